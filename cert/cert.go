@@ -63,6 +63,54 @@ func (m *mkcert) makeCert(hosts []string) {
 	// including custom roots. See https://support.apple.com/en-us/HT210176.
 	expiration := time.Now().AddDate(2, 3, 0)
 
+	tpl := m.certTemplate(hosts, expiration)
+
+	cert, err := x509.CreateCertificate(rand.Reader, tpl, m.caCert, pub, m.caKey)
+	fatalIfErr(err, "failed to generate certificate")
+
+	certFile, keyFile, p12File := m.fileNames(hosts)
+
+	if !m.pkcs12 {
+		certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert})
+		privDER, err := x509.MarshalPKCS8PrivateKey(priv)
+		fatalIfErr(err, "failed to encode certificate key")
+		privPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privDER})
+
+		if certFile == keyFile {
+			err = ioutil.WriteFile(keyFile, append(certPEM, privPEM...), 0600)
+			fatalIfErr(err, "failed to save certificate and key")
+		} else {
+			err = ioutil.WriteFile(certFile, certPEM, 0644)
+			fatalIfErr(err, "failed to save certificate")
+			err = ioutil.WriteFile(keyFile, privPEM, 0600)
+			fatalIfErr(err, "failed to save certificate key")
+		}
+	} else {
+		domainCert, _ := x509.ParseCertificate(cert)
+		pfxData, err := pkcs12.Encode(rand.Reader, priv, domainCert, []*x509.Certificate{m.caCert}, DefaultPassword)
+		fatalIfErr(err, "failed to generate PKCS#12")
+		err = ioutil.WriteFile(p12File, pfxData, 0644)
+		fatalIfErr(err, "failed to save PKCS#12")
+	}
+
+	m.printHosts(hosts)
+
+	if !m.pkcs12 {
+		if certFile == keyFile {
+			log.Printf("\nThe certificate and key are at \"%s\" \n\n", certFile)
+		} else {
+			log.Printf("\nThe certificate is at \"%s\" and the key at \"%s\" \n\n", certFile, keyFile)
+		}
+	} else {
+		log.Printf("\nThe PKCS#12 bundle is at \"%s\" \n", p12File)
+		log.Printf("\nThe legacy PKCS#12 encryption password is the often hardcoded default \"%s\" \n\n", DefaultPassword)
+	}
+
+	log.Printf("It will expire on %s \n\n", expiration.Format("2 January 2006"))
+}
+
+// certTemplate returns the template of a leaf certificate valid for hosts.
+func (m *mkcert) certTemplate(hosts []string, expiration time.Time) *x509.Certificate {
 	tpl := &x509.Certificate{
 		SerialNumber: randomSerialNumber(),
 		Subject: pkix.Name{
@@ -115,48 +163,7 @@ func (m *mkcert) makeCert(hosts []string) {
 		tpl.Subject.CommonName = hosts[0]
 	}
 
-	cert, err := x509.CreateCertificate(rand.Reader, tpl, m.caCert, pub, m.caKey)
-	fatalIfErr(err, "failed to generate certificate")
-
-	certFile, keyFile, p12File := m.fileNames(hosts)
-
-	if !m.pkcs12 {
-		certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert})
-		privDER, err := x509.MarshalPKCS8PrivateKey(priv)
-		fatalIfErr(err, "failed to encode certificate key")
-		privPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privDER})
-
-		if certFile == keyFile {
-			err = ioutil.WriteFile(keyFile, append(certPEM, privPEM...), 0600)
-			fatalIfErr(err, "failed to save certificate and key")
-		} else {
-			err = ioutil.WriteFile(certFile, certPEM, 0644)
-			fatalIfErr(err, "failed to save certificate")
-			err = ioutil.WriteFile(keyFile, privPEM, 0600)
-			fatalIfErr(err, "failed to save certificate key")
-		}
-	} else {
-		domainCert, _ := x509.ParseCertificate(cert)
-		pfxData, err := pkcs12.Encode(rand.Reader, priv, domainCert, []*x509.Certificate{m.caCert}, DefaultPassword)
-		fatalIfErr(err, "failed to generate PKCS#12")
-		err = ioutil.WriteFile(p12File, pfxData, 0644)
-		fatalIfErr(err, "failed to save PKCS#12")
-	}
-
-	m.printHosts(hosts)
-
-	if !m.pkcs12 {
-		if certFile == keyFile {
-			log.Printf("\nThe certificate and key are at \"%s\" \n\n", certFile)
-		} else {
-			log.Printf("\nThe certificate is at \"%s\" and the key at \"%s\" \n\n", certFile, keyFile)
-		}
-	} else {
-		log.Printf("\nThe PKCS#12 bundle is at \"%s\" \n", p12File)
-		log.Printf("\nThe legacy PKCS#12 encryption password is the often hardcoded default \"%s\" \n\n", DefaultPassword)
-	}
-
-	log.Printf("It will expire on %s \n\n", expiration.Format("2 January 2006"))
+	return tpl
 }
 
 func (m *mkcert) printHosts(hosts []string) {
@@ -303,14 +310,12 @@ func (m *mkcert) loadCA(createCA bool) error {
 		m.newCA()
 	}
 
-	certPEMBlock, err := ioutil.ReadFile(filepath.Join(m.CAROOT, rootName))
-	fatalIfErr(err, "failed to read the CA certificate")
-	certDERBlock, _ := pem.Decode(certPEMBlock)
-	if certDERBlock == nil || certDERBlock.Type != "CERTIFICATE" {
-		log.Fatalln("ERROR: failed to read the CA certificate: unexpected content")
+	// errors are returned, the proxy issues certificates on config reloads.
+	certs, err := readCertificates(caPath)
+	if err != nil {
+		return fmt.Errorf("failed to read the CA certificate: %v", err)
 	}
-	m.caCert, err = x509.ParseCertificate(certDERBlock.Bytes)
-	fatalIfErr(err, "failed to parse the CA certificate")
+	m.caCert = certs[0]
 
 	if !pathExists(filepath.Join(m.CAROOT, rootKeyName)) {
 		// keyless mode, where only -install works
@@ -318,16 +323,48 @@ func (m *mkcert) loadCA(createCA bool) error {
 	}
 
 	keyPEMBlock, err := ioutil.ReadFile(filepath.Join(m.CAROOT, rootKeyName))
-	fatalIfErr(err, "failed to read the CA key")
+	if err != nil {
+		return fmt.Errorf("failed to read the CA key: %v", err)
+	}
 	keyDERBlock, _ := pem.Decode(keyPEMBlock)
 	if keyDERBlock == nil || keyDERBlock.Type != "PRIVATE KEY" {
-		log.Fatalln("ERROR: failed to read the CA key: unexpected content")
+		return errors.New("failed to read the CA key: unexpected content")
 	}
 	m.caKey, err = x509.ParsePKCS8PrivateKey(keyDERBlock.Bytes)
-	fatalIfErr(err, "failed to parse the CA key")
+	if err != nil {
+		return fmt.Errorf("failed to parse the CA key: %v", err)
+	}
 	return nil
 }
 
+// readCertificates parses all PEM encoded certificates of a file.
+func readCertificates(path string) ([]*x509.Certificate, error) {
+	certPEMBlock, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var certs []*x509.Certificate
+	for {
+		var certDERBlock *pem.Block
+		certDERBlock, certPEMBlock = pem.Decode(certPEMBlock)
+		if certDERBlock == nil {
+			break
+		}
+		if certDERBlock.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(certDERBlock.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return nil, errors.New("unexpected content")
+	}
+	return certs, nil
+}
+
 func (m *mkcert) newCA() {
 	priv, err := m.generateKey(true)
 	fatalIfErr(err, "failed to generate the CA key")
@@ -2,8 +2,11 @@ package cert
 
 import (
 	"crypto"
+	"crypto/rand"
+	"crypto/tls"
 	"crypto/x509"
 	"errors"
+	"fmt"
 	"log"
 	"os"
 	"os/exec"
@@ -11,6 +14,7 @@ import (
 	"path/filepath"
 	"strings"
 	"sync"
+	"time"
 )
 
 const rootName = "rootCA.pem"
@@ -83,6 +87,58 @@ func CreateCert(csrFile string, domainName string) error {
 	return m.create(strings.Split(domainName, " "))
 }
 
+// CertPool returns a pool with the certificates of a PEM bundle, for verifying
+// peers signed by a custom CA. An empty caFile loads the local root CA.
+func CertPool(caFile string) (*x509.CertPool, error) {
+	if len(caFile) == 0 {
+		caRoot := getCAROOT()
+		if caRoot == "" {
+			return nil, errors.New("failed to find the default CA location")
+		}
+		caFile = filepath.Join(caRoot, rootName)
+	}
+	certs, err := readCertificates(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the CA bundle %s: %v", caFile, err)
+	}
+	pool := x509.NewCertPool()
+	for _, cert := range certs {
+		pool.AddCert(cert)
+	}
+	return pool, nil
+}
+
+// IssueCertificate issues an in-memory server certificate for hosts, signed by
+// the local root CA, for serving tls without writing a key to disk.
+func IssueCertificate(hosts []string) (*tls.Certificate, error) {
+	m := &mkcert{ecdsa: true}
+	m.CAROOT = getCAROOT()
+	if m.CAROOT == "" {
+		return nil, errors.New("failed to find the default CA location")
+	}
+	err := m.loadCA(false)
+	if err != nil {
+		return nil, err
+	}
+	if m.caKey == nil {
+		return nil, errors.New("can't create new certificates because the CA key (rootCA-key.pem) is missing")
+	}
+
+	priv, err := m.generateKey(false)
+	if err != nil {
+		return nil, err
+	}
+	tpl := m.certTemplate(hosts, time.Now().AddDate(2, 3, 0))
+	cert, err := x509.CreateCertificate(rand.Reader, tpl, m.caCert, priv.(crypto.Signer).Public(), m.caKey)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Certificate{
+		Certificate: [][]byte{cert, m.caCert.Raw},
+		PrivateKey:  priv,
+	}, nil
+}
+
 func (m *mkcert) create(args []string) error {
 	var warning bool
 	if storeEnabled("system") && !m.checkPlatform() {
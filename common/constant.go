@@ -3,15 +3,12 @@ package common
 const (
 	StealthDnsIp        = "127.0.0.1"
 	DnsUdpPort          = 53
+	DnsTlsPort          = 853
+	DnsHttpsPort        = 443
 	NhpDomainNameSuffix = ".nhp"
 	DefaultUpstreamDNS  = "8.8.8.8"
 )
 
-const (
-	Type_A = iota
-	Type_AAAA
-)
-
 const (
 	AgentInit          = "nhp_agent_init"
 	AgentClose         = "nhp_agent_close"
@@ -0,0 +1,307 @@
+package dns
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/OpenNHP/opennhp/nhp/log"
+	"github.com/miekg/dns"
+	"github.com/pelletier/go-toml/v2"
+
+	"github.com/OpenNHP/StealthDNS/common"
+)
+
+const (
+	defaultAdminAddr     = "127.0.0.1:5380"
+	adminShutdownTimeout = 2 * time.Second
+	adminClientTimeout   = 5 * time.Second
+	// adminTokenFile is kept next to config.toml, only its readers may call
+	// the admin api.
+	adminTokenFile = "admin.token"
+)
+
+var errAdminDisabled = errors.New("admin api is disabled in the config")
+
+// adminServer serves the cache admin api of the proxy to the "stealth-dns cache"
+// command. It only listens on loopback addresses.
+type adminServer struct {
+	server *http.Server
+}
+
+// adminAddr returns the listen address of the admin api, or an error if it is
+// disabled or not a loopback address.
+func adminAddr(conf *AdminConfig) (string, error) {
+	if conf.Disable {
+		return "", errAdminDisabled
+	}
+	if len(conf.Listen) == 0 {
+		return defaultAdminAddr, nil
+	}
+	host, _, err := net.SplitHostPort(conf.Listen)
+	if err != nil {
+		return "", err
+	}
+	if ip := net.ParseIP(host); ip == nil || !ip.IsLoopback() {
+		return "", fmt.Errorf("admin api address %s is not a loopback address", conf.Listen)
+	}
+	return conf.Listen, nil
+}
+
+// adminToken reads the token of the admin api from file, a new one is
+// generated if create is set and the file does not exist.
+func adminToken(file string, create bool) (string, error) {
+	content, err := os.ReadFile(file)
+	if err == nil || !create || !errors.Is(err, os.ErrNotExist) {
+		token := strings.TrimSpace(string(content))
+		if err == nil && len(token) == 0 {
+			err = fmt.Errorf("admin token file %s is empty", file)
+		}
+		return token, err
+	}
+	b := make([]byte, 32)
+	if _, err = rand.Read(b); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(b)
+	if err = os.WriteFile(file, []byte(token+"\n"), 0600); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// newAdminServer returns nil if the admin api is disabled or misconfigured.
+func (p *ProxyService) newAdminServer(conf *AdminConfig) *adminServer {
+	addr, err := adminAddr(conf)
+	if err != nil {
+		if !errors.Is(err, errAdminDisabled) {
+			log.Error("admin api not started: %v", err)
+		}
+		return nil
+	}
+	token, err := adminToken(filepath.Join(common.ExeDirPath, "etc", adminTokenFile), true)
+	if err != nil {
+		log.Error("admin api not started: %v", err)
+		return nil
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/cache/stats", p.serveCacheStats)
+	mux.HandleFunc("/cache/entries", p.serveCacheEntries)
+	mux.HandleFunc("/cache/ttl", p.serveResourceTTL)
+	mux.HandleFunc("/cache/flush", p.serveCacheFlush)
+	s := &adminServer{
+		server: &http.Server{
+			Addr:              addr,
+			Handler:           guardAdmin(addr, token, mux),
+			ReadHeaderTimeout: 5 * time.Second,
+		},
+	}
+	go func() {
+		log.Info("admin api listening on %s", addr)
+		if err := s.server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Error("admin api on %s failed: %v", addr, err)
+		}
+	}()
+	return s
+}
+
+func (s *adminServer) close() {
+	if s == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), adminShutdownTimeout)
+	defer cancel()
+	_ = s.server.Shutdown(ctx)
+}
+
+// guardAdmin keeps web pages from reaching the admin api of the local host,
+// also through a dns rebinding name, and requires the token of the api.
+func guardAdmin(addr, token string, next http.Handler) http.Handler {
+	_, port, _ := net.SplitHostPort(addr)
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if len(req.Header.Get("Origin")) > 0 {
+			http.Error(rw, "cross origin requests are refused", http.StatusForbidden)
+			return
+		}
+		if !loopbackHost(req.Host, port) {
+			http.Error(rw, "host "+req.Host+" is refused", http.StatusForbidden)
+			return
+		}
+		auth := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(auth), []byte(token)) != 1 {
+			http.Error(rw, "invalid admin token", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(rw, req)
+	})
+}
+
+// loopbackHost reports whether the host header names a loopback address or
+// localhost with port.
+func loopbackHost(hostport, port string) bool {
+	host, p, err := net.SplitHostPort(hostport)
+	if err != nil || p != port {
+		return false
+	}
+	if strings.EqualFold(host, "localhost") {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+func (p *ProxyService) serveCacheStats(rw http.ResponseWriter, req *http.Request) {
+	writeAdminJSON(rw, p.CacheStats())
+}
+
+func (p *ProxyService) serveCacheEntries(rw http.ResponseWriter, req *http.Request) {
+	writeAdminJSON(rw, p.CacheEntries())
+}
+
+func (p *ProxyService) serveResourceTTL(rw http.ResponseWriter, req *http.Request) {
+	ttl, found := p.ResourceTTL(req.URL.Query().Get("resource"))
+	if !found {
+		http.Error(rw, "resource not cached", http.StatusNotFound)
+		return
+	}
+	writeAdminJSON(rw, ttl)
+}
+
+// serveCacheFlush flushes the answers of a name and type, all types if the
+// type is empty, or both caches without a name.
+func (p *ProxyService) serveCacheFlush(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(rw, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	name := req.URL.Query().Get("name")
+	if len(name) == 0 {
+		p.FlushCache()
+		writeAdminJSON(rw, -1)
+		return
+	}
+	qtype, err := parseQtype(req.URL.Query().Get("type"))
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeAdminJSON(rw, p.FlushCacheName(name, qtype))
+}
+
+func writeAdminJSON(rw http.ResponseWriter, v interface{}) {
+	rw.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(rw).Encode(v); err != nil {
+		log.Error("failed to write admin api answer: %v", err)
+	}
+}
+
+// parseQtype parses a query type like "AAAA", an empty type is dns.TypeNone.
+func parseQtype(qtype string) (uint16, error) {
+	if len(qtype) == 0 {
+		return dns.TypeNone, nil
+	}
+	if t, found := dns.StringToType[strings.ToUpper(qtype)]; found {
+		return t, nil
+	}
+	return 0, fmt.Errorf("unknown query type %s", qtype)
+}
+
+// AdminClient calls the admin api of a running proxy.
+type AdminClient struct {
+	base   string
+	token  string
+	client *http.Client
+}
+
+// NewAdminClient returns a client of the admin api configured in a config.toml
+// file, with the token stored next to it by the proxy.
+func NewAdminClient(configFile string) (*AdminClient, error) {
+	content, err := os.ReadFile(configFile)
+	if err != nil {
+		return nil, err
+	}
+	var conf Config
+	if err := toml.Unmarshal(content, &conf); err != nil {
+		return nil, err
+	}
+	addr, err := adminAddr(&conf.Admin)
+	if err != nil {
+		return nil, err
+	}
+	token, err := adminToken(filepath.Join(filepath.Dir(configFile), adminTokenFile), false)
+	if err != nil {
+		return nil, fmt.Errorf("stealth dns is not running or its admin token is not readable: %v", err)
+	}
+	return &AdminClient{
+		base:   "http://" + addr,
+		token:  token,
+		client: &http.Client{Timeout: adminClientTimeout},
+	}, nil
+}
+
+func (c *AdminClient) call(method, path string, query url.Values, v interface{}) error {
+	target := c.base + path
+	if len(query) > 0 {
+		target += "?" + query.Encode()
+	}
+	req, err := http.NewRequest(method, target, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("stealth dns is not running: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var msg bytes.Buffer
+		_, _ = msg.ReadFrom(resp.Body)
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(msg.String()))
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// CacheStats returns the counters of the caches of the running proxy.
+func (c *AdminClient) CacheStats() (stats map[string]CacheStats, err error) {
+	err = c.call(http.MethodGet, "/cache/stats", nil, &stats)
+	return stats, err
+}
+
+// CacheEntries lists the cached entries of the running proxy.
+func (c *AdminClient) CacheEntries() (entries map[string][]CacheEntry, err error) {
+	err = c.call(http.MethodGet, "/cache/entries", nil, &entries)
+	return entries, err
+}
+
+// ResourceTTL returns how long the answer of a knocked resource stays cached.
+func (c *AdminClient) ResourceTTL(resId string) (ttl time.Duration, err error) {
+	err = c.call(http.MethodGet, "/cache/ttl", url.Values{"resource": {resId}}, &ttl)
+	return ttl, err
+}
+
+// FlushCache flushes the cached answers of name and qtype, of all types if
+// qtype is empty. It returns the number of flushed entries.
+func (c *AdminClient) FlushCache(name, qtype string) (flushed int, err error) {
+	query := url.Values{"name": {name}, "type": {qtype}}
+	err = c.call(http.MethodPost, "/cache/flush", query, &flushed)
+	return flushed, err
+}
+
+// FlushAllCaches removes all entries of the caches of the running proxy.
+func (c *AdminClient) FlushAllCaches() error {
+	var flushed int
+	return c.call(http.MethodPost, "/cache/flush", nil, &flushed)
+}
@@ -0,0 +1,426 @@
+package dns
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/OpenNHP/opennhp/nhp/log"
+	"github.com/OpenNHP/opennhp/nhp/utils"
+	"github.com/miekg/dns"
+)
+
+// blocklist formats.
+const (
+	BlocklistHosts   = "hosts"
+	BlocklistAdblock = "adblock"
+	BlocklistRPZ     = "rpz"
+)
+
+const (
+	// blockRouteTable is the name of the table routing blocked names.
+	blockRouteTable = "block"
+
+	defaultBlocklistRefresh = 24 * 60 * 60
+	blocklistFetchTimeout   = 60 * time.Second
+	blocklistMaxBytes       = 64 << 20
+	// an url source that was never fetched is retried with a backoff
+	// doubling from the min to the max retry interval.
+	blocklistMinRetry = 10 * time.Second
+	blocklistMaxRetry = 10 * time.Minute
+
+	// rpzOrigin is the origin of relative RPZ owners before any $ORIGIN.
+	rpzOrigin = "rpz."
+)
+
+// blockRule blocks or allows a name itself and, if below is set, its subdomains.
+type blockRule struct {
+	name  string
+	self  bool
+	below bool
+	allow bool
+}
+
+// blockNode is a node of the blocklist trie, keyed by labels from the root.
+type blockNode struct {
+	children   map[string]*blockNode
+	block      bool
+	blockBelow bool
+	allow      bool
+	allowBelow bool
+}
+
+// blockTrie matches names against the rules by suffix, the most specific
+// rule wins and allowing wins over blocking at the same name.
+type blockTrie struct {
+	root  *blockNode
+	rules int
+}
+
+func newBlockTrie() *blockTrie {
+	return &blockTrie{root: &blockNode{}}
+}
+
+func (t *blockTrie) insert(rule blockRule) {
+	node := t.root
+	labels := dns.SplitDomainName(rule.name)
+	for i := len(labels) - 1; i >= 0; i-- {
+		child, found := node.children[labels[i]]
+		if !found {
+			if node.children == nil {
+				node.children = make(map[string]*blockNode)
+			}
+			child = &blockNode{}
+			node.children[labels[i]] = child
+		}
+		node = child
+	}
+	if rule.allow {
+		node.allow = node.allow || rule.self
+		node.allowBelow = node.allowBelow || rule.below
+	} else {
+		node.block = node.block || rule.self
+		node.blockBelow = node.blockBelow || rule.below
+	}
+	t.rules++
+}
+
+// blocked reports whether the normalised name is blocked.
+func (t *blockTrie) blocked(name string) bool {
+	blocked := false
+	node := t.root
+	labels := dns.SplitDomainName(name)
+	for i := len(labels) - 1; i >= 0; i-- {
+		if node.allowBelow {
+			blocked = false
+		} else if node.blockBelow {
+			blocked = true
+		}
+		child, found := node.children[labels[i]]
+		if !found {
+			return blocked
+		}
+		node = child
+	}
+	if node.allow {
+		return false
+	}
+	return blocked || node.block
+}
+
+// parseBlocklist reads the rules of a blocklist in format.
+func parseBlocklist(r io.Reader, format string, source string) ([]blockRule, error) {
+	switch strings.ToLower(format) {
+	case "", BlocklistHosts:
+		return parseHostsBlocklist(r)
+	case BlocklistAdblock:
+		return parseAdblockBlocklist(r)
+	case BlocklistRPZ:
+		return parseRPZBlocklist(r, source)
+	default:
+		return nil, fmt.Errorf("unknown blocklist format %q", format)
+	}
+}
+
+// parseHostsBlocklist reads "address name [names...]" lines of hosts files,
+// or a name per line. The names are blocked, not their subdomains.
+func parseHostsBlocklist(r io.Reader) ([]blockRule, error) {
+	var rules []blockRule
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(line)
+		if len(fields) > 1 && net.ParseIP(fields[0]) != nil {
+			fields = fields[1:]
+		}
+		for _, field := range fields {
+			name := normalizeName(field)
+			switch name {
+			case "localhost.", "localhost.localdomain.", "local.", "broadcasthost.", "ip6-localhost.", "ip6-loopback.":
+				continue
+			}
+			if _, ok := dns.IsDomainName(name); ok && net.ParseIP(field) == nil {
+				rules = append(rules, blockRule{name: name, self: true})
+			}
+		}
+	}
+	return rules, scanner.Err()
+}
+
+// parseAdblockBlocklist reads the domain rules "||example.com^" of adblock
+// filter lists, which block the domain and its subdomains, and their
+// "@@||example.com^" exceptions. Other rules don't apply to dns.
+func parseAdblockBlocklist(r io.Reader) ([]blockRule, error) {
+	var rules []blockRule
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || line[0] == '!' || line[0] == '[' {
+			continue
+		}
+		allow := false
+		if rest, ok := strings.CutPrefix(line, "@@"); ok {
+			allow, line = true, rest
+		}
+		rest, ok := strings.CutPrefix(line, "||")
+		if !ok {
+			continue
+		}
+		// only rules for a whole domain, "^" may be followed by options.
+		name, options, ok := strings.Cut(rest, "^")
+		if !ok || (len(options) > 0 && options[0] != '$') || strings.ContainsAny(name, "/*") {
+			continue
+		}
+		name = normalizeName(name)
+		if _, ok := dns.IsDomainName(name); ok {
+			rules = append(rules, blockRule{name: name, self: true, below: true, allow: allow})
+		}
+	}
+	return rules, scanner.Err()
+}
+
+// parseRPZBlocklist reads a response policy zone. "name CNAME rpz-passthru."
+// allows a name, any other trigger blocks it, a "*." owner covers the
+// subdomains. Owners are relative to the zone origin, the owner of the SOA
+// record. Relative owners of a file without $ORIGIN are kept even if the SOA
+// owner is another name.
+func parseRPZBlocklist(r io.Reader, source string) ([]blockRule, error) {
+	var rules []blockRule
+	origin := ""
+	zp := dns.NewZoneParser(r, rpzOrigin, source)
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		owner := normalizeName(rr.Header().Name)
+		switch rr.Header().Rrtype {
+		case dns.TypeSOA:
+			origin = owner
+			continue
+		case dns.TypeNS:
+			continue
+		}
+		name, ok := cutOrigin(owner, origin)
+		if !ok {
+			name, ok = cutOrigin(owner, rpzOrigin)
+		}
+		if !ok {
+			continue
+		}
+		rule := blockRule{name: dns.Fqdn(name), self: true}
+		if wildcard, ok := strings.CutPrefix(rule.name, "*."); ok {
+			rule.name, rule.self, rule.below = wildcard, false, true
+		}
+		if cname, ok := rr.(*dns.CNAME); ok && isPassthru(cname.Target, origin) {
+			rule.allow = true
+		}
+		rules = append(rules, rule)
+	}
+	return rules, zp.Err()
+}
+
+// cutOrigin returns the owner relative to origin.
+func cutOrigin(owner, origin string) (string, bool) {
+	if len(origin) == 0 || origin == "." {
+		return "", false
+	}
+	return strings.CutSuffix(owner, "."+origin)
+}
+
+// isPassthru reports whether a CNAME target is the rpz-passthru action, also
+// when written relative to the origin.
+func isPassthru(target, origin string) bool {
+	target = normalizeName(target)
+	return target == "rpz-passthru." || target == "rpz-passthru."+origin || target == "rpz-passthru."+rpzOrigin
+}
+
+// blocklist compiles the blocklist sources and the allowlist into a trie,
+// refreshing url sources on their interval and file sources when edited.
+type blocklist struct {
+	trie   atomic.Pointer[blockTrie]
+	policy atomic.Pointer[failurePolicy]
+
+	// retry is the first retry interval of url sources never fetched.
+	retry time.Duration
+
+	mu      sync.Mutex
+	conf    BlockConfig
+	rules   [][]blockRule
+	watches []io.Closer
+	stop    chan struct{}
+}
+
+func newBlocklist() *blocklist {
+	b := &blocklist{retry: blocklistMinRetry}
+	b.trie.Store(newBlockTrie())
+	b.policy.Store(newFailurePolicy(&FailureConfig{}))
+	return b
+}
+
+func (b *blocklist) setConfig(conf *BlockConfig) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.closeSources()
+
+	b.conf = *conf
+	b.policy.Store(newFailurePolicy(&FailureConfig{
+		Response:     conf.Response,
+		TTL:          conf.TTL,
+		SinkholeIPv4: conf.SinkholeIPv4,
+		SinkholeIPv6: conf.SinkholeIPv6,
+	}))
+	b.rules = make([][]blockRule, len(conf.Lists))
+	stop := make(chan struct{})
+	b.stop = stop
+	for i, list := range conf.Lists {
+		if isURL(list.Source) {
+			go b.refreshURL(i, list, stop)
+			continue
+		}
+		index, source := i, list
+		b.rules[index] = loadBlocklistFile(source)
+		b.watches = append(b.watches, utils.WatchFile(localFilePath(source.Source), func() {
+			log.Info("blocklist: %s has been updated", source.Source)
+			rules := loadBlocklistFile(source)
+			b.mu.Lock()
+			defer b.mu.Unlock()
+			if b.stop == stop {
+				b.rules[index] = rules
+				b.compile()
+			}
+		}))
+	}
+	b.compile()
+}
+
+// closeSources stops the refreshers and watches, the lock must be held.
+func (b *blocklist) closeSources() {
+	if b.stop != nil {
+		close(b.stop)
+		b.stop = nil
+	}
+	for _, watch := range b.watches {
+		_ = watch.Close()
+	}
+	b.watches = nil
+}
+
+func (b *blocklist) close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.closeSources()
+}
+
+// compile builds the trie of the rules, the lock must be held.
+func (b *blocklist) compile() {
+	trie := newBlockTrie()
+	for _, rules := range b.rules {
+		for _, rule := range rules {
+			trie.insert(rule)
+		}
+	}
+	for _, name := range b.conf.Allowlist {
+		trie.insert(blockRule{name: normalizeName(strings.TrimSpace(name)), self: true, below: true, allow: true})
+	}
+	b.trie.Store(trie)
+	log.Info("blocklist compiled with %d rules", trie.rules)
+}
+
+func (b *blocklist) refreshURL(index int, list *BlocklistConfig, stop chan struct{}) {
+	interval := time.Duration(list.RefreshInterval) * time.Second
+	if interval <= 0 {
+		interval = defaultBlocklistRefresh * time.Second
+	}
+	retry, fetched := b.retry, false
+	for {
+		wait := interval
+		rules, err := fetchBlocklist(list)
+		if err != nil {
+			// keep the rules of the last successful fetch, or retry soon
+			// if there are none yet.
+			log.Error("failed to fetch blocklist %s: %v", list.Source, err)
+			if !fetched {
+				wait = min(retry, interval)
+				retry = min(retry*2, blocklistMaxRetry)
+			}
+		} else {
+			fetched = true
+			b.mu.Lock()
+			if b.stop == stop {
+				b.rules[index] = rules
+				b.compile()
+			}
+			b.mu.Unlock()
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-stop:
+			timer.Stop()
+			return
+		}
+	}
+}
+
+func isURL(source string) bool {
+	return strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://")
+}
+
+func loadBlocklistFile(list *BlocklistConfig) []blockRule {
+	f, err := os.Open(localFilePath(list.Source))
+	if err != nil {
+		log.Error("failed to read blocklist %s: %v", list.Source, err)
+		return nil
+	}
+	defer f.Close()
+	rules, err := parseBlocklist(f, list.Format, list.Source)
+	if err != nil {
+		log.Error("failed to parse blocklist %s: %v", list.Source, err)
+	}
+	return rules
+}
+
+func fetchBlocklist(list *BlocklistConfig) ([]blockRule, error) {
+	client := &http.Client{Timeout: blocklistFetchTimeout}
+	resp, err := client.Get(list.Source)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("http status %s", resp.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, blocklistMaxBytes))
+	if err != nil {
+		return nil, err
+	}
+	return parseBlocklist(bytes.NewReader(body), list.Format, list.Source)
+}
+
+// routeBlock blocks the names matching the blocklists.
+func (p *ProxyService) routeBlock(name string, qtype uint16) *Route {
+	if p.blocklist.trie.Load().blocked(name) {
+		return &Route{Action: RouteBlock}
+	}
+	return nil
+}
+
+// blockAnswer answers a blocked name with the block response, or the one of
+// the policy rule that blocked it.
+func (p *ProxyService) blockAnswer(w dns.ResponseWriter, r *dns.Msg, route *Route) {
+	policy := p.blocklist.policy.Load()
+	response, ttl := policy.response, policy.ttl
+	if len(route.Response) > 0 {
+		response = route.Response
+	}
+	if route.TTL > 0 {
+		ttl = route.TTL
+	}
+	m := policy.answer(r, response, ttl, &dns.EDNS0_EDE{InfoCode: dns.ExtendedErrorCodeBlocked})
+	p.writeMsg(w, r, m)
+}
@@ -0,0 +1,216 @@
+package dns
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func testBlockTrie(t *testing.T, format, list string) *blockTrie {
+	rules, err := parseBlocklist(strings.NewReader(list), format, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	trie := newBlockTrie()
+	for _, rule := range rules {
+		trie.insert(rule)
+	}
+	return trie
+}
+
+func TestBlocklistFormats(t *testing.T) {
+	tests := []struct {
+		name    string
+		format  string
+		list    string
+		blocked []string
+		allowed []string
+	}{
+		{
+			name:   "hosts block the names only",
+			format: BlocklistHosts,
+			list: `# comment
+0.0.0.0 ads.example.com tracker.example.com # trailing
+127.0.0.1 localhost
+::1 ip6-localhost
+Metrics.Example.NET
+0.0.0.0 192.0.2.1
+`,
+			blocked: []string{"ads.example.com.", "ADS.example.com.", "tracker.example.com.", "metrics.example.net."},
+			allowed: []string{"x.ads.example.com.", "example.com.", "badads.example.com.", "localhost.", "ip6-localhost.", "192.0.2.1."},
+		},
+		{
+			name:   "adblock blocks the subdomains",
+			format: BlocklistAdblock,
+			list: `[Adblock Plus 2.0]
+! comment
+||ads.example.com^
+||tracker.example.org^$third-party
+||cdn.example.net/path^
+||*.wild.example^
+example.org##.banner
+/banner/*
+`,
+			blocked: []string{"ads.example.com.", "a.b.ads.example.com.", "tracker.example.org."},
+			allowed: []string{"badads.example.com.", "example.com.", "cdn.example.net.", "x.wild.example.", "example.org."},
+		},
+		{
+			name:   "rpz triggers, wildcards and passthru",
+			format: BlocklistRPZ,
+			list: `$TTL 300
+@ SOA localhost. root.localhost. 1 3600 600 86400 60
+  NS  localhost.
+ads.example.com CNAME .
+*.ads.example.com CNAME .
+*.tracker.example CNAME *.
+ok.tracker.example CNAME rpz-passthru.
+sink.example A 0.0.0.0
+`,
+			blocked: []string{"ads.example.com.", "x.ads.example.com.", "a.tracker.example.", "b.ok.tracker.example."},
+			allowed: []string{"tracker.example.", "ok.tracker.example.", "example.com.", "badads.example.com."},
+		},
+		{
+			// the SOA owner differs from the default origin of the relative owners.
+			name:   "rpz with an absolute SOA owner",
+			format: BlocklistRPZ,
+			list: `rpz.example.org. 300 IN SOA localhost. root.localhost. 1 3600 600 86400 60
+rpz.example.org. 300 IN NS localhost.
+ads.example.com 300 IN CNAME .
+safe.ads.example.com 300 IN CNAME rpz-passthru
+abs.example.com.rpz.example.org. 300 IN CNAME .
+other.example.net. 300 IN CNAME .
+`,
+			blocked: []string{"ads.example.com.", "abs.example.com."},
+			allowed: []string{"safe.ads.example.com.", "other.example.net.", "rpz.example.org."},
+		},
+		{
+			name:   "rpz with an $ORIGIN",
+			format: BlocklistRPZ,
+			list: `$ORIGIN block.local.
+@ 300 IN SOA localhost. root.localhost. 1 3600 600 86400 60
+ads.example.com 300 IN CNAME .
+*.example.org 300 IN CNAME .
+www.example.org 300 IN CNAME rpz-passthru.
+`,
+			blocked: []string{"ads.example.com.", "x.example.org."},
+			allowed: []string{"www.example.org.", "example.org.", "block.local."},
+		},
+	}
+	for _, tt := range tests {
+		trie := testBlockTrie(t, tt.format, tt.list)
+		for _, name := range tt.blocked {
+			if !trie.blocked(normalizeName(name)) {
+				t.Errorf("%s: %s is not blocked", tt.name, name)
+			}
+		}
+		for _, name := range tt.allowed {
+			if trie.blocked(normalizeName(name)) {
+				t.Errorf("%s: %s is blocked", tt.name, name)
+			}
+		}
+	}
+
+	if _, err := parseBlocklist(strings.NewReader(""), "unknown", "test"); err == nil {
+		t.Error("unknown format is accepted")
+	}
+}
+
+func TestBlocklistPrecedence(t *testing.T) {
+	trie := testBlockTrie(t, BlocklistAdblock, `||example.com^
+@@||safe.example.com^
+||ads.safe.example.com^
+@@||ads.example.com^
+||ads.example.com^
+`)
+	tests := []struct {
+		name    string
+		blocked bool
+	}{
+		{name: "example.com.", blocked: true},
+		{name: "www.example.com.", blocked: true},
+		// the most specific rule wins.
+		{name: "safe.example.com.", blocked: false},
+		{name: "www.safe.example.com.", blocked: false},
+		{name: "ads.safe.example.com.", blocked: true},
+		{name: "x.ads.safe.example.com.", blocked: true},
+		// an exception wins over a block of the same name.
+		{name: "ads.example.com.", blocked: false},
+		{name: "x.ads.example.com.", blocked: false},
+	}
+	for _, tt := range tests {
+		if blocked := trie.blocked(tt.name); blocked != tt.blocked {
+			t.Errorf("%s blocked %t, want %t", tt.name, blocked, tt.blocked)
+		}
+	}
+}
+
+func TestBlocklistAllowlist(t *testing.T) {
+	dir := t.TempDir()
+	hosts := filepath.Join(dir, "hosts")
+	adblock := filepath.Join(dir, "adblock.txt")
+	if err := os.WriteFile(hosts, []byte("0.0.0.0 ads.example.com cdn.example.org\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(adblock, []byte("||example.net^\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	b := newBlocklist()
+	defer b.close()
+	b.setConfig(&BlockConfig{
+		Allowlist: []string{"cdn.example.org", " Example.NET "},
+		Lists: []*BlocklistConfig{
+			{Source: hosts},
+			{Source: adblock, Format: BlocklistAdblock},
+		},
+	})
+	trie := b.trie.Load()
+	for name, want := range map[string]bool{
+		"ads.example.com.":     true,
+		"cdn.example.org.":     false,
+		"example.net.":         false,
+		"www.example.net.":     false,
+		"www.ads.example.com.": false,
+	} {
+		if blocked := trie.blocked(name); blocked != want {
+			t.Errorf("%s blocked %t, want %t", name, blocked, want)
+		}
+	}
+}
+
+func TestBlocklistRefreshRetry(t *testing.T) {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if requests.Add(1) <= 2 {
+			http.Error(rw, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = rw.Write([]byte("||ads.example.com^\n"))
+	}))
+	defer server.Close()
+
+	b := newBlocklist()
+	b.retry = 5 * time.Millisecond
+	defer b.close()
+	b.setConfig(&BlockConfig{
+		Lists: []*BlocklistConfig{{Source: server.URL, Format: BlocklistAdblock, RefreshInterval: 3600}},
+	})
+
+	deadline := time.Now().Add(2 * time.Second)
+	for !b.trie.Load().blocked("ads.example.com.") {
+		if time.Now().After(deadline) {
+			t.Fatalf("blocklist not fetched after %d requests", requests.Load())
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	// fetched, the next one is after the refresh interval.
+	time.Sleep(50 * time.Millisecond)
+	if n := requests.Load(); n != 3 {
+		t.Errorf("%d requests, want 3", n)
+	}
+}
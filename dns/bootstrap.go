@@ -0,0 +1,117 @@
+package dns
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const minBootstrapTTL = 60 * time.Second
+
+// bootstrapDialer connects to the host of an encrypted upstream without going
+// through the system resolver, which would loop back into this proxy. The host
+// is dialed on its configured bootstrap ips, or resolved with plain dns servers.
+type bootstrapDialer struct {
+	host      string
+	port      string
+	ips       []string
+	resolvers []string
+	timeout   time.Duration
+
+	mu          sync.Mutex
+	resolved    []string
+	resolvedTTL time.Time
+}
+
+func newBootstrapDialer(host, port string, ips, resolvers []string, timeout time.Duration) *bootstrapDialer {
+	d := &bootstrapDialer{
+		host:      host,
+		port:      port,
+		resolvers: resolvers,
+		timeout:   timeout,
+	}
+	if net.ParseIP(host) != nil {
+		d.ips = []string{host}
+	} else {
+		d.ips = ips
+	}
+	return d
+}
+
+func (d *bootstrapDialer) addresses() ([]string, error) {
+	if len(d.ips) > 0 {
+		return d.ips, nil
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if len(d.resolved) > 0 && time.Now().Before(d.resolvedTTL) {
+		return d.resolved, nil
+	}
+
+	var lastErr error = fmt.Errorf("no bootstrap dns to resolve %s", d.host)
+	for _, resolver := range d.resolvers {
+		upstream, err := newUpstream(resolver, d.timeout)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		var ips []string
+		ttl := uint32(0)
+		for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+			msg := &dns.Msg{}
+			msg.SetQuestion(dns.Fqdn(d.host), qtype)
+			resp, err := upstream.Exchange(msg)
+			if err != nil {
+				lastErr = err
+				continue
+			}
+			for _, rr := range resp.Answer {
+				switch v := rr.(type) {
+				case *dns.A:
+					ips = append(ips, v.A.String())
+				case *dns.AAAA:
+					ips = append(ips, v.AAAA.String())
+				default:
+					continue
+				}
+				if ttl == 0 || rr.Header().Ttl < ttl {
+					ttl = rr.Header().Ttl
+				}
+			}
+		}
+		if len(ips) > 0 {
+			expire := time.Duration(ttl) * time.Second
+			if expire < minBootstrapTTL {
+				expire = minBootstrapTTL
+			}
+			d.resolved = ips
+			d.resolvedTTL = time.Now().Add(expire)
+			return ips, nil
+		}
+	}
+	return nil, lastErr
+}
+
+// DialContext dials the upstream host, ignoring the address resolved by the caller.
+func (d *bootstrapDialer) DialContext(ctx context.Context, network, _ string) (net.Conn, error) {
+	ips, err := d.addresses()
+	if err != nil {
+		return nil, err
+	}
+	dialer := &net.Dialer{Timeout: d.timeout}
+	var errs []error
+	for _, ip := range ips {
+		conn, err := dialer.DialContext(ctx, network, net.JoinHostPort(ip, d.port))
+		if err == nil {
+			return conn, nil
+		}
+		errs = append(errs, err)
+	}
+	return nil, errors.Join(errs...)
+}
@@ -1,29 +1,76 @@
 package dns
 
 import (
+	"container/list"
+	"sort"
 	"sync"
 	"time"
 
-	"github.com/miekg/dns"
 	"golang.org/x/sync/singleflight"
 )
 
+const (
+	defaultCacheSize     = 10000
+	cacheCleanupInterval = time.Minute
+)
+
 type CacheItem struct {
-	value      *dns.Msg
+	key        string
+	value      interface{}
+	createTime time.Time
 	expireTime time.Time
 }
 
+// remainingTTL is the remaining lifetime in seconds, rounded up so an item is
+// not served with a zero ttl while still cached.
+func (item *CacheItem) remainingTTL() uint32 {
+	remaining := time.Until(item.expireTime)
+	if remaining <= 0 {
+		return 0
+	}
+	return uint32((remaining + time.Second - 1) / time.Second)
+}
+
+// CacheStats are the counters of a StealthDNSCache.
+type CacheStats struct {
+	Size      int    `json:"size"`
+	MaxSize   int    `json:"maxSize"`
+	Hits      uint64 `json:"hits"`
+	Misses    uint64 `json:"misses"`
+	Evictions uint64 `json:"evictions"`
+	Expired   uint64 `json:"expired"`
+}
+
+// CacheEntry describes a cached item.
+type CacheEntry struct {
+	Key          string        `json:"key"`
+	RemainingTTL time.Duration `json:"remainingTTL"`
+	ExpireTime   time.Time     `json:"expireTime"`
+}
+
+// StealthDNSCache is a size-bounded cache evicting the least recently used
+// item when full. Expired items are removed by a janitor goroutine.
 type StealthDNSCache struct {
-	mu    sync.RWMutex
-	cache map[string]*CacheItem
-	group singleflight.Group
-	ttl   time.Duration
+	mu      sync.Mutex
+	cache   map[string]*list.Element
+	lru     *list.List
+	maxSize int
+	group   singleflight.Group
+	ttl     time.Duration
+	stats   CacheStats
+
+	janitorStop chan struct{}
 }
 
-func NewStealthDNSCache(ttl time.Duration) *StealthDNSCache {
+func NewStealthDNSCache(ttl time.Duration, maxSize int) *StealthDNSCache {
+	if maxSize <= 0 {
+		maxSize = defaultCacheSize
+	}
 	return &StealthDNSCache{
-		cache: make(map[string]*CacheItem),
-		ttl:   ttl,
+		cache:   make(map[string]*list.Element),
+		lru:     list.New(),
+		maxSize: maxSize,
+		ttl:     ttl,
 	}
 }
 
@@ -35,44 +82,160 @@ func (pc *StealthDNSCache) GetCache(key string) (*CacheItem, bool) {
 	return item, true
 }
 
-func (pc *StealthDNSCache) SetCache(key string, value *dns.Msg) {
+func (pc *StealthDNSCache) SetCache(key string, value interface{}) {
 	pc.set(key, value, pc.ttl)
 }
 
-func (pc *StealthDNSCache) SetCacheWithTTL(key string, value *dns.Msg, ttl time.Duration) {
+func (pc *StealthDNSCache) SetCacheWithTTL(key string, value interface{}, ttl time.Duration) {
 	pc.set(key, value, ttl)
 }
 
-func (pc *StealthDNSCache) Delete(key string) {
+// Delete removes key from the cache and reports whether it was cached.
+func (pc *StealthDNSCache) Delete(key string) bool {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	elem, exists := pc.cache[key]
+	if !exists {
+		return false
+	}
+	pc.remove(elem)
+	return true
+}
+
+// DeleteFunc removes the items whose key matches and returns how many were removed.
+func (pc *StealthDNSCache) DeleteFunc(match func(key string) bool) int {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	var deleted int
+	for key, elem := range pc.cache {
+		if match(key) {
+			pc.remove(elem)
+			deleted++
+		}
+	}
+	return deleted
+}
+
+// Flush removes all items.
+func (pc *StealthDNSCache) Flush() {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	pc.cache = make(map[string]*list.Element)
+	pc.lru.Init()
+}
+
+// TTL returns the remaining lifetime of a cached key.
+func (pc *StealthDNSCache) TTL(key string) (time.Duration, bool) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	elem, exists := pc.cache[key]
+	if !exists {
+		return 0, false
+	}
+	remaining := time.Until(elem.Value.(*CacheItem).expireTime)
+	if remaining <= 0 {
+		return 0, false
+	}
+	return remaining, true
+}
+
+// Entries lists the unexpired items, sorted by key.
+func (pc *StealthDNSCache) Entries() []CacheEntry {
 	pc.mu.Lock()
 	defer pc.mu.Unlock()
-	delete(pc.cache, key)
+	now := time.Now()
+	entries := make([]CacheEntry, 0, len(pc.cache))
+	for key, elem := range pc.cache {
+		item := elem.Value.(*CacheItem)
+		if now.After(item.expireTime) {
+			continue
+		}
+		entries = append(entries, CacheEntry{
+			Key:          key,
+			RemainingTTL: item.expireTime.Sub(now),
+			ExpireTime:   item.expireTime,
+		})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Key < entries[j].Key
+	})
+	return entries
+}
+
+func (pc *StealthDNSCache) Stats() CacheStats {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	stats := pc.stats
+	stats.Size = len(pc.cache)
+	stats.MaxSize = pc.maxSize
+	return stats
+}
+
+// SetMaxSize changes the capacity, evicting the least recently used items
+// that no longer fit.
+func (pc *StealthDNSCache) SetMaxSize(maxSize int) {
+	if maxSize <= 0 {
+		maxSize = defaultCacheSize
+	}
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	pc.maxSize = maxSize
+	pc.evict()
 }
 
 func (pc *StealthDNSCache) get(key string) (*CacheItem, bool) {
-	pc.mu.RLock()
-	defer pc.mu.RUnlock()
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
 
-	item, exists := pc.cache[key]
+	elem, exists := pc.cache[key]
 	if !exists {
+		pc.stats.Misses++
 		return nil, false
 	}
 
+	item := elem.Value.(*CacheItem)
 	if time.Now().After(item.expireTime) {
+		pc.remove(elem)
+		pc.stats.Expired++
+		pc.stats.Misses++
 		return nil, false
 	}
 
+	pc.lru.MoveToFront(elem)
+	pc.stats.Hits++
 	return item, true
 }
 
-func (pc *StealthDNSCache) set(key string, value *dns.Msg, ttl time.Duration) {
+func (pc *StealthDNSCache) set(key string, value interface{}, ttl time.Duration) {
 	pc.mu.Lock()
 	defer pc.mu.Unlock()
 
-	pc.cache[key] = &CacheItem{
+	now := time.Now()
+	item := &CacheItem{
+		key:        key,
 		value:      value,
-		expireTime: time.Now().Add(ttl),
+		createTime: now,
+		expireTime: now.Add(ttl),
+	}
+	if elem, exists := pc.cache[key]; exists {
+		elem.Value = item
+		pc.lru.MoveToFront(elem)
+		return
 	}
+	pc.cache[key] = pc.lru.PushFront(item)
+	pc.evict()
+}
+
+func (pc *StealthDNSCache) evict() {
+	for len(pc.cache) > pc.maxSize {
+		pc.remove(pc.lru.Back())
+		pc.stats.Evictions++
+	}
+}
+
+func (pc *StealthDNSCache) remove(elem *list.Element) {
+	pc.lru.Remove(elem)
+	delete(pc.cache, elem.Value.(*CacheItem).key)
 }
 
 func (pc *StealthDNSCache) CleanupExpired() {
@@ -80,9 +243,42 @@ func (pc *StealthDNSCache) CleanupExpired() {
 	defer pc.mu.Unlock()
 
 	now := time.Now()
-	for key, item := range pc.cache {
-		if now.After(item.expireTime) {
-			delete(pc.cache, key)
+	for _, elem := range pc.cache {
+		if now.After(elem.Value.(*CacheItem).expireTime) {
+			pc.remove(elem)
+			pc.stats.Expired++
 		}
 	}
 }
+
+// StartJanitor removes expired items every interval until StopJanitor is called.
+func (pc *StealthDNSCache) StartJanitor(interval time.Duration) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	if pc.janitorStop != nil {
+		return
+	}
+	stop := make(chan struct{})
+	pc.janitorStop = stop
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				pc.CleanupExpired()
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+func (pc *StealthDNSCache) StopJanitor() {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	if pc.janitorStop != nil {
+		close(pc.janitorStop)
+		pc.janitorStop = nil
+	}
+}
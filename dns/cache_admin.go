@@ -0,0 +1,65 @@
+package dns
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/OpenNHP/opennhp/nhp/log"
+	"github.com/miekg/dns"
+)
+
+const (
+	ResourceCacheName = "resource"
+	ForwardCacheName  = "forward"
+)
+
+// CacheStats returns the counters of the knocked resource cache and the
+// forwarded answer cache.
+func (p *ProxyService) CacheStats() map[string]CacheStats {
+	return map[string]CacheStats{
+		ResourceCacheName: p.dnsCache.Stats(),
+		ForwardCacheName:  p.forwardCache.cache.Stats(),
+	}
+}
+
+// CacheEntries lists the unexpired entries of both caches.
+func (p *ProxyService) CacheEntries() map[string][]CacheEntry {
+	return map[string][]CacheEntry{
+		ResourceCacheName: p.dnsCache.Entries(),
+		ForwardCacheName:  p.forwardCache.cache.Entries(),
+	}
+}
+
+// ResourceTTL returns how long the answer of a knocked resource stays cached.
+func (p *ProxyService) ResourceTTL(resId string) (time.Duration, bool) {
+	return p.dnsCache.TTL(resId)
+}
+
+// FlushCacheName removes the cached answers of name and qtype, of all types if
+// qtype is dns.TypeNone, and the knock result of the resource name routes to.
+// It returns the number of removed entries.
+func (p *ProxyService) FlushCacheName(name string, qtype uint16) int {
+	name = normalizeName(name)
+	prefix := name + "|"
+	if qtype != dns.TypeNone {
+		prefix += fmt.Sprintf("%d|", qtype)
+	}
+	flushed := p.forwardCache.cache.DeleteFunc(func(key string) bool {
+		return strings.HasPrefix(key, prefix)
+	})
+	if route := p.router.Route(name, qtype); route != nil && route.Action == RouteProtected {
+		if p.dnsCache.Delete(route.ResourceId) {
+			flushed++
+		}
+	}
+	log.Info("flush %d cached answers of %s %s", flushed, name, dns.Type(qtype))
+	return flushed
+}
+
+// FlushCache removes all entries of both caches.
+func (p *ProxyService) FlushCache() {
+	p.dnsCache.Flush()
+	p.forwardCache.cache.Flush()
+	log.Info("all dns caches flushed")
+}
@@ -0,0 +1,281 @@
+package dns
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestStealthDNSCacheLRU(t *testing.T) {
+	c := NewStealthDNSCache(time.Minute, 2)
+	c.SetCache("a", 1)
+	c.SetCache("b", 2)
+	// a becomes the most recently used, b is evicted by c.
+	if _, found := c.GetCache("a"); !found {
+		t.Fatal("a is not cached")
+	}
+	c.SetCache("c", 3)
+	if _, found := c.GetCache("b"); found {
+		t.Error("least recently used b is not evicted")
+	}
+	for _, key := range []string{"a", "c"} {
+		if _, found := c.GetCache(key); !found {
+			t.Errorf("%s is evicted", key)
+		}
+	}
+
+	// updating a key does not evict.
+	c.SetCache("a", 4)
+	if item, _ := c.GetCache("a"); item == nil || item.value != 4 {
+		t.Errorf("a is not updated: %v", item)
+	}
+	c.SetMaxSize(1)
+	if _, found := c.GetCache("c"); found {
+		t.Error("c is not evicted by shrinking the cache")
+	}
+
+	stats := c.Stats()
+	want := CacheStats{Size: 1, MaxSize: 1, Hits: 4, Misses: 2, Evictions: 2}
+	if stats != want {
+		t.Errorf("stats = %+v, want %+v", stats, want)
+	}
+}
+
+func TestStealthDNSCacheExpiry(t *testing.T) {
+	c := NewStealthDNSCache(time.Minute, 0)
+	c.SetCacheWithTTL("gone", 1, -time.Second)
+	c.SetCacheWithTTL("kept", 2, time.Minute)
+	if _, found := c.GetCache("gone"); found {
+		t.Error("expired item is served")
+	}
+	if _, found := c.TTL("gone"); found {
+		t.Error("expired item has a ttl")
+	}
+	if ttl, found := c.TTL("kept"); !found || ttl <= 59*time.Second {
+		t.Errorf("ttl of kept = %s, %t", ttl, found)
+	}
+	entries := c.Entries()
+	if len(entries) != 1 || entries[0].Key != "kept" {
+		t.Errorf("entries = %+v", entries)
+	}
+	if stats := c.Stats(); stats.Expired != 1 || stats.Size != 1 {
+		t.Errorf("stats = %+v", stats)
+	}
+}
+
+func TestStealthDNSCacheJanitor(t *testing.T) {
+	c := NewStealthDNSCache(20*time.Millisecond, 0)
+	c.SetCache("a", 1)
+	c.SetCacheWithTTL("b", 2, time.Minute)
+	c.StartJanitor(5 * time.Millisecond)
+	// a second start keeps the running janitor.
+	c.StartJanitor(5 * time.Millisecond)
+	defer c.StopJanitor()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for c.Stats().Size != 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("janitor did not remove the expired item: %+v", c.Stats())
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if stats := c.Stats(); stats.Expired != 1 || stats.Misses != 0 {
+		t.Errorf("stats = %+v", stats)
+	}
+	c.StopJanitor()
+	c.StopJanitor()
+}
+
+func TestStealthDNSCacheDeleteFunc(t *testing.T) {
+	c := NewStealthDNSCache(time.Minute, 0)
+	for _, key := range []string{"a|1", "a|28", "b|1"} {
+		c.SetCache(key, key)
+	}
+	if n := c.DeleteFunc(func(key string) bool { return key[0] == 'a' }); n != 2 {
+		t.Errorf("deleted %d, want 2", n)
+	}
+	if !c.Delete("b|1") || c.Delete("b|1") {
+		t.Error("delete of b|1 does not report it once")
+	}
+	c.SetCache("c", 1)
+	c.Flush()
+	if stats := c.Stats(); stats.Size != 0 {
+		t.Errorf("size after flush = %d", stats.Size)
+	}
+}
+
+// testCacheProxy is a proxy with caches, routing the nhp zone.
+func testCacheProxy() *ProxyService {
+	p := &ProxyService{
+		dnsCache:     NewStealthDNSCache(time.Minute, 0),
+		forwardCache: newForwardCache(&CacheConfig{}),
+		router:       NewDomainRouter(),
+	}
+	p.router.SetTable(nhpRouteTable, RoutePriorityProtected, RouteTableFunc(p.routeNhpZone))
+	return p
+}
+
+func cacheAnswer(p *ProxyService, name string, qtype uint16) {
+	r := testQuery(name, qtype)
+	resp := new(dns.Msg)
+	resp.SetReply(r)
+	rr, _ := dns.NewRR(name + " 300 IN " + dns.TypeToString[qtype] + " " + map[uint16]string{
+		dns.TypeA:    "192.0.2.1",
+		dns.TypeAAAA: "2001:db8::1",
+	}[qtype])
+	resp.Answer = append(resp.Answer, rr)
+	p.forwardCache.set(r, "", "", resp)
+	r.SetEdns0(1232, true)
+	p.forwardCache.set(r, "corp", "", resp)
+}
+
+func TestFlushCacheName(t *testing.T) {
+	tests := []struct {
+		name    string
+		qtype   uint16
+		flushed int
+		left    []string
+	}{
+		{name: "www.example.com", qtype: dns.TypeA, flushed: 2, left: []string{"AAAA www.example.com.", "A example.com."}},
+		{name: "WWW.Example.com.", qtype: dns.TypeNone, flushed: 4, left: []string{"A example.com."}},
+		{name: "other.example.com", qtype: dns.TypeA, flushed: 0},
+		{name: "app." + nhpZone(), qtype: dns.TypeA, flushed: 1},
+	}
+	for _, tt := range tests {
+		p := testCacheProxy()
+		cacheAnswer(p, "www.example.com.", dns.TypeA)
+		cacheAnswer(p, "www.example.com.", dns.TypeAAAA)
+		cacheAnswer(p, "example.com.", dns.TypeA)
+		p.dnsCache.SetCache("app", "knock")
+
+		if flushed := p.FlushCacheName(tt.name, tt.qtype); flushed != tt.flushed {
+			t.Errorf("flush %s %s = %d, want %d", tt.name, dns.Type(tt.qtype), flushed, tt.flushed)
+		}
+		for _, left := range tt.left {
+			qtype, name, _ := strings.Cut(left, " ")
+			if p.forwardCache.get(testQuery(name, dns.StringToType[qtype]), "", "") == nil {
+				t.Errorf("flush %s %s removed %s", tt.name, dns.Type(tt.qtype), left)
+			}
+		}
+	}
+}
+
+func TestAdminServer(t *testing.T) {
+	p := testCacheProxy()
+	cacheAnswer(p, "www.example.com.", dns.TypeA)
+	p.dnsCache.SetCache("app", "knock")
+	mux := http.NewServeMux()
+	mux.HandleFunc("/cache/stats", p.serveCacheStats)
+	mux.HandleFunc("/cache/ttl", p.serveResourceTTL)
+	mux.HandleFunc("/cache/flush", p.serveCacheFlush)
+	handler := guardAdmin(defaultAdminAddr, "secret", mux)
+	request := func(method, target string) *http.Request {
+		req := httptest.NewRequest(method, target, nil)
+		req.Host = defaultAdminAddr
+		req.Header.Set("Authorization", "Bearer secret")
+		return req
+	}
+
+	tests := []struct {
+		method string
+		target string
+		origin string
+		host   string
+		token  string
+		status int
+		body   string
+	}{
+		{method: http.MethodGet, target: "/cache/flush?name=www.example.com", status: http.StatusMethodNotAllowed},
+		{method: http.MethodPost, target: "/cache/flush?name=www.example.com", origin: "https://evil.example", status: http.StatusForbidden},
+		// a web page reaching the api through a name rebound to 127.0.0.1.
+		{method: http.MethodPost, target: "/cache/flush?name=www.example.com", host: "rebind.evil.example:5380", status: http.StatusForbidden},
+		{method: http.MethodPost, target: "/cache/flush?name=www.example.com", host: "127.0.0.1:80", status: http.StatusForbidden},
+		{method: http.MethodPost, target: "/cache/flush?name=www.example.com", token: "guess", status: http.StatusUnauthorized},
+		{method: http.MethodGet, target: "/cache/ttl?resource=none", host: "localhost:5380", status: http.StatusNotFound},
+		{method: http.MethodGet, target: "/cache/ttl?resource=none", host: "[::1]:5380", status: http.StatusNotFound},
+		{method: http.MethodPost, target: "/cache/flush?name=www.example.com&type=BOGUS", status: http.StatusBadRequest},
+		{method: http.MethodGet, target: "/cache/ttl?resource=none", status: http.StatusNotFound},
+		{method: http.MethodPost, target: "/cache/flush?name=www.example.com&type=a", status: http.StatusOK, body: "2\n"},
+		{method: http.MethodPost, target: "/cache/flush", status: http.StatusOK, body: "-1\n"},
+	}
+	for _, tt := range tests {
+		req := request(tt.method, tt.target)
+		if len(tt.origin) > 0 {
+			req.Header.Set("Origin", tt.origin)
+		}
+		if len(tt.host) > 0 {
+			req.Host = tt.host
+		}
+		if len(tt.token) > 0 {
+			req.Header.Set("Authorization", "Bearer "+tt.token)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != tt.status {
+			t.Errorf("%s %s = %d, want %d", tt.method, tt.target, rec.Code, tt.status)
+		}
+		if len(tt.body) > 0 && rec.Body.String() != tt.body {
+			t.Errorf("%s %s = %q, want %q", tt.method, tt.target, rec.Body.String(), tt.body)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, request(http.MethodGet, "/cache/stats"))
+	var stats map[string]CacheStats
+	if err := json.Unmarshal(rec.Body.Bytes(), &stats); err != nil {
+		t.Fatal(err)
+	}
+	if stats[ResourceCacheName].Size != 0 || stats[ForwardCacheName].Size != 0 {
+		t.Errorf("caches are not flushed: %+v", stats)
+	}
+}
+
+func TestAdminToken(t *testing.T) {
+	file := filepath.Join(t.TempDir(), adminTokenFile)
+	if _, err := adminToken(file, false); err == nil {
+		t.Error("the client read a missing token")
+	}
+	token, err := adminToken(file, true)
+	if err != nil || len(token) != 64 {
+		t.Fatalf("adminToken() = %q, %v", token, err)
+	}
+	info, err := os.Stat(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("token file mode = %v, want 0600", info.Mode())
+	}
+	for _, create := range []bool{true, false} {
+		if got, err := adminToken(file, create); got != token || err != nil {
+			t.Errorf("adminToken(create %v) = %q, %v, want the stored %q", create, got, err, token)
+		}
+	}
+}
+
+func TestAdminAddr(t *testing.T) {
+	tests := []struct {
+		conf    AdminConfig
+		want    string
+		wantErr bool
+	}{
+		{conf: AdminConfig{}, want: defaultAdminAddr},
+		{conf: AdminConfig{Listen: "[::1]:8053"}, want: "[::1]:8053"},
+		{conf: AdminConfig{Listen: "0.0.0.0:5380"}, wantErr: true},
+		{conf: AdminConfig{Listen: "localhost:5380"}, wantErr: true},
+		{conf: AdminConfig{Disable: true}, wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := adminAddr(&tt.conf)
+		if got != tt.want || (err != nil) != tt.wantErr {
+			t.Errorf("adminAddr(%+v) = %q, %v", tt.conf, got, err)
+		}
+	}
+}
@@ -5,6 +5,8 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"reflect"
+	"strings"
 
 	"github.com/OpenNHP/opennhp/nhp/log"
 	"github.com/OpenNHP/opennhp/nhp/utils"
@@ -16,12 +18,150 @@ import (
 var (
 	dnsConfigWatch      io.Closer
 	resourceConfigWatch io.Closer
+	policyConfigWatch   io.Closer
 
 	errLoadConfig = fmt.Errorf("dns config load error")
 )
 
 type Config struct {
-	LogLevel int `json:"logLevel"`
+	LogLevel int            `json:"logLevel"`
+	Listen   ListenConfig   `json:"listen"`
+	Upstream UpstreamConfig `json:"upstream"`
+	Cache    CacheConfig    `json:"cache"`
+	Reknock  ReknockConfig  `json:"reknock"`
+	Failure  FailureConfig  `json:"failure"`
+	Local    LocalConfig    `json:"local"`
+	Block    BlockConfig    `json:"block"`
+	EDNS     EDNSConfig     `json:"edns"`
+	DNSSEC   DNSSECConfig   `json:"dnssec"`
+	QueryLog QueryLogConfig `json:"queryLog"`
+	Admin    AdminConfig    `json:"admin"`
+}
+
+type AdminConfig struct {
+	Disable bool   `json:"disable"`
+	Listen  string `json:"listen"`
+}
+
+type QueryLogConfig struct {
+	Enable     bool   `json:"enable"`
+	File       string `json:"file"`
+	MaxSize    int    `json:"maxSize"`
+	MaxAge     int    `json:"maxAge"`
+	MaxBackups int    `json:"maxBackups"`
+	ClientIP   string `json:"clientIP"`
+	Name       string `json:"name"`
+	HashKey    string `json:"hashKey"`
+}
+
+type DNSSECConfig struct {
+	Validate     bool     `json:"validate"`
+	TrustAnchors []string `json:"trustAnchors"`
+}
+
+type EDNSConfig struct {
+	UDPSize        uint16 `json:"udpSize"`
+	ClientSubnet   string `json:"clientSubnet"`
+	DisablePadding bool   `json:"disablePadding"`
+}
+
+type BlockConfig struct {
+	Response     string             `json:"response"`
+	TTL          uint32             `json:"ttl"`
+	SinkholeIPv4 string             `json:"sinkholeIPv4"`
+	SinkholeIPv6 string             `json:"sinkholeIPv6"`
+	Allowlist    []string           `json:"allowlist"`
+	Lists        []*BlocklistConfig `json:"lists"`
+}
+
+type BlocklistConfig struct {
+	Source          string `json:"source"`
+	Format          string `json:"format"`
+	RefreshInterval int    `json:"refreshInterval"`
+}
+
+type LocalConfig struct {
+	HostsFiles []string          `json:"hostsFiles"`
+	ZoneFiles  []*ZoneFileConfig `json:"zoneFiles"`
+	TTL        uint32            `json:"ttl"`
+}
+
+type ZoneFileConfig struct {
+	File   string `json:"file"`
+	Origin string `json:"origin"`
+}
+
+type FailureConfig struct {
+	Response     string `json:"response"`
+	TTL          uint32 `json:"ttl"`
+	SinkholeIPv4 string `json:"sinkholeIPv4"`
+	SinkholeIPv6 string `json:"sinkholeIPv6"`
+}
+
+type ReknockConfig struct {
+	Disable     bool   `json:"disable"`
+	Before      uint32 `json:"before"`
+	IdleTimeout uint32 `json:"idleTimeout"`
+}
+
+type CacheConfig struct {
+	Disable        bool   `json:"disable"`
+	MaxEntries     int    `json:"maxEntries"`
+	MinTTL         uint32 `json:"minTTL"`
+	MaxTTL         uint32 `json:"maxTTL"`
+	MaxNegativeTTL uint32 `json:"maxNegativeTTL"`
+}
+
+type ListenConfig struct {
+	Addrs   []*ListenAddr `json:"addrs"`
+	DoHPath string        `json:"dohPath"`
+}
+
+type UpstreamConfig struct {
+	Strategy        string   `json:"strategy"`
+	Servers         []string `json:"servers"`
+	IgnoreSystemDNS bool     `json:"ignoreSystemDNS"`
+	Timeout         int      `json:"timeout"`
+
+	DoH []*DoHConfig `json:"doh"`
+	DoT []*DoTConfig `json:"dot"`
+
+	Groups []*UpstreamGroupConfig `json:"groups"`
+	Rules  []*ForwardRuleConfig   `json:"rules"`
+}
+
+type UpstreamGroupConfig struct {
+	Name     string       `json:"name"`
+	Strategy string       `json:"strategy"`
+	Servers  []string     `json:"servers"`
+	DoH      []*DoHConfig `json:"doh"`
+	DoT      []*DoTConfig `json:"dot"`
+}
+
+type ForwardRuleConfig struct {
+	Suffix string `json:"suffix"`
+	Group  string `json:"group"`
+}
+
+type DoHConfig struct {
+	Url       string   `json:"url"`
+	Method    string   `json:"method"`
+	Bootstrap []string `json:"bootstrap"`
+}
+
+type DoTConfig struct {
+	Server     string   `json:"server"`
+	ServerName string   `json:"serverName"`
+	Bootstrap  []string `json:"bootstrap"`
+	SPKIPins   []string `json:"spkiPins"`
+	CAFile     string   `json:"caFile"`
+}
+
+type ListenAddr struct {
+	Ip        string `json:"ip"`
+	Interface string `json:"interface"`
+	Port      int    `json:"port"`
+	Protocol  string `json:"protocol"`
 }
 
 type Resources struct {
@@ -34,6 +174,52 @@ type Resource struct {
 	ServerHostname string `json:"serverHostname"`
 	ServerIp       string `json:"serverIp"`
 	ServerPort     int    `json:"serverPort"`
+
+	Domains []string `json:"domains"`
+
+	FailureResponse string `json:"failureResponse"`
+	FailureTTL      uint32 `json:"failureTTL"`
+	SubdomainHosts  bool   `json:"subdomainHosts"`
+	RoundRobin      bool   `json:"roundRobin"`
+
+	Services []*ServiceConfig `json:"services"`
+	HTTPS    *HTTPSConfig     `json:"https"`
+}
+
+type PolicyRules struct {
+	Rules []*PolicyRule
+}
+
+type PolicyRule struct {
+	Name string `json:"name"`
+
+	Domains    []string `json:"domains"`
+	Types      []string `json:"types"`
+	Clients    []string `json:"clients"`
+	Times      []string `json:"times"`
+	Days       []string `json:"days"`
+	SSIDs      []string `json:"ssids"`
+	Interfaces []string `json:"interfaces"`
+
+	Action   string   `json:"action"`
+	Resource string   `json:"resource"`
+	Upstream string   `json:"upstream"`
+	Response string   `json:"response"`
+	Rewrite  []string `json:"rewrite"`
+	TTL      uint32   `json:"ttl"`
+}
+
+type ServiceConfig struct {
+	Service  string `json:"service"`
+	Protocol string `json:"protocol"`
+	Port     uint16 `json:"port"`
+	Priority uint16 `json:"priority"`
+	Weight   uint16 `json:"weight"`
+}
+
+type HTTPSConfig struct {
+	Port uint16   `json:"port"`
+	Alpn []string `json:"alpn"`
 }
 
 func (p *ProxyService) loadDNSConfig() error {
@@ -67,6 +253,19 @@ func (p *ProxyService) loadResources() error {
 	return nil
 }
 
+// loadPolicy loads and watches policy.toml. Without a valid policy, queries
+// are routed by the route tables only.
+func (p *ProxyService) loadPolicy() {
+	// policy.toml
+	fileName := filepath.Join(common.ExeDirPath, "etc", "policy.toml")
+	p.updatePolicy(fileName)
+
+	policyConfigWatch = utils.WatchFile(fileName, func() {
+		log.Info("policy config: %s has been updated", fileName)
+		p.updatePolicy(fileName)
+	})
+}
+
 func (p *ProxyService) updateDNSConfig(file string) (err error) {
 	utils.CatchPanicThenRun(func() {
 		err = errLoadConfig
@@ -78,12 +277,25 @@ func (p *ProxyService) updateDNSConfig(file string) (err error) {
 	}
 
 	var conf Config
-	if err := toml.Unmarshal(content, &conf); err != nil {
-		log.Error("failed to unmarshal dns config: %v", err)
+	parseErr := toml.Unmarshal(content, &conf)
+	if parseErr != nil {
+		log.Error("failed to unmarshal dns config: %v", parseErr)
+	}
+
+	if p.config != nil && (err != nil || parseErr != nil) {
+		// a broken edit keeps the config in force.
+		if err == nil {
+			err = parseErr
+		}
+		return err
 	}
 
 	if p.config == nil {
 		p.config = &conf
+		p.failure.Store(newFailurePolicy(&p.config.Failure))
+		p.edns.Store(newEDNSPolicy(&p.config.EDNS))
+		p.dnssec.Store(newDNSSECValidator(&p.config.DNSSEC, p.exchangeDNSSEC))
+		p.queryLog.Store(newQueryLog(&p.config.QueryLog))
 		p.log.SetLogLevel(conf.LogLevel)
 		return err
 	}
@@ -94,6 +306,96 @@ func (p *ProxyService) updateDNSConfig(file string) (err error) {
 		p.log.SetLogLevel(conf.LogLevel)
 		p.config.LogLevel = conf.LogLevel
 	}
+
+	if !reflect.DeepEqual(p.config.Listen, conf.Listen) {
+		log.Info("listen addresses have been updated, rebinding")
+		p.config.Listen = conf.Listen
+		if p.running.Load() {
+			p.bindListeners(&p.config.Listen, false)
+		}
+	}
+
+	if !reflect.DeepEqual(p.config.Upstream, conf.Upstream) {
+		log.Info("upstream dns config has been updated")
+		p.config.Upstream = conf.Upstream
+		if p.running.Load() {
+			if old := p.upstreams.Swap(p.newUpstreamRouter(&p.config.Upstream)); old != nil {
+				old.close()
+			}
+		}
+	}
+
+	if p.config.Cache != conf.Cache {
+		log.Info("cache config has been updated")
+		p.config.Cache = conf.Cache
+		if p.forwardCache != nil {
+			p.forwardCache.setConfig(&p.config.Cache)
+		}
+	}
+
+	if p.config.Reknock != conf.Reknock {
+		log.Info("re-knock config has been updated")
+		p.config.Reknock = conf.Reknock
+		if p.reknock != nil {
+			p.reknock.setConfig(&p.config.Reknock)
+		}
+	}
+
+	if !reflect.DeepEqual(p.config.Local, conf.Local) {
+		log.Info("local data files have been updated")
+		p.config.Local = conf.Local
+		if p.running.Load() {
+			p.loadLocalData(&p.config.Local)
+		}
+	}
+
+	if !reflect.DeepEqual(p.config.Block, conf.Block) {
+		log.Info("blocklist config has been updated")
+		p.config.Block = conf.Block
+		if p.running.Load() {
+			p.blocklist.setConfig(&p.config.Block)
+		}
+	}
+
+	if p.config.Failure != conf.Failure {
+		log.Info("failure response config has been updated")
+		p.config.Failure = conf.Failure
+		p.failure.Store(newFailurePolicy(&p.config.Failure))
+	}
+
+	if p.config.EDNS != conf.EDNS {
+		log.Info("edns config has been updated")
+		p.config.EDNS = conf.EDNS
+		p.edns.Store(newEDNSPolicy(&p.config.EDNS))
+		// cached answers were tailored to the old client subnets.
+		if p.forwardCache != nil {
+			p.forwardCache.cache.Flush()
+		}
+	}
+
+	if !reflect.DeepEqual(p.config.DNSSEC, conf.DNSSEC) {
+		log.Info("dnssec config has been updated")
+		p.config.DNSSEC = conf.DNSSEC
+		p.dnssec.Store(newDNSSECValidator(&p.config.DNSSEC, p.exchangeDNSSEC))
+		// cached answers were validated, or not, by the old config.
+		if p.forwardCache != nil {
+			p.forwardCache.cache.Flush()
+		}
+	}
+
+	if p.config.QueryLog != conf.QueryLog {
+		log.Info("query log config has been updated")
+		p.config.QueryLog = conf.QueryLog
+		p.queryLog.Swap(newQueryLog(&p.config.QueryLog)).close()
+	}
+
+	if p.config.Admin != conf.Admin {
+		log.Info("admin api config has been updated")
+		p.config.Admin = conf.Admin
+		if p.running.Load() {
+			p.admin.Swap(p.newAdminServer(&p.config.Admin)).close()
+		}
+	}
 	return err
 }
 
@@ -113,16 +415,62 @@ func (p *ProxyService) updateResources(file string) (err error) {
 	}
 	tempResourceMap := make(map[string]*Resource)
 	for _, resource := range resources.Resources {
-		tempResourceMap[resource.ResourceId] = resource
+		// query names are lower-cased before routing.
+		tempResourceMap[strings.ToLower(resource.ResourceId)] = resource
 	}
 
 	p.resourceMapLock.Lock()
-	defer p.resourceMapLock.Unlock()
 	p.resourceMap = tempResourceMap
+	p.resourceMapLock.Unlock()
+
+	if p.router != nil {
+		p.router.SetTable(domainRouteTable, RoutePriorityProtected, newDomainTable(resources.Resources))
+	}
 
 	return err
 }
 
+func (p *ProxyService) updatePolicy(file string) (err error) {
+	utils.CatchPanicThenRun(func() {
+		err = errLoadConfig
+	})
+
+	rules, err := readPolicyRules(file)
+	if err != nil {
+		log.Error("failed to load policy config: %v", err)
+		if p.policy.Load() != nil {
+			// a broken edit keeps the rules in force.
+			return err
+		}
+		rules = &PolicyRules{}
+	}
+	p.policy.Store(newPolicyEngine(rules))
+	return err
+}
+
+// readPolicyRules reads a policy file, a missing file has no rules.
+func readPolicyRules(file string) (*PolicyRules, error) {
+	content, err := os.ReadFile(file)
+	if os.IsNotExist(err) {
+		return &PolicyRules{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var rules PolicyRules
+	if err := toml.Unmarshal(content, &rules); err != nil {
+		return nil, err
+	}
+	return &rules, nil
+}
+
+// getResource returns the resource of resId, or nil if it is unknown.
+func (p *ProxyService) getResource(resId string) *Resource {
+	p.resourceMapLock.Lock()
+	defer p.resourceMapLock.Unlock()
+	return p.resourceMap[strings.ToLower(resId)]
+}
+
 func (p *ProxyService) StopConfigWatch() {
 	if dnsConfigWatch != nil {
 		dnsConfigWatch.Close()
@@ -131,4 +479,15 @@ func (p *ProxyService) StopConfigWatch() {
 	if resourceConfigWatch != nil {
 		resourceConfigWatch.Close()
 	}
+
+	if policyConfigWatch != nil {
+		policyConfigWatch.Close()
+	}
+
+	p.localLock.Lock()
+	defer p.localLock.Unlock()
+	for _, watch := range p.localWatches {
+		watch.Close()
+	}
+	p.localWatches = nil
 }
@@ -0,0 +1,58 @@
+package dns
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestUpdateDNSConfigKeepsConfigOnError(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "config.toml")
+	valid := `[Listen]
+Addrs = [{Ip = "127.0.0.1", Port = 5353, Protocol = "udp"}]
+
+[Upstream]
+Servers = ["192.0.2.53"]
+
+[Cache]
+MaxEntries = 100
+
+[EDNS]
+ClientSubnet = "keep"
+`
+	if err := os.WriteFile(file, []byte(valid), 0644); err != nil {
+		t.Fatal(err)
+	}
+	p := &ProxyService{config: &Config{}, forwardCache: newForwardCache(&CacheConfig{})}
+	if err := p.updateDNSConfig(file); err != nil {
+		t.Fatal(err)
+	}
+	if len(p.config.Listen.Addrs) != 1 || len(p.config.Upstream.Servers) != 1 || p.forwardCache.conf.Load().MaxEntries != 100 {
+		t.Fatalf("config not applied: %+v", p.config)
+	}
+	want := *p.config
+	policy := p.edns.Load()
+
+	for _, content := range []string{
+		"[Upstream\nServers = [\"192.0.2.53\"]\n",
+		"[Cache]\nMaxEntries = \"many\"\n",
+	} {
+		if err := os.WriteFile(file, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := p.updateDNSConfig(file); err == nil {
+			t.Errorf("broken config %q is loaded", content)
+		}
+		if !reflect.DeepEqual(*p.config, want) || p.forwardCache.conf.Load().MaxEntries != 100 || p.edns.Load() != policy {
+			t.Errorf("broken config %q changed the config to %+v", content, p.config)
+		}
+	}
+
+	if err := p.updateDNSConfig(filepath.Join(t.TempDir(), "missing.toml")); err == nil {
+		t.Error("missing config is loaded")
+	}
+	if !reflect.DeepEqual(*p.config, want) {
+		t.Errorf("missing config changed the config to %+v", p.config)
+	}
+}
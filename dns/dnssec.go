@@ -0,0 +1,860 @@
+package dns
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/OpenNHP/opennhp/nhp/log"
+	"github.com/miekg/dns"
+)
+
+const (
+	// the validated keys of a zone are cached for the ttl of their records,
+	// within these bounds in seconds.
+	minDNSSECKeyTTL = 60
+	maxDNSSECKeyTTL = 3600
+
+	// maxDNSSECChainDepth bounds the zones walked from a name to its trust anchor.
+	maxDNSSECChainDepth = 32
+)
+
+// defaultTrustAnchors are the DS records of the root zone KSKs, see
+// https://data.iana.org/root-anchors/root-anchors.xml
+var defaultTrustAnchors = []string{
+	". IN DS 20326 8 2 E06D44B80B8F1D39A95C0B0D7C65D08458E880409BBC683457104237C7F8EC8D",
+	". IN DS 38696 8 2 683D2D0ACB8C9B712A1948B27F741219298D0A450D612C483AF444A4C0FB2B16",
+}
+
+// algorithms and digests the validator can verify, data signed with others is
+// treated as unsigned (RFC 4035 section 5.2).
+var (
+	dnssecAlgorithms = map[uint8]bool{
+		dns.RSASHA1:          true,
+		dns.RSASHA1NSEC3SHA1: true,
+		dns.RSASHA256:        true,
+		dns.RSASHA512:        true,
+		dns.ECDSAP256SHA256:  true,
+		dns.ECDSAP384SHA384:  true,
+		dns.ED25519:          true,
+	}
+	dnssecDigests = map[uint8]bool{
+		dns.SHA1:   true,
+		dns.SHA256: true,
+		dns.SHA384: true,
+	}
+)
+
+// dnssecError is a validation failure with its Extended DNS Error code.
+type dnssecError struct {
+	infoCode uint16
+	reason   string
+}
+
+func (e *dnssecError) Error() string {
+	return e.reason
+}
+
+func newDNSSECError(infoCode uint16, format string, args ...interface{}) error {
+	return &dnssecError{infoCode: infoCode, reason: fmt.Sprintf(format, args...)}
+}
+
+// zoneKeys are the validated keys signing the names of a zone, or none if the
+// zone is provably unsigned.
+type zoneKeys struct {
+	zone   string
+	secure bool
+	keys   []*dns.DNSKEY
+}
+
+// rrSet is the records of one name and type with their signatures.
+type rrSet struct {
+	name  string
+	rtype uint16
+	rrs   []dns.RR
+	sigs  []*dns.RRSIG
+}
+
+// dnssecValidator validates forwarded answers (RFC 4035 section 5) by chains
+// of DS and DNSKEY records up to the trust anchors.
+type dnssecValidator struct {
+	anchors  map[string][]*dns.DS
+	exchange func(r *dns.Msg) (*dns.Msg, error)
+	keys     *StealthDNSCache
+}
+
+// newDNSSECValidator returns nil if validation is disabled.
+func newDNSSECValidator(conf *DNSSECConfig, exchange func(r *dns.Msg) (*dns.Msg, error)) *dnssecValidator {
+	if !conf.Validate {
+		return nil
+	}
+	v := &dnssecValidator{
+		anchors:  make(map[string][]*dns.DS),
+		exchange: exchange,
+		keys:     NewStealthDNSCache(0, 0),
+	}
+	anchors := conf.TrustAnchors
+	if len(anchors) == 0 {
+		anchors = defaultTrustAnchors
+	}
+	for _, anchor := range anchors {
+		rr, err := dns.NewRR(anchor)
+		if err != nil || rr == nil {
+			log.Error("invalid dnssec trust anchor %q, ignored: %v", anchor, err)
+			continue
+		}
+		switch a := rr.(type) {
+		case *dns.DS:
+			zone := normalizeName(a.Hdr.Name)
+			v.anchors[zone] = append(v.anchors[zone], a)
+		case *dns.DNSKEY:
+			zone := normalizeName(a.Hdr.Name)
+			v.anchors[zone] = append(v.anchors[zone], a.ToDS(dns.SHA256))
+		default:
+			log.Error("dnssec trust anchor %q is neither a DS nor a DNSKEY record, ignored", anchor)
+		}
+	}
+	if len(v.anchors) == 0 {
+		log.Error("no valid dnssec trust anchor, using the root zone keys")
+		for _, anchor := range defaultTrustAnchors {
+			rr, _ := dns.NewRR(anchor)
+			v.anchors["."] = append(v.anchors["."], rr.(*dns.DS))
+		}
+	}
+	return v
+}
+
+// query returns a copy of r asking for signatures, with checking disabled so
+// that bogus answers reach the validator, which reports why they are bogus.
+func (v *dnssecValidator) query(r *dns.Msg) *dns.Msg {
+	m := r.Copy()
+	m.CheckingDisabled = true
+	if opt := m.IsEdns0(); opt != nil {
+		opt.SetDo()
+	} else {
+		m.SetEdns0(defaultEDNSUDPSize, true)
+	}
+	return m
+}
+
+// validate checks resp, the answer of a query made by query(r). It returns
+// the answer shared by the clients asking r, with the AD bit set if it is
+// secure, or SERVFAIL if it is bogus. dnssecReply adapts it to each client.
+func (v *dnssecValidator) validate(r *dns.Msg, resp *dns.Msg) *dns.Msg {
+	secure, err := v.verifyAnswer(resp, time.Now())
+	if err != nil {
+		log.Warning("domain :%s dnssec validation failed: %v", r.Question[0].Name, err)
+		m := new(dns.Msg)
+		m.SetRcode(r, dns.RcodeServerFailure)
+		infoCode := dns.ExtendedErrorCodeDNSBogus
+		if e, ok := err.(*dnssecError); ok {
+			infoCode = e.infoCode
+		}
+		if r.IsEdns0() != nil {
+			m.SetEdns0(defaultEDNSUDPSize, false)
+			opt := m.IsEdns0()
+			opt.Option = append(opt.Option, newEDE(infoCode, err))
+		}
+		return m
+	}
+
+	m := resp
+	m.CheckingDisabled = false
+	m.AuthenticatedData = secure
+	return m
+}
+
+// dnssecReply returns m, the answer to r shared by all clients, for the client
+// of r: the AD bit is only set for clients asking for it (RFC 6840 section
+// 5.7), and the DNSSEC records are removed unless the DO bit is set.
+func dnssecReply(r *dns.Msg, m *dns.Msg) *dns.Msg {
+	do := false
+	if opt := r.IsEdns0(); opt != nil {
+		do = opt.Do()
+	}
+	ad := m.AuthenticatedData && (do || r.AuthenticatedData)
+	if do && ad == m.AuthenticatedData {
+		return m
+	}
+	m = m.Copy()
+	m.AuthenticatedData = ad
+	if !do && len(r.Question) == 1 {
+		qtype := r.Question[0].Qtype
+		m.Answer = stripDNSSEC(m.Answer, qtype)
+		m.Ns = stripDNSSEC(m.Ns, qtype)
+	}
+	return m
+}
+
+// verifyAnswer reports whether resp is secure, or an error if it is bogus.
+// Answers of insecure zones are neither.
+func (v *dnssecValidator) verifyAnswer(resp *dns.Msg, now time.Time) (bool, error) {
+	if len(resp.Question) != 1 || (resp.Rcode != dns.RcodeSuccess && resp.Rcode != dns.RcodeNameError) {
+		return false, nil
+	}
+	qtype := resp.Question[0].Qtype
+
+	// the name answered last, following the cname chain.
+	target := normalizeName(resp.Question[0].Name)
+	for _, rr := range resp.Answer {
+		if cname, ok := rr.(*dns.CNAME); ok && normalizeName(cname.Hdr.Name) == target {
+			target = normalizeName(cname.Target)
+		}
+	}
+
+	secure := true
+	answered := false
+	var wildcards []*rrSet
+	answer := groupRRsets(resp.Answer)
+	for _, set := range answer {
+		if set.rtype == dns.TypeCNAME && len(set.sigs) == 0 && synthesizedFromDNAME(set.name, answer) {
+			// the cname synthesized from a signed DNAME is unsigned, RFC 6672 section 5.3.3.
+			continue
+		}
+		setSecure, err := v.verifyRRset(set, now)
+		if err != nil {
+			return false, err
+		}
+		secure = secure && setSecure
+		if set.name == target && (set.rtype == qtype || qtype == dns.TypeANY) {
+			answered = true
+		}
+		if setSecure && int(set.sigs[0].Labels) < dns.CountLabel(set.name) {
+			wildcards = append(wildcards, set)
+		}
+	}
+
+	var authority []*rrSet
+	var nsecs []*dns.NSEC
+	var nsec3s []*dns.NSEC3
+	for _, set := range groupRRsets(resp.Ns) {
+		switch set.rtype {
+		case dns.TypeSOA, dns.TypeNSEC, dns.TypeNSEC3:
+			authority = append(authority, set)
+		default:
+			continue
+		}
+		for _, rr := range set.rrs {
+			switch nsec := rr.(type) {
+			case *dns.NSEC:
+				nsecs = append(nsecs, nsec)
+			case *dns.NSEC3:
+				nsec3s = append(nsec3s, nsec)
+			}
+		}
+	}
+
+	if answered && resp.Rcode == dns.RcodeSuccess {
+		if !secure || len(wildcards) == 0 {
+			return secure, nil
+		}
+		// a wildcard answer also proves that the query name doesn't exist.
+		for _, set := range authority {
+			setSecure, err := v.verifyRRset(set, now)
+			if err != nil {
+				return false, err
+			}
+			if !setSecure {
+				return false, nil
+			}
+		}
+		for _, set := range wildcards {
+			if !provesExpansion(set.name, int(set.sigs[0].Labels), nsecs, nsec3s) {
+				return false, newDNSSECError(dns.ExtendedErrorCodeNSECMissing, "no proof that %s is not an existing name", set.name)
+			}
+		}
+		return true, nil
+	}
+
+	// a negative answer, NXDOMAIN or NODATA of the target.
+	if len(authority) == 0 {
+		keys, err := v.keysOf(target, 0)
+		if err != nil {
+			return false, err
+		}
+		if !keys.secure {
+			return false, nil
+		}
+		return false, newDNSSECError(dns.ExtendedErrorCodeNSECMissing, "no signed denial of %s %s", target, dns.TypeToString[qtype])
+	}
+	for _, set := range authority {
+		setSecure, err := v.verifyRRset(set, now)
+		if err != nil {
+			return false, err
+		}
+		secure = secure && setSecure
+	}
+	if !secure {
+		return false, nil
+	}
+	return verifyDenial(target, qtype, resp.Rcode == dns.RcodeNameError, nsecs, nsec3s)
+}
+
+// verifyRRset reports whether set is signed by the validated keys of its
+// zone, or an error if it is bogus. Sets of insecure zones are not secure.
+func (v *dnssecValidator) verifyRRset(set *rrSet, now time.Time) (bool, error) {
+	if len(set.sigs) == 0 {
+		// unsigned data is only acceptable from a provably unsigned zone.
+		keys, err := v.keysOf(set.name, 0)
+		if err != nil {
+			return false, err
+		}
+		if !keys.secure {
+			return false, nil
+		}
+		return false, newDNSSECError(dns.ExtendedErrorCodeRRSIGsMissing, "%s %s of signed zone %s has no signature",
+			set.name, dns.TypeToString[set.rtype], keys.zone)
+	}
+	signer := normalizeName(set.sigs[0].SignerName)
+	if !inZone(set.name, signer) {
+		return false, newDNSSECError(dns.ExtendedErrorCodeDNSBogus, "%s %s is signed by %s, which is not its zone",
+			set.name, dns.TypeToString[set.rtype], signer)
+	}
+	keys, err := v.keysOf(signer, 0)
+	if err != nil {
+		return false, err
+	}
+	if !keys.secure {
+		return false, nil
+	}
+	if err := verifySignatures(set, keys.keys, now); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// keysOf returns the validated keys signing zone, or the zone containing it
+// if it is no zone cut, walking the chain of trust up to a trust anchor.
+func (v *dnssecValidator) keysOf(zone string, depth int) (*zoneKeys, error) {
+	zone = normalizeName(zone)
+	if item, found := v.keys.GetCache(zone); found {
+		return item.value.(*zoneKeys), nil
+	}
+	if depth > maxDNSSECChainDepth {
+		return nil, newDNSSECError(dns.ExtendedErrorCodeDNSSECIndeterminate, "chain of trust of %s is too long", zone)
+	}
+	result, err, _ := v.keys.group.Do(zone, func() (interface{}, error) {
+		return v.loadKeys(zone, depth)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result.(*zoneKeys), nil
+}
+
+func (v *dnssecValidator) loadKeys(zone string, depth int) (*zoneKeys, error) {
+	dsSet, found := v.anchors[zone]
+	if !found {
+		if zone == "." {
+			// outside of the trust anchors.
+			return v.cacheKeys(zone, &zoneKeys{zone: zone}, maxDNSSECKeyTTL), nil
+		}
+		var keys *zoneKeys
+		var ttl uint32
+		var err error
+		dsSet, keys, ttl, err = v.delegation(zone, depth)
+		if err != nil {
+			return nil, err
+		}
+		if keys != nil {
+			return v.cacheKeys(zone, keys, ttl), nil
+		}
+	}
+
+	resp, err := v.fetch(zone, dns.TypeDNSKEY)
+	if err != nil {
+		return nil, err
+	}
+	var keySet *rrSet
+	for _, set := range groupRRsets(resp.Answer) {
+		if set.name == zone && set.rtype == dns.TypeDNSKEY {
+			keySet = set
+		}
+	}
+	if keySet == nil {
+		return nil, newDNSSECError(dns.ExtendedErrorCodeDNSKEYMissing, "zone %s has no DNSKEY", zone)
+	}
+
+	supported := false
+	err = newDNSSECError(dns.ExtendedErrorCodeDNSKEYMissing, "no DNSKEY of %s matches its DS", zone)
+	for _, ds := range dsSet {
+		if !dnssecAlgorithms[ds.Algorithm] || !dnssecDigests[ds.DigestType] {
+			continue
+		}
+		supported = true
+		for _, rr := range keySet.rrs {
+			key := rr.(*dns.DNSKEY)
+			if key.KeyTag() != ds.KeyTag || key.Algorithm != ds.Algorithm {
+				continue
+			}
+			if keyDS := key.ToDS(ds.DigestType); keyDS == nil || !strings.EqualFold(keyDS.Digest, ds.Digest) {
+				continue
+			}
+			if err = verifySignatures(keySet, []*dns.DNSKEY{key}, time.Now()); err != nil {
+				continue
+			}
+			keys := &zoneKeys{zone: zone, secure: true}
+			for _, rr := range keySet.rrs {
+				keys.keys = append(keys.keys, rr.(*dns.DNSKEY))
+			}
+			return v.cacheKeys(zone, keys, minRRTTL(keySet.rrs)), nil
+		}
+	}
+	if !supported {
+		log.Debug("zone %s is signed with unsupported algorithms, treated as unsigned", zone)
+		return v.cacheKeys(zone, &zoneKeys{zone: zone}, minRRTTL(keySet.rrs)), nil
+	}
+	return nil, err
+}
+
+// delegation returns the validated DS records of zone. If zone has none, it
+// returns the keys of its names instead: none for an unsigned delegation, the
+// keys of the parent zone if zone is not a zone cut.
+func (v *dnssecValidator) delegation(zone string, depth int) ([]*dns.DS, *zoneKeys, uint32, error) {
+	resp, err := v.fetch(zone, dns.TypeDS)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+
+	var dsSet *rrSet
+	for _, set := range groupRRsets(resp.Answer) {
+		if set.name == zone && set.rtype == dns.TypeDS {
+			dsSet = set
+		}
+	}
+	var proof []*rrSet
+	if dsSet != nil {
+		proof = []*rrSet{dsSet}
+	} else {
+		for _, set := range groupRRsets(resp.Ns) {
+			if set.rtype == dns.TypeSOA || set.rtype == dns.TypeNSEC || set.rtype == dns.TypeNSEC3 {
+				proof = append(proof, set)
+			}
+		}
+	}
+
+	var signer string
+	for _, set := range proof {
+		if len(set.sigs) > 0 {
+			signer = normalizeName(set.sigs[0].SignerName)
+			break
+		}
+	}
+	if len(signer) == 0 {
+		// unsigned, the parent must be unsigned too.
+		off, _ := dns.NextLabel(zone, 0)
+		parent, err := v.keysOf(zone[off:], depth+1)
+		if err != nil {
+			return nil, nil, 0, err
+		}
+		if parent.secure {
+			return nil, nil, 0, newDNSSECError(dns.ExtendedErrorCodeRRSIGsMissing, "DS of %s in signed zone %s has no signature", zone, parent.zone)
+		}
+		return nil, &zoneKeys{zone: zone}, minDNSSECKeyTTL, nil
+	}
+	if signer == zone || !inZone(zone, signer) {
+		return nil, nil, 0, newDNSSECError(dns.ExtendedErrorCodeDNSBogus, "DS of %s is signed by %s, which is not its parent", zone, signer)
+	}
+	parent, err := v.keysOf(signer, depth+1)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	if !parent.secure {
+		return nil, &zoneKeys{zone: zone}, maxDNSSECKeyTTL, nil
+	}
+	now := time.Now()
+	for _, set := range proof {
+		if err := verifySignatures(set, parent.keys, now); err != nil {
+			return nil, nil, 0, err
+		}
+	}
+
+	if dsSet != nil {
+		var ds []*dns.DS
+		for _, rr := range dsSet.rrs {
+			ds = append(ds, rr.(*dns.DS))
+		}
+		return ds, nil, 0, nil
+	}
+
+	var nsecs []*dns.NSEC
+	var nsec3s []*dns.NSEC3
+	var ttl uint32 = maxDNSSECKeyTTL
+	for _, set := range proof {
+		ttl = min(ttl, minRRTTL(set.rrs))
+		for _, rr := range set.rrs {
+			switch nsec := rr.(type) {
+			case *dns.NSEC:
+				nsecs = append(nsecs, nsec)
+			case *dns.NSEC3:
+				nsec3s = append(nsec3s, nsec)
+			}
+		}
+	}
+	cut, err := verifyNoDS(zone, nsecs, nsec3s)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	if cut {
+		log.Debug("zone %s is an unsigned delegation of %s", zone, signer)
+		return nil, &zoneKeys{zone: zone}, ttl, nil
+	}
+	return nil, &zoneKeys{zone: parent.zone, secure: true, keys: parent.keys}, ttl, nil
+}
+
+// cacheKeys caches the keys signing the names of zone.
+func (v *dnssecValidator) cacheKeys(zone string, keys *zoneKeys, ttl uint32) *zoneKeys {
+	ttl = max(minDNSSECKeyTTL, min(ttl, maxDNSSECKeyTTL))
+	v.keys.SetCacheWithTTL(zone, keys, time.Duration(ttl)*time.Second)
+	return keys
+}
+
+// fetch queries the records of the chain of trust.
+func (v *dnssecValidator) fetch(name string, qtype uint16) (*dns.Msg, error) {
+	m := new(dns.Msg)
+	m.SetQuestion(name, qtype)
+	m.CheckingDisabled = true
+	m.SetEdns0(defaultEDNSUDPSize, true)
+	resp, err := v.exchange(m)
+	if err != nil {
+		return nil, newDNSSECError(dns.ExtendedErrorCodeNetworkError, "query %s %s: %v", name, dns.TypeToString[qtype], err)
+	}
+	if resp.Rcode != dns.RcodeSuccess && resp.Rcode != dns.RcodeNameError {
+		return nil, newDNSSECError(dns.ExtendedErrorCodeDNSSECIndeterminate, "query %s %s: %s",
+			name, dns.TypeToString[qtype], dns.RcodeToString[resp.Rcode])
+	}
+	return resp, nil
+}
+
+// verifySignatures checks that a valid signature of set was made by one of keys.
+func verifySignatures(set *rrSet, keys []*dns.DNSKEY, now time.Time) error {
+	if len(set.sigs) == 0 {
+		return newDNSSECError(dns.ExtendedErrorCodeRRSIGsMissing, "%s %s has no signature", set.name, dns.TypeToString[set.rtype])
+	}
+	var err error
+	for _, sig := range set.sigs {
+		for _, key := range keys {
+			if key.KeyTag() != sig.KeyTag || key.Algorithm != sig.Algorithm {
+				continue
+			}
+			if key.Flags&dns.ZONE == 0 {
+				err = newDNSSECError(dns.ExtendedErrorCodeNoZoneKeyBitSet, "key %d of %s is no zone key", key.KeyTag(), key.Hdr.Name)
+				continue
+			}
+			if !sig.ValidityPeriod(now) {
+				if int32(sig.Inception-uint32(now.Unix())) > 0 {
+					err = newDNSSECError(dns.ExtendedErrorCodeSignatureNotYetValid, "signature of %s %s is not yet valid", set.name, dns.TypeToString[set.rtype])
+				} else {
+					err = newDNSSECError(dns.ExtendedErrorCodeSignatureExpired, "signature of %s %s has expired", set.name, dns.TypeToString[set.rtype])
+				}
+				continue
+			}
+			if e := sig.Verify(key, set.rrs); e != nil {
+				err = newDNSSECError(dns.ExtendedErrorCodeDNSBogus, "signature of %s %s by key %d does not verify: %v", set.name, dns.TypeToString[set.rtype], key.KeyTag(), e)
+				continue
+			}
+			return nil
+		}
+	}
+	if err == nil {
+		err = newDNSSECError(dns.ExtendedErrorCodeDNSKEYMissing, "no key of %s signs %s %s", set.sigs[0].SignerName, set.name, dns.TypeToString[set.rtype])
+	}
+	return err
+}
+
+// verifyDenial checks that the NSEC or NSEC3 records prove that name doesn't
+// exist if nxdomain, or has no record of qtype otherwise, and that no wildcard
+// matches name instead (RFC 4035 section 5.4, RFC 5155 section 8). It reports
+// whether the proof is secure, which it is not if it relies on an opt-out
+// NSEC3 that may skip an unsigned delegation.
+func verifyDenial(name string, qtype uint16, nxdomain bool, nsecs []*dns.NSEC, nsec3s []*dns.NSEC3) (bool, error) {
+	if nxdomain {
+		encloser, optOut, found := closestEncloser(name, nsecs, nsec3s)
+		if !found {
+			return false, newDNSSECError(dns.ExtendedErrorCodeNSECMissing, "no proof that %s doesn't exist", name)
+		}
+		if !coversName("*."+encloser, nsecs, nsec3s) {
+			return false, newDNSSECError(dns.ExtendedErrorCodeNSECMissing, "no proof that no wildcard of %s matches %s", encloser, name)
+		}
+		return !optOut, nil
+	}
+
+	parentSide := false
+	for _, nsec := range nsecs {
+		if normalizeName(nsec.Hdr.Name) == name {
+			if delegatedTypes(nsec.TypeBitMap, qtype) {
+				parentSide = true
+				continue
+			}
+			if deniesType(nsec.TypeBitMap, qtype) {
+				return true, nil
+			}
+		}
+		// an empty non-terminal, the next name is below it.
+		if nsecCovers(nsec, name) && inZone(normalizeName(nsec.NextDomain), name) {
+			return true, nil
+		}
+	}
+	for _, nsec3 := range nsec3s {
+		if nsec3.Match(name) {
+			if delegatedTypes(nsec3.TypeBitMap, qtype) {
+				parentSide = true
+				continue
+			}
+			if deniesType(nsec3.TypeBitMap, qtype) {
+				return true, nil
+			}
+		}
+	}
+	if qtype == dns.TypeDS {
+		// an unsigned delegation in an opt-out span, RFC 5155 section 8.6.
+		if _, optOut, found := closestEncloser(name, nil, nsec3s); found && optOut {
+			return false, nil
+		}
+	}
+	if parentSide {
+		return false, newDNSSECError(dns.ExtendedErrorCodeDNSBogus, "denial of %s %s is from the other side of its zone cut", name, dns.TypeToString[qtype])
+	}
+
+	// the name doesn't exist, and the wildcard matching it has no record of qtype.
+	if encloser, optOut, found := closestEncloser(name, nsecs, nsec3s); found {
+		wildcard := "*." + encloser
+		for _, nsec := range nsecs {
+			if normalizeName(nsec.Hdr.Name) == wildcard && deniesType(nsec.TypeBitMap, qtype) {
+				return true, nil
+			}
+		}
+		for _, nsec3 := range nsec3s {
+			if nsec3.Match(wildcard) && deniesType(nsec3.TypeBitMap, qtype) {
+				return !optOut, nil
+			}
+		}
+	}
+	return false, newDNSSECError(dns.ExtendedErrorCodeNSECMissing, "no proof that %s has no %s", name, dns.TypeToString[qtype])
+}
+
+// deniesType reports whether the type bitmap of a NSEC or NSEC3 record of a
+// name proves it has no record of qtype, nor a CNAME answered instead.
+func deniesType(bitmap []uint16, qtype uint16) bool {
+	return !hasType(bitmap, qtype) && !hasType(bitmap, dns.TypeCNAME)
+}
+
+// delegatedTypes reports whether the type bitmap is that of the other side of
+// a zone cut than the answer of qtype: a delegation of the parent zone for
+// the records of the child, or the apex of the child for a DS record, which
+// only the parent has (RFC 4035 section 5.4, RFC 6840 section 4.4).
+func delegatedTypes(bitmap []uint16, qtype uint16) bool {
+	if qtype == dns.TypeDS {
+		return hasType(bitmap, dns.TypeSOA)
+	}
+	return hasType(bitmap, dns.TypeNS) && !hasType(bitmap, dns.TypeSOA)
+}
+
+// verifyNoDS checks the proof that zone has no DS record, and reports
+// whether zone is an unsigned delegation rather than a name of its parent.
+func verifyNoDS(zone string, nsecs []*dns.NSEC, nsec3s []*dns.NSEC3) (bool, error) {
+	for _, nsec := range nsecs {
+		if normalizeName(nsec.Hdr.Name) == zone {
+			if hasType(nsec.TypeBitMap, dns.TypeDS) {
+				return false, newDNSSECError(dns.ExtendedErrorCodeDNSBogus, "NSEC of %s lists the DS it denies", zone)
+			}
+			return hasType(nsec.TypeBitMap, dns.TypeNS) && !hasType(nsec.TypeBitMap, dns.TypeSOA), nil
+		}
+		if nsecCovers(nsec, zone) {
+			// zone is an empty non-terminal or doesn't exist, it's no zone cut.
+			return false, nil
+		}
+	}
+	for _, nsec3 := range nsec3s {
+		if nsec3.Match(zone) {
+			if hasType(nsec3.TypeBitMap, dns.TypeDS) {
+				return false, newDNSSECError(dns.ExtendedErrorCodeDNSBogus, "NSEC3 of %s lists the DS it denies", zone)
+			}
+			return hasType(nsec3.TypeBitMap, dns.TypeNS) && !hasType(nsec3.TypeBitMap, dns.TypeSOA), nil
+		}
+	}
+	for _, nsec3 := range nsec3s {
+		if nsec3.Flags&1 == 1 && nsec3Covers(nsec3, zone) {
+			// opt-out spans only skip unsigned delegations.
+			return true, nil
+		}
+	}
+	return false, newDNSSECError(dns.ExtendedErrorCodeNSECMissing, "no proof that %s has no DS", zone)
+}
+
+// closestEncloser returns the closest encloser of name proven by the NSEC or
+// NSEC3 records, if they prove that name doesn't exist. NSEC3 needs the
+// closest encloser proof of RFC 5155 section 8.3, optOut reports whether the
+// next closer name is covered by an opt-out NSEC3.
+func closestEncloser(name string, nsecs []*dns.NSEC, nsec3s []*dns.NSEC3) (string, bool, bool) {
+	for _, nsec := range nsecs {
+		if nsecCovers(nsec, name) {
+			// the longest ancestor of name existing, the owner or the next name of nsec.
+			labels := max(dns.CompareDomainName(name, nsec.Hdr.Name), dns.CompareDomainName(name, nsec.NextDomain))
+			return lastLabels(name, labels), false, true
+		}
+	}
+	nextCloser := name
+	for off, end := dns.NextLabel(name, 0); !end; off, end = dns.NextLabel(name, off) {
+		encloser := name[off:]
+		for _, nsec3 := range nsec3s {
+			if !nsec3.Match(encloser) {
+				continue
+			}
+			for _, cover := range nsec3s {
+				if nsec3Covers(cover, nextCloser) {
+					return encloser, cover.Flags&1 == 1, true
+				}
+			}
+			return "", false, false
+		}
+		nextCloser = encloser
+	}
+	return "", false, false
+}
+
+// coversName reports whether a NSEC or NSEC3 record proves that name doesn't
+// exist, without looking for its closest encloser.
+func coversName(name string, nsecs []*dns.NSEC, nsec3s []*dns.NSEC3) bool {
+	for _, nsec := range nsecs {
+		if nsecCovers(nsec, name) {
+			return true
+		}
+	}
+	for _, nsec3 := range nsec3s {
+		if nsec3Covers(nsec3, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// provesExpansion reports whether the NSEC or NSEC3 records prove that name,
+// answered by a wildcard of labels labels, doesn't exist. Its closest
+// encloser is the wildcard's parent, so NSEC3 only needs to cover the next
+// closer name (RFC 5155 section 8.8).
+func provesExpansion(name string, labels int, nsecs []*dns.NSEC, nsec3s []*dns.NSEC3) bool {
+	for _, nsec := range nsecs {
+		if nsecCovers(nsec, name) {
+			return true
+		}
+	}
+	nextCloser := lastLabels(name, labels+1)
+	for _, nsec3 := range nsec3s {
+		if nsec3Covers(nsec3, nextCloser) {
+			return true
+		}
+	}
+	return false
+}
+
+// lastLabels returns the ancestor of name with its last n labels.
+func lastLabels(name string, n int) string {
+	indexes := dns.Split(name)
+	if n <= 0 {
+		return "."
+	}
+	if n >= len(indexes) {
+		return name
+	}
+	return name[indexes[len(indexes)-n]:]
+}
+
+// nsecCovers reports whether name sorts strictly between the owner and the
+// next name of nsec, in the canonical order of RFC 4034 section 6.1.
+func nsecCovers(nsec *dns.NSEC, name string) bool {
+	owner, next := normalizeName(nsec.Hdr.Name), normalizeName(nsec.NextDomain)
+	if canonicalCompare(owner, next) < 0 {
+		return canonicalCompare(owner, name) < 0 && canonicalCompare(name, next) < 0
+	}
+	// the last NSEC of the zone, its next name is the apex.
+	return canonicalCompare(owner, name) < 0 && inZone(name, next)
+}
+
+// nsec3Covers reports whether the hash of name sorts strictly between the
+// owner and the next hash of nsec3. Cover also holds for the owner's hash.
+func nsec3Covers(nsec3 *dns.NSEC3, name string) bool {
+	return nsec3.Cover(name) && !nsec3.Match(name)
+}
+
+func canonicalCompare(a, b string) int {
+	la, lb := dns.SplitDomainName(a), dns.SplitDomainName(b)
+	for i := 1; i <= len(la) && i <= len(lb); i++ {
+		if c := strings.Compare(strings.ToLower(la[len(la)-i]), strings.ToLower(lb[len(lb)-i])); c != 0 {
+			return c
+		}
+	}
+	return len(la) - len(lb)
+}
+
+func hasType(bitmap []uint16, rtype uint16) bool {
+	for _, t := range bitmap {
+		if t == rtype {
+			return true
+		}
+	}
+	return false
+}
+
+// synthesizedFromDNAME reports whether a DNAME of the answer owns a parent of name.
+func synthesizedFromDNAME(name string, answer []*rrSet) bool {
+	for _, set := range answer {
+		if set.rtype == dns.TypeDNAME && set.name != name && inZone(name, set.name) {
+			return true
+		}
+	}
+	return false
+}
+
+// groupRRsets groups records into sets of the same name and type, with the
+// signatures covering them, in the order they first appear.
+func groupRRsets(rrs []dns.RR) []*rrSet {
+	var sets []*rrSet
+	index := make(map[string]*rrSet)
+	key := func(name string, rtype uint16) string {
+		return fmt.Sprintf("%s|%d", name, rtype)
+	}
+	for _, rr := range rrs {
+		if rr.Header().Rrtype == dns.TypeRRSIG || rr.Header().Rrtype == dns.TypeOPT {
+			continue
+		}
+		name := normalizeName(rr.Header().Name)
+		set, found := index[key(name, rr.Header().Rrtype)]
+		if !found {
+			set = &rrSet{name: name, rtype: rr.Header().Rrtype}
+			index[key(name, rr.Header().Rrtype)] = set
+			sets = append(sets, set)
+		}
+		set.rrs = append(set.rrs, rr)
+	}
+	for _, rr := range rrs {
+		if sig, ok := rr.(*dns.RRSIG); ok {
+			if set, found := index[key(normalizeName(sig.Hdr.Name), sig.TypeCovered)]; found {
+				set.sigs = append(set.sigs, sig)
+			}
+		}
+	}
+	return sets
+}
+
+// stripDNSSEC removes the DNSSEC records a client not setting the DO bit
+// didn't ask for, RFC 4035 section 3.2.1.
+func stripDNSSEC(rrs []dns.RR, qtype uint16) []dns.RR {
+	result := make([]dns.RR, 0, len(rrs))
+	for _, rr := range rrs {
+		switch rr.Header().Rrtype {
+		case dns.TypeRRSIG, dns.TypeNSEC, dns.TypeNSEC3:
+			if rr.Header().Rrtype != qtype {
+				continue
+			}
+		}
+		result = append(result, rr)
+	}
+	return result
+}
+
+// exchangeDNSSEC forwards the queries of the chain of trust by the forward rules.
+func (p *ProxyService) exchangeDNSSEC(r *dns.Msg) (*dns.Msg, error) {
+	resp, _, err := p.exchangeUpstream(r, "")
+	return resp, err
+}
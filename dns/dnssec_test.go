@@ -0,0 +1,409 @@
+package dns
+
+import (
+	"crypto"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// testSigner signs the records of a zone with its key signing key.
+type testSigner struct {
+	key  *dns.DNSKEY
+	priv crypto.Signer
+}
+
+func newTestSigner(t *testing.T, zone string) *testSigner {
+	key := &dns.DNSKEY{
+		Hdr:       dns.RR_Header{Name: zone, Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: 3600},
+		Flags:     dns.ZONE | dns.SEP,
+		Protocol:  3,
+		Algorithm: dns.ECDSAP256SHA256,
+	}
+	priv, err := key.Generate(256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testSigner{key: key, priv: priv.(crypto.Signer)}
+}
+
+// sign returns the set rrs with its signature, valid for an hour.
+func (s *testSigner) sign(t *testing.T, rrs ...dns.RR) []dns.RR {
+	return s.signAt(t, time.Now().Add(-time.Hour), time.Now().Add(time.Hour), rrs...)
+}
+
+func (s *testSigner) signAt(t *testing.T, inception, expiration time.Time, rrs ...dns.RR) []dns.RR {
+	sig := &dns.RRSIG{
+		Hdr:        dns.RR_Header{Name: rrs[0].Header().Name, Rrtype: dns.TypeRRSIG, Class: dns.ClassINET, Ttl: rrs[0].Header().Ttl},
+		Algorithm:  s.key.Algorithm,
+		SignerName: s.key.Hdr.Name,
+		KeyTag:     s.key.KeyTag(),
+		Inception:  uint32(inception.Unix()),
+		Expiration: uint32(expiration.Unix()),
+	}
+	if err := sig.Sign(s.priv, rrs); err != nil {
+		t.Fatal(err)
+	}
+	return append(rrs, sig)
+}
+
+func testRR(t *testing.T, s string) dns.RR {
+	rr, err := dns.NewRR(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rr
+}
+
+// testZones answers queries from fixed messages.
+type testZones struct {
+	mu      sync.Mutex
+	msgs    map[string]*dns.Msg
+	queries map[string]int
+	// nowild is an NXDOMAIN of test. without the proof that no wildcard matches.
+	nowild string
+}
+
+func zoneKey(name string, qtype uint16) string {
+	return fmt.Sprintf("%s|%s", name, dns.TypeToString[qtype])
+}
+
+func (z *testZones) add(name string, qtype uint16, rcode int, answer, ns []dns.RR) {
+	m := new(dns.Msg)
+	m.SetQuestion(name, qtype)
+	m.Response = true
+	m.Rcode = rcode
+	m.Answer, m.Ns = answer, ns
+	z.msgs[zoneKey(name, qtype)] = m
+}
+
+func (z *testZones) exchange(r *dns.Msg) (*dns.Msg, error) {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	key := zoneKey(r.Question[0].Name, r.Question[0].Qtype)
+	z.queries[key]++
+	m, found := z.msgs[key]
+	if !found {
+		return nil, fmt.Errorf("no answer of %s", key)
+	}
+	m = m.Copy()
+	m.Id = r.Id
+	return m, nil
+}
+
+func (z *testZones) count(name string, qtype uint16) int {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	return z.queries[zoneKey(name, qtype)]
+}
+
+// nsec3Chain returns the NSEC3 records, unsalted, of the names of zone with
+// their types.
+func nsec3Chain(zone string, names map[string][]uint16, optOut bool) []*dns.NSEC3 {
+	type hashed struct {
+		hash  string
+		types []uint16
+	}
+	var hashes []hashed
+	for name, types := range names {
+		sorted := append([]uint16(nil), types...)
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+		hashes = append(hashes, hashed{hash: dns.HashName(name, dns.SHA1, 0, ""), types: sorted})
+	}
+	sort.Slice(hashes, func(i, j int) bool { return hashes[i].hash < hashes[j].hash })
+	var flags uint8
+	if optOut {
+		flags = 1
+	}
+	var chain []*dns.NSEC3
+	for i, h := range hashes {
+		chain = append(chain, &dns.NSEC3{
+			Hdr:        dns.RR_Header{Name: h.hash + "." + zone, Rrtype: dns.TypeNSEC3, Class: dns.ClassINET, Ttl: 300},
+			Hash:       dns.SHA1,
+			Flags:      flags,
+			HashLength: 20,
+			NextDomain: hashes[(i+1)%len(hashes)].hash,
+			TypeBitMap: h.types,
+		})
+	}
+	return chain
+}
+
+// nsec3Proof returns the signed NSEC3 records matching or covering names.
+func nsec3Proof(t *testing.T, s *testSigner, chain []*dns.NSEC3, names ...string) []dns.RR {
+	picked := make(map[*dns.NSEC3]bool)
+	var rrs []dns.RR
+	for _, name := range names {
+		var found *dns.NSEC3
+		for _, nsec3 := range chain {
+			if nsec3.Match(name) {
+				found = nsec3
+			}
+		}
+		for _, nsec3 := range chain {
+			if found == nil && nsec3Covers(nsec3, name) {
+				found = nsec3
+			}
+		}
+		if found == nil {
+			t.Fatalf("no NSEC3 of %s", name)
+		}
+		if !picked[found] {
+			picked[found] = true
+			rrs = append(rrs, s.sign(t, found)...)
+		}
+	}
+	return rrs
+}
+
+// expand returns the signed wildcard records rrs as answers for name.
+func expand(rrs []dns.RR, name string) []dns.RR {
+	for _, rr := range rrs {
+		rr.Header().Name = name
+	}
+	return rrs
+}
+
+// testDNSSECZones returns the trust anchor and zones signed from the root:
+// example. denying names with NSEC, test. and opt. with NSEC3, the latter
+// opting out, and the unsigned delegation unsigned.
+func testDNSSECZones(t *testing.T) (string, *testZones) {
+	z := &testZones{msgs: make(map[string]*dns.Msg), queries: make(map[string]int)}
+	root := newTestSigner(t, ".")
+	example := newTestSigner(t, "example.")
+	test := newTestSigner(t, "test.")
+	opt := newTestSigner(t, "opt.")
+	nods := newTestSigner(t, "nods.example.")
+	wrongDS := newTestSigner(t, "wrongds.example.")
+	other := newTestSigner(t, "other.")
+
+	join := func(sets ...[]dns.RR) []dns.RR {
+		var rrs []dns.RR
+		for _, set := range sets {
+			rrs = append(rrs, set...)
+		}
+		return rrs
+	}
+	rootSOA := root.sign(t, testRR(t, ". 300 IN SOA a.root. nstld.root. 1 1800 900 604800 300"))
+	z.add(".", dns.TypeDNSKEY, dns.RcodeSuccess, root.sign(t, root.key), nil)
+	for _, child := range []*testSigner{example, test, opt} {
+		z.add(child.key.Hdr.Name, dns.TypeDS, dns.RcodeSuccess, root.sign(t, child.key.ToDS(dns.SHA256)), nil)
+		z.add(child.key.Hdr.Name, dns.TypeDNSKEY, dns.RcodeSuccess, child.sign(t, child.key), nil)
+	}
+
+	// unsigned. is delegated without DS.
+	z.add("unsigned.", dns.TypeDS, dns.RcodeSuccess, nil,
+		join(rootSOA, root.sign(t, testRR(t, "unsigned. 300 IN NSEC zz. NS RRSIG NSEC"))))
+	z.add("www.unsigned.", dns.TypeDS, dns.RcodeSuccess, nil, []dns.RR{testRR(t, "unsigned. 300 IN SOA ns.unsigned. h.unsigned. 1 3600 600 86400 300")})
+	z.add("www.unsigned.", dns.TypeA, dns.RcodeSuccess, []dns.RR{testRR(t, "www.unsigned. 300 IN A 192.0.2.9")}, nil)
+
+	// example. with NSEC.
+	soa := example.sign(t, testRR(t, "example. 300 IN SOA ns.example. h.example. 1 3600 600 86400 300"))
+	apexNSEC := example.sign(t, testRR(t, "example. 300 IN NSEC bad.example. SOA NS RRSIG NSEC DNSKEY"))
+	mailNSEC := example.sign(t, testRR(t, "mail.example. 300 IN NSEC nods.example. A RRSIG NSEC"))
+	subNSEC := example.sign(t, testRR(t, "sub.example. 300 IN NSEC *.wild.example. NS RRSIG NSEC"))
+	wildNSEC := example.sign(t, testRR(t, "*.wild.example. 300 IN NSEC www.example. A RRSIG NSEC"))
+	wwwNSEC := example.sign(t, testRR(t, "www.example. 300 IN NSEC wrongds.example. A RRSIG NSEC"))
+
+	z.add("www.example.", dns.TypeA, dns.RcodeSuccess, example.sign(t, testRR(t, "www.example. 300 IN A 192.0.2.1")), nil)
+	bad := example.sign(t, testRR(t, "bad.example. 300 IN A 192.0.2.2"))
+	bad[0].(*dns.A).A = net.ParseIP("198.51.100.66")
+	z.add("bad.example.", dns.TypeA, dns.RcodeSuccess, bad, nil)
+	z.add("old.example.", dns.TypeA, dns.RcodeSuccess,
+		example.signAt(t, time.Now().Add(-48*time.Hour), time.Now().Add(-24*time.Hour), testRR(t, "old.example. 300 IN A 192.0.2.3")), nil)
+	z.add("missing.example.", dns.TypeA, dns.RcodeNameError, nil, join(soa, mailNSEC, apexNSEC))
+	z.add("mars.example.", dns.TypeA, dns.RcodeNameError, nil, join(soa, mailNSEC))
+	z.add("a.wild.example.", dns.TypeA, dns.RcodeNameError, nil, join(soa, wildNSEC, apexNSEC))
+	z.add("www.example.", dns.TypeTXT, dns.RcodeSuccess, nil, join(soa, wwwNSEC))
+	z.add("sub.example.", dns.TypeA, dns.RcodeSuccess, nil, join(soa, subNSEC))
+	z.add("sub.example.", dns.TypeDS, dns.RcodeSuccess, nil, join(soa, subNSEC))
+	z.add("x.wild.example.", dns.TypeA, dns.RcodeSuccess,
+		expand(example.sign(t, testRR(t, "*.wild.example. 300 IN A 192.0.2.4")), "x.wild.example."), wildNSEC)
+	z.add("x.wild.example.", dns.TypeTXT, dns.RcodeSuccess, nil, join(soa, wildNSEC))
+	z.add("y.wild.example.", dns.TypeA, dns.RcodeSuccess,
+		expand(example.sign(t, testRR(t, "*.wild.example. 300 IN A 192.0.2.4")), "y.wild.example."), nil)
+
+	// nods.example. is signed, but its parent has no DS nor denies it.
+	z.add("nods.example.", dns.TypeDS, dns.RcodeSuccess, nil, soa)
+	z.add("www.nods.example.", dns.TypeA, dns.RcodeSuccess, nods.sign(t, testRR(t, "www.nods.example. 300 IN A 192.0.2.5")), nil)
+	// the DS of wrongds.example. is of another key.
+	wrongKey := *other.key
+	wrongKey.Hdr.Name = "wrongds.example."
+	z.add("wrongds.example.", dns.TypeDS, dns.RcodeSuccess, example.sign(t, wrongKey.ToDS(dns.SHA256)), nil)
+	z.add("wrongds.example.", dns.TypeDNSKEY, dns.RcodeSuccess, wrongDS.sign(t, wrongDS.key), nil)
+	z.add("www.wrongds.example.", dns.TypeA, dns.RcodeSuccess, wrongDS.sign(t, testRR(t, "www.wrongds.example. 300 IN A 192.0.2.6")), nil)
+
+	// test. with NSEC3.
+	testSOA := test.sign(t, testRR(t, "test. 300 IN SOA ns.test. h.test. 1 3600 600 86400 300"))
+	chain := nsec3Chain("test.", map[string][]uint16{
+		"test.":        {dns.TypeSOA, dns.TypeNS, dns.TypeDNSKEY, dns.TypeNSEC3PARAM, dns.TypeRRSIG},
+		"www.test.":    {dns.TypeA, dns.TypeRRSIG},
+		"wild.test.":   nil,
+		"*.wild.test.": {dns.TypeA, dns.TypeRRSIG},
+		"sub.test.":    {dns.TypeNS},
+	}, false)
+	z.add("nx.test.", dns.TypeA, dns.RcodeNameError, nil,
+		join(testSOA, nsec3Proof(t, test, chain, "test.", "nx.test.", "*.test.")))
+	// a name whose NSEC3 doesn't also cover the wildcard of the apex.
+	for i := 0; ; i++ {
+		name := fmt.Sprintf("nowild%d.test.", i)
+		var cover *dns.NSEC3
+		for _, nsec3 := range chain {
+			if nsec3Covers(nsec3, name) {
+				cover = nsec3
+			}
+		}
+		if cover != nil && !nsec3Covers(cover, "*.test.") {
+			z.add(name, dns.TypeA, dns.RcodeNameError, nil, join(testSOA, nsec3Proof(t, test, chain, "test.", name)))
+			z.nowild = name
+			break
+		}
+	}
+	z.add("www.test.", dns.TypeTXT, dns.RcodeSuccess, nil, join(testSOA, nsec3Proof(t, test, chain, "www.test.")))
+	z.add("sub.test.", dns.TypeA, dns.RcodeSuccess, nil, join(testSOA, nsec3Proof(t, test, chain, "sub.test.")))
+	z.add("a.wild.test.", dns.TypeA, dns.RcodeSuccess,
+		expand(test.sign(t, testRR(t, "*.wild.test. 300 IN A 192.0.2.7")), "a.wild.test."), nsec3Proof(t, test, chain, "a.wild.test."))
+	z.add("b.wild.test.", dns.TypeA, dns.RcodeSuccess,
+		expand(test.sign(t, testRR(t, "*.wild.test. 300 IN A 192.0.2.7")), "b.wild.test."), nil)
+	z.add("a.wild.test.", dns.TypeTXT, dns.RcodeSuccess, nil,
+		join(testSOA, nsec3Proof(t, test, chain, "wild.test.", "a.wild.test.", "*.wild.test.")))
+
+	// opt. with opt-out NSEC3.
+	optSOA := opt.sign(t, testRR(t, "opt. 300 IN SOA ns.opt. h.opt. 1 3600 600 86400 300"))
+	optChain := nsec3Chain("opt.", map[string][]uint16{
+		"opt.":     {dns.TypeSOA, dns.TypeNS, dns.TypeDNSKEY, dns.TypeNSEC3PARAM, dns.TypeRRSIG},
+		"www.opt.": {dns.TypeA, dns.TypeRRSIG},
+	}, true)
+	z.add("nx.opt.", dns.TypeA, dns.RcodeNameError, nil,
+		join(optSOA, nsec3Proof(t, opt, optChain, "opt.", "nx.opt.", "*.opt.")))
+	z.add("unsig.opt.", dns.TypeDS, dns.RcodeSuccess, nil,
+		join(optSOA, nsec3Proof(t, opt, optChain, "opt.", "unsig.opt.")))
+
+	return root.key.ToDS(dns.SHA256).String(), z
+}
+
+func msgEDE(m *dns.Msg) (uint16, bool) {
+	if opt := m.IsEdns0(); opt != nil {
+		for _, option := range opt.Option {
+			if ede, ok := option.(*dns.EDNS0_EDE); ok {
+				return ede.InfoCode, true
+			}
+		}
+	}
+	return 0, false
+}
+
+func TestDNSSECValidate(t *testing.T) {
+	anchor, zones := testDNSSECZones(t)
+	v := newDNSSECValidator(&DNSSECConfig{Validate: true, TrustAnchors: []string{anchor}}, zones.exchange)
+	tests := []struct {
+		name  string
+		qtype uint16
+		rcode int
+		ad    bool
+		ede   uint16
+	}{
+		{name: "www.example.", qtype: dns.TypeA, ad: true},
+		{name: "bad.example.", qtype: dns.TypeA, rcode: dns.RcodeServerFailure, ede: dns.ExtendedErrorCodeDNSBogus},
+		{name: "old.example.", qtype: dns.TypeA, rcode: dns.RcodeServerFailure, ede: dns.ExtendedErrorCodeSignatureExpired},
+		{name: "www.nods.example.", qtype: dns.TypeA, rcode: dns.RcodeServerFailure, ede: dns.ExtendedErrorCodeNSECMissing},
+		{name: "www.wrongds.example.", qtype: dns.TypeA, rcode: dns.RcodeServerFailure, ede: dns.ExtendedErrorCodeDNSKEYMissing},
+		{name: "www.unsigned.", qtype: dns.TypeA},
+
+		// NSEC
+		{name: "missing.example.", qtype: dns.TypeA, rcode: dns.RcodeNameError, ad: true},
+		{name: "mars.example.", qtype: dns.TypeA, rcode: dns.RcodeServerFailure, ede: dns.ExtendedErrorCodeNSECMissing},
+		// the wildcard owning the NSEC covering the name exists.
+		{name: "a.wild.example.", qtype: dns.TypeA, rcode: dns.RcodeServerFailure, ede: dns.ExtendedErrorCodeNSECMissing},
+		{name: "www.example.", qtype: dns.TypeTXT, ad: true},
+		{name: "x.wild.example.", qtype: dns.TypeTXT, ad: true},
+		// the NSEC of a delegation is from the parent zone.
+		{name: "sub.example.", qtype: dns.TypeA, rcode: dns.RcodeServerFailure, ede: dns.ExtendedErrorCodeDNSBogus},
+		{name: "sub.example.", qtype: dns.TypeDS, ad: true},
+		{name: "x.wild.example.", qtype: dns.TypeA, ad: true},
+		{name: "y.wild.example.", qtype: dns.TypeA, rcode: dns.RcodeServerFailure, ede: dns.ExtendedErrorCodeNSECMissing},
+
+		// NSEC3
+		{name: "nx.test.", qtype: dns.TypeA, rcode: dns.RcodeNameError, ad: true},
+		{name: zones.nowild, qtype: dns.TypeA, rcode: dns.RcodeServerFailure, ede: dns.ExtendedErrorCodeNSECMissing},
+		{name: "www.test.", qtype: dns.TypeTXT, ad: true},
+		{name: "sub.test.", qtype: dns.TypeA, rcode: dns.RcodeServerFailure, ede: dns.ExtendedErrorCodeDNSBogus},
+		{name: "a.wild.test.", qtype: dns.TypeA, ad: true},
+		{name: "b.wild.test.", qtype: dns.TypeA, rcode: dns.RcodeServerFailure, ede: dns.ExtendedErrorCodeNSECMissing},
+		{name: "a.wild.test.", qtype: dns.TypeTXT, ad: true},
+		// an opt-out span may hide an unsigned delegation.
+		{name: "nx.opt.", qtype: dns.TypeA, rcode: dns.RcodeNameError},
+		{name: "unsig.opt.", qtype: dns.TypeDS},
+	}
+	for _, tt := range tests {
+		r := ednsQuery(tt.name, tt.qtype)
+		resp, err := zones.exchange(v.query(r))
+		if err != nil {
+			t.Fatal(err)
+		}
+		m := v.validate(r, resp)
+		ede, hasEDE := msgEDE(m)
+		if m.Rcode != tt.rcode || m.AuthenticatedData != tt.ad || m.CheckingDisabled {
+			t.Errorf("%s %s: %s, ad %t, ede %d", tt.name, dns.Type(tt.qtype), dns.RcodeToString[m.Rcode], m.AuthenticatedData, ede)
+			continue
+		}
+		if tt.rcode == dns.RcodeServerFailure && (!hasEDE || ede != tt.ede) {
+			t.Errorf("%s %s: extended error %d, want %d", tt.name, dns.Type(tt.qtype), ede, tt.ede)
+		}
+	}
+}
+
+func TestDNSSECForward(t *testing.T) {
+	anchor, zones := testDNSSECZones(t)
+	p := testCacheProxy()
+	p.edns.Store(newEDNSPolicy(&EDNSConfig{}))
+	p.upstreams.Store(&upstreamRouter{
+		defaultPool: NewUpstreamPool("", []Upstream{&funcUpstream{answer: zones.exchange}}),
+		groups:      make(map[string]*UpstreamPool),
+	})
+	p.dnssec.Store(newDNSSECValidator(&DNSSECConfig{Validate: true, TrustAnchors: []string{anchor}}, p.exchangeDNSSEC))
+
+	query := func(name string, do, ad, cd bool) *dns.Msg {
+		r := testQuery(name, dns.TypeA)
+		r.SetEdns0(4096, do)
+		r.AuthenticatedData, r.CheckingDisabled = ad, cd
+		return r
+	}
+	tests := []struct {
+		name    string
+		r       *dns.Msg
+		rcode   int
+		ad      bool
+		rrsig   bool
+		queries int
+	}{
+		{name: "secure", r: query("www.example.", true, false, false), ad: true, rrsig: true, queries: 1},
+		// the answer is validated once and shared, the AD bit and signatures are per client.
+		{name: "AD without DO", r: query("www.example.", false, true, false), ad: true, queries: 2},
+		{name: "cached without DO", r: query("www.example.", false, false, false), queries: 2},
+		{name: "cached with AD", r: query("www.example.", false, true, false), ad: true, queries: 2},
+		{name: "bogus", r: query("bad.example.", false, false, false), rcode: dns.RcodeServerFailure, queries: 1},
+		// the client checks the answer itself, RFC 4035 section 3.2.2.
+		{name: "checking disabled", r: query("bad.example.", true, false, true), rrsig: true, queries: 2},
+	}
+	for _, tt := range tests {
+		w := newRecordWriter("127.0.0.1")
+		p.forwardUpstreamDNS(w, tt.r, "")
+		m := w.msg
+		rrsig := false
+		for _, rr := range m.Answer {
+			rrsig = rrsig || rr.Header().Rrtype == dns.TypeRRSIG
+		}
+		if m.Rcode != tt.rcode || m.AuthenticatedData != tt.ad || rrsig != tt.rrsig {
+			t.Errorf("%s: %s, ad %t, signatures %t", tt.name, dns.RcodeToString[m.Rcode], m.AuthenticatedData, rrsig)
+		}
+		if queries := zones.count(tt.r.Question[0].Name, dns.TypeA); queries != tt.queries {
+			t.Errorf("%s: %d upstream queries, want %d", tt.name, queries, tt.queries)
+		}
+	}
+}
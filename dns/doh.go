@@ -0,0 +1,127 @@
+package dns
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	dohMediaType    = "application/dns-message"
+	dohMaxBodyBytes = dns.MaxMsgSize
+)
+
+// dohUpstream is a DNS-over-HTTPS (RFC 8484) upstream. The http transport
+// keeps connections alive and negotiates HTTP/2, so queries share one
+// connection per upstream.
+type dohUpstream struct {
+	url    *url.URL
+	method string
+	client *http.Client
+}
+
+func newDoHUpstream(conf *DoHConfig, resolvers []string, timeout time.Duration) (*dohUpstream, error) {
+	u, err := url.Parse(conf.Url)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "https" || len(u.Hostname()) == 0 {
+		return nil, fmt.Errorf("doh upstream %s is not an https url", conf.Url)
+	}
+
+	method := strings.ToUpper(conf.Method)
+	switch method {
+	case "":
+		method = http.MethodPost
+	case http.MethodGet, http.MethodPost:
+	default:
+		return nil, fmt.Errorf("doh method %s is not supported", conf.Method)
+	}
+
+	port := u.Port()
+	if len(port) == 0 {
+		port = "443"
+	}
+	dialer := newBootstrapDialer(u.Hostname(), port, conf.Bootstrap, resolvers, timeout)
+	transport := &http.Transport{
+		DialContext:         dialer.DialContext,
+		TLSClientConfig:     &tls.Config{ServerName: u.Hostname(), MinVersion: tls.VersionTLS12},
+		ForceAttemptHTTP2:   true,
+		MaxIdleConnsPerHost: 4,
+		IdleConnTimeout:     90 * time.Second,
+		TLSHandshakeTimeout: timeout,
+	}
+
+	return &dohUpstream{
+		url:    u,
+		method: method,
+		client: &http.Client{Transport: transport, Timeout: timeout},
+	}, nil
+}
+
+// Close closes the idle connections of the upstream.
+func (u *dohUpstream) Close() error {
+	u.client.CloseIdleConnections()
+	return nil
+}
+
+func (u *dohUpstream) Address() string {
+	return u.url.String()
+}
+
+func (u *dohUpstream) Exchange(r *dns.Msg) (*dns.Msg, error) {
+	// the message id is set to 0 for http cache friendliness, see RFC 8484 section 4.1.
+	msg := r.Copy()
+	msg.Id = 0
+	padMsg(msg, queryPaddingBlock)
+	buf, err := msg.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	var req *http.Request
+	if u.method == http.MethodGet {
+		reqUrl := *u.url
+		query := reqUrl.Query()
+		query.Set("dns", base64.RawURLEncoding.EncodeToString(buf))
+		reqUrl.RawQuery = query.Encode()
+		req, err = http.NewRequest(http.MethodGet, reqUrl.String(), nil)
+	} else {
+		req, err = http.NewRequest(http.MethodPost, u.url.String(), bytes.NewReader(buf))
+		if req != nil {
+			req.Header.Set("Content-Type", dohMediaType)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", dohMediaType)
+
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("doh upstream returns http status %d", resp.StatusCode)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, dohMaxBodyBytes))
+	if err != nil {
+		return nil, err
+	}
+	answer := &dns.Msg{}
+	if err = answer.Unpack(body); err != nil {
+		return nil, err
+	}
+	answer.Id = r.Id
+	return answer, nil
+}
@@ -0,0 +1,182 @@
+package dns
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/OpenNHP/opennhp/nhp/log"
+	"github.com/miekg/dns"
+)
+
+const (
+	defaultDoHPath     = "/dns-query"
+	dohAnswerTimeout   = 10 * time.Second
+	dohShutdownTimeout = 2 * time.Second
+)
+
+// dohServer is a local DNS-over-HTTPS (RFC 8484) listener, letting browsers
+// with built-in secure dns resolve through the proxy.
+type dohServer struct {
+	server  *http.Server
+	handler dns.Handler
+}
+
+func newDoHServer(addr, path string, tlsConfig *tls.Config, handler dns.Handler) *dohServer {
+	s := &dohServer{handler: handler}
+	mux := http.NewServeMux()
+	mux.HandleFunc(dohPath(path), s.serveHTTP)
+	s.server = &http.Server{
+		Addr:              addr,
+		Handler:           mux,
+		TLSConfig:         tlsConfig,
+		ReadHeaderTimeout: 5 * time.Second,
+		IdleTimeout:       90 * time.Second,
+	}
+	return s
+}
+
+// dohPath is the url path queries are served on.
+func dohPath(path string) string {
+	if len(path) == 0 {
+		return defaultDoHPath
+	}
+	return path
+}
+
+func (s *dohServer) ListenAndServe() error {
+	err := s.server.ListenAndServeTLS("", "")
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
+
+func (s *dohServer) Shutdown() error {
+	ctx, cancel := context.WithTimeout(context.Background(), dohShutdownTimeout)
+	defer cancel()
+	return s.server.Shutdown(ctx)
+}
+
+func (s *dohServer) serveHTTP(rw http.ResponseWriter, req *http.Request) {
+	var buf []byte
+	var err error
+	switch req.Method {
+	case http.MethodGet:
+		buf, err = base64.RawURLEncoding.DecodeString(req.URL.Query().Get("dns"))
+	case http.MethodPost:
+		if req.Header.Get("Content-Type") != dohMediaType {
+			http.Error(rw, "unsupported media type", http.StatusUnsupportedMediaType)
+			return
+		}
+		buf, err = io.ReadAll(io.LimitReader(req.Body, dohMaxBodyBytes))
+	default:
+		http.Error(rw, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err != nil || len(buf) == 0 {
+		http.Error(rw, "invalid dns query", http.StatusBadRequest)
+		return
+	}
+
+	r := &dns.Msg{}
+	if err = r.Unpack(buf); err != nil || len(r.Question) == 0 {
+		http.Error(rw, "invalid dns query", http.StatusBadRequest)
+		return
+	}
+
+	w := newDoHResponseWriter(req)
+	s.handler.ServeDNS(w, r)
+
+	var m *dns.Msg
+	select {
+	case m = <-w.msgCh:
+	case <-time.After(dohAnswerTimeout):
+		log.Warning("doh query %s timeout", r.Question[0].Name)
+		m = new(dns.Msg)
+		m.SetRcode(r, dns.RcodeServerFailure)
+	case <-req.Context().Done():
+		return
+	}
+
+	out, err := m.Pack()
+	if err != nil {
+		http.Error(rw, "invalid dns answer", http.StatusInternalServerError)
+		return
+	}
+	rw.Header().Set("Content-Type", dohMediaType)
+	rw.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", minRRTTL(m.Answer)))
+	_, _ = rw.Write(out)
+}
+
+// dohResponseWriter hands the answer written by ServeDNS back to the http handler.
+type dohResponseWriter struct {
+	localAddr  net.Addr
+	remoteAddr net.Addr
+	tlsState   *tls.ConnectionState
+	msgCh      chan *dns.Msg
+}
+
+func newDoHResponseWriter(req *http.Request) *dohResponseWriter {
+	w := &dohResponseWriter{
+		localAddr:  &net.TCPAddr{},
+		remoteAddr: &net.TCPAddr{},
+		tlsState:   req.TLS,
+		msgCh:      make(chan *dns.Msg, 1),
+	}
+	if addr, ok := req.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		w.localAddr = addr
+	}
+	if addr, err := net.ResolveTCPAddr("tcp", req.RemoteAddr); err == nil {
+		w.remoteAddr = addr
+	}
+	return w
+}
+
+func (w *dohResponseWriter) LocalAddr() net.Addr {
+	return w.localAddr
+}
+
+func (w *dohResponseWriter) RemoteAddr() net.Addr {
+	return w.remoteAddr
+}
+
+// ConnectionState implements dns.ConnectionStater.
+func (w *dohResponseWriter) ConnectionState() *tls.ConnectionState {
+	return w.tlsState
+}
+
+func (w *dohResponseWriter) WriteMsg(m *dns.Msg) error {
+	select {
+	case w.msgCh <- m:
+		return nil
+	default:
+		return errors.New("doh answer already written")
+	}
+}
+
+func (w *dohResponseWriter) Write(buf []byte) (int, error) {
+	m := &dns.Msg{}
+	if err := m.Unpack(buf); err != nil {
+		return 0, err
+	}
+	return len(buf), w.WriteMsg(m)
+}
+
+func (w *dohResponseWriter) Close() error {
+	return nil
+}
+
+func (w *dohResponseWriter) TsigStatus() error {
+	return nil
+}
+
+func (w *dohResponseWriter) TsigTimersOnly(bool) {}
+
+func (w *dohResponseWriter) Hijack() {}
@@ -0,0 +1,111 @@
+package dns
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/OpenNHP/opennhp/nhp/log"
+	"github.com/miekg/dns"
+)
+
+// domainRouteTable is the name of the table routing the real domain names of
+// the resources.
+const domainRouteTable = "domains"
+
+// domainOwner is the resource protecting a domain, and the query types
+// synthesized for it. Other types are left to the real zone.
+type domainOwner struct {
+	resId string
+	types map[uint16]bool
+}
+
+func newDomainOwner(resource *Resource) *domainOwner {
+	owner := &domainOwner{
+		resId: strings.ToLower(resource.ResourceId),
+		types: map[uint16]bool{dns.TypeA: true, dns.TypeAAAA: true, dns.TypeTXT: true, dns.TypeANY: true},
+	}
+	if len(resource.Services) > 0 {
+		owner.types[dns.TypeSRV] = true
+	}
+	if resource.HTTPS != nil {
+		owner.types[dns.TypeHTTPS] = true
+		owner.types[dns.TypeSVCB] = true
+	}
+	return owner
+}
+
+type wildcardDomain struct {
+	suffix string
+	labels int
+	owner  *domainOwner
+}
+
+// domainTable protects the domain names declared by the resources. Exact
+// names win over wildcards, and the most specific wildcard wins.
+type domainTable struct {
+	exact map[string]*domainOwner
+	// ordered by specificity, most labels first.
+	wildcards []*wildcardDomain
+}
+
+func newDomainTable(resources []*Resource) *domainTable {
+	table := &domainTable{
+		exact: make(map[string]*domainOwner),
+	}
+	owners := make(map[string]string)
+	for _, resource := range resources {
+		owner := newDomainOwner(resource)
+		for _, domain := range resource.Domains {
+			pattern := normalizeName(strings.TrimSpace(domain))
+			if pattern == "." || pattern == "*." {
+				log.Error("resource [%s] domain %q is invalid, ignored", resource.ResourceId, domain)
+				continue
+			}
+			if resId, found := owners[pattern]; found {
+				log.Error("resource [%s] domain %s is already declared by resource [%s], ignored", resource.ResourceId, domain, resId)
+				continue
+			}
+			owners[pattern] = owner.resId
+
+			if suffix, ok := strings.CutPrefix(pattern, "*."); ok {
+				table.wildcards = append(table.wildcards, &wildcardDomain{
+					suffix: suffix,
+					labels: dns.CountLabel(suffix),
+					owner:  owner,
+				})
+			} else {
+				table.exact[pattern] = owner
+			}
+		}
+	}
+	sort.SliceStable(table.wildcards, func(i, j int) bool {
+		return table.wildcards[i].labels > table.wildcards[j].labels
+	})
+	return table
+}
+
+// Route protects the types synthesized for a protected name, the others
+// like MX or CAA are forwarded to the real zone.
+func (table *domainTable) Route(name string, qtype uint16) *Route {
+	if owner, found := table.exact[name]; found {
+		if !owner.types[qtype] {
+			return nil
+		}
+		return &Route{Action: RouteProtected, ResourceId: owner.resId}
+	}
+	if service, proto, base, ok := splitService(name); ok && qtype == dns.TypeSRV {
+		if owner, found := table.exact[base]; found && owner.types[qtype] {
+			return &Route{Action: RouteProtected, ResourceId: owner.resId, Subdomain: "_" + service + "._" + proto}
+		}
+	}
+	for _, wildcard := range table.wildcards {
+		// a wildcard matches the names below its suffix, not the suffix itself.
+		if subdomain, ok := strings.CutSuffix(name, "."+wildcard.suffix); ok {
+			if !wildcard.owner.types[qtype] {
+				return nil
+			}
+			return &Route{Action: RouteProtected, ResourceId: wildcard.owner.resId, Subdomain: subdomain}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,330 @@
+package dns
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/OpenNHP/opennhp/nhp/log"
+	"github.com/miekg/dns"
+
+	"github.com/OpenNHP/StealthDNS/cert"
+	"github.com/OpenNHP/StealthDNS/common"
+)
+
+var (
+	errDoTConnClosed  = errors.New("dot connection closed")
+	errUpstreamClosed = errors.New("upstream closed")
+)
+
+// dotUpstream is a DNS-over-TLS (RFC 7858) upstream. Queries are pipelined
+// over one persistent tls connection, which is redialed once it is closed.
+type dotUpstream struct {
+	addr      string
+	dialer    *bootstrapDialer
+	tlsConfig *tls.Config
+	timeout   time.Duration
+
+	mu     sync.Mutex
+	conn   *dotConn
+	closed bool
+}
+
+func newDoTUpstream(conf *DoTConfig, resolvers []string, timeout time.Duration) (*dotUpstream, error) {
+	host, port, err := net.SplitHostPort(conf.Server)
+	if err != nil {
+		host, port = conf.Server, "853"
+	}
+	host = trimBrackets(host)
+	if len(host) == 0 {
+		return nil, errors.New("dot server is empty")
+	}
+
+	serverName := conf.ServerName
+	if len(serverName) == 0 {
+		serverName = host
+	}
+	tlsConfig := &tls.Config{
+		ServerName: serverName,
+		MinVersion: tls.VersionTLS12,
+	}
+	if len(conf.CAFile) > 0 {
+		caFile := conf.CAFile
+		if !filepath.IsAbs(caFile) {
+			caFile = filepath.Join(common.ExeDirPath, caFile)
+		}
+		tlsConfig.RootCAs, err = cert.CertPool(caFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(conf.SPKIPins) > 0 {
+		pins := make(map[string]bool)
+		for _, pin := range conf.SPKIPins {
+			pins[pin] = true
+		}
+		tlsConfig.VerifyConnection = func(cs tls.ConnectionState) error {
+			return verifySPKIPins(cs, pins)
+		}
+	}
+
+	return &dotUpstream{
+		addr:      "tls://" + net.JoinHostPort(host, port),
+		dialer:    newBootstrapDialer(host, port, conf.Bootstrap, resolvers, timeout),
+		tlsConfig: tlsConfig,
+		timeout:   timeout,
+	}, nil
+}
+
+// verifySPKIPins accepts the connection if any certificate of the verified
+// chains matches a base64 encoded sha256 digest of its SubjectPublicKeyInfo.
+func verifySPKIPins(cs tls.ConnectionState, pins map[string]bool) error {
+	chains := cs.VerifiedChains
+	if len(chains) == 0 {
+		chains = [][]*x509.Certificate{cs.PeerCertificates}
+	}
+	for _, chain := range chains {
+		for _, c := range chain {
+			digest := sha256.Sum256(c.RawSubjectPublicKeyInfo)
+			if pins[base64.StdEncoding.EncodeToString(digest[:])] {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("no certificate of %s matches the spki pins", cs.ServerName)
+}
+
+func trimBrackets(host string) string {
+	if len(host) > 1 && host[0] == '[' && host[len(host)-1] == ']' {
+		return host[1 : len(host)-1]
+	}
+	return host
+}
+
+func (u *dotUpstream) Address() string {
+	return u.addr
+}
+
+func (u *dotUpstream) Exchange(r *dns.Msg) (*dns.Msg, error) {
+	conn, reused, err := u.getConn()
+	if err != nil {
+		return nil, err
+	}
+	resp, err := conn.exchange(r, u.timeout)
+	if errors.Is(err, errDoTConnClosed) && reused {
+		// the server closed the idle connection, retry once on a new one.
+		conn, _, err = u.getConn()
+		if err != nil {
+			return nil, err
+		}
+		resp, err = conn.exchange(r, u.timeout)
+	}
+	return resp, err
+}
+
+func (u *dotUpstream) getConn() (*dotConn, bool, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.closed {
+		return nil, false, errUpstreamClosed
+	}
+	if u.conn != nil && !u.conn.isClosed() {
+		return u.conn, true, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), u.timeout)
+	defer cancel()
+	rawConn, err := u.dialer.DialContext(ctx, "tcp", "")
+	if err != nil {
+		return nil, false, err
+	}
+	tlsConn := tls.Client(rawConn, u.tlsConfig)
+	_ = tlsConn.SetDeadline(time.Now().Add(u.timeout))
+	if err = tlsConn.Handshake(); err != nil {
+		_ = rawConn.Close()
+		return nil, false, err
+	}
+	_ = tlsConn.SetDeadline(time.Time{})
+
+	u.conn = newDoTConn(tlsConn)
+	log.Debug("dot connection to %s established", u.addr)
+	return u.conn, false, nil
+}
+
+// Close closes the connection of the upstream, which is not redialed.
+func (u *dotUpstream) Close() error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.closed = true
+	if u.conn != nil {
+		u.conn.close()
+		u.conn = nil
+	}
+	return nil
+}
+
+// dotQuery is a query waiting for its answer.
+type dotQuery struct {
+	question []dns.Question
+	ch       chan *dns.Msg
+}
+
+// dotMaxTimeouts is the number of queries in a row left unanswered after
+// which a connection is considered dead and closed to be redialed.
+const dotMaxTimeouts = 3
+
+// dotConn multiplexes queries over a tls connection by message id.
+type dotConn struct {
+	conn    *dns.Conn
+	writeMu sync.Mutex
+
+	mu       sync.Mutex
+	pending  map[uint16]*dotQuery
+	closed   bool
+	timeouts int
+}
+
+func newDoTConn(conn net.Conn) *dotConn {
+	c := &dotConn{
+		conn:    &dns.Conn{Conn: conn},
+		pending: make(map[uint16]*dotQuery),
+	}
+	go c.readLoop()
+	return c
+}
+
+func (c *dotConn) isClosed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.closed
+}
+
+func (c *dotConn) readLoop() {
+	for {
+		m, err := c.conn.ReadMsg()
+		if err != nil {
+			c.close()
+			return
+		}
+		c.mu.Lock()
+		query, found := c.pending[m.Id]
+		if found && !sameQuestion(m.Question, query.question) {
+			// a late answer to a query that timed out and whose id was reused.
+			log.Debug("dot answer %d of %v does not match the query, dropped", m.Id, m.Question)
+			found = false
+		}
+		if found {
+			delete(c.pending, m.Id)
+			c.timeouts = 0
+		}
+		c.mu.Unlock()
+		if found {
+			query.ch <- m
+		}
+	}
+}
+
+func (c *dotConn) close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return
+	}
+	c.closed = true
+	_ = c.conn.Close()
+	for id, query := range c.pending {
+		close(query.ch)
+		delete(c.pending, id)
+	}
+}
+
+// register allocates an unused message id for a query of question, clients
+// may send colliding ids.
+func (c *dotConn) register(question []dns.Question) (uint16, chan *dns.Msg, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return 0, nil, errDoTConnClosed
+	}
+	if len(c.pending) >= 0xffff {
+		return 0, nil, errors.New("too many pending dot queries")
+	}
+	id := uint16(rand.UintN(0x10000))
+	for {
+		if _, found := c.pending[id]; !found {
+			break
+		}
+		id++
+	}
+	ch := make(chan *dns.Msg, 1)
+	c.pending[id] = &dotQuery{question: question, ch: ch}
+	return id, ch, nil
+}
+
+// timeout unregisters the query id which was not answered in time and reports
+// whether the connection stopped answering.
+func (c *dotConn) timeout(id uint16) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.pending, id)
+	c.timeouts++
+	return c.timeouts >= dotMaxTimeouts
+}
+
+func (c *dotConn) exchange(r *dns.Msg, timeout time.Duration) (*dns.Msg, error) {
+	id, ch, err := c.register(r.Question)
+	if err != nil {
+		return nil, err
+	}
+	msg := r.Copy()
+	msg.Id = id
+	padMsg(msg, queryPaddingBlock)
+
+	c.writeMu.Lock()
+	_ = c.conn.SetWriteDeadline(time.Now().Add(timeout))
+	err = c.conn.WriteMsg(msg)
+	c.writeMu.Unlock()
+	if err != nil {
+		c.close()
+		return nil, errDoTConnClosed
+	}
+
+	select {
+	case resp, ok := <-ch:
+		if !ok {
+			return nil, errDoTConnClosed
+		}
+		resp.Id = r.Id
+		return resp, nil
+	case <-time.After(timeout):
+		if c.timeout(id) {
+			log.Warning("dot connection stopped answering, closed")
+			c.close()
+		}
+		return nil, fmt.Errorf("dot query timeout after %s", timeout)
+	}
+}
+
+// sameQuestion compares questions, names case-insensitively as servers may
+// not preserve their case.
+func sameQuestion(a, b []dns.Question) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Qtype != b[i].Qtype || a[i].Qclass != b[i].Qclass || !strings.EqualFold(a[i].Name, b[i].Name) {
+			return false
+		}
+	}
+	return true
+}
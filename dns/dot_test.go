@@ -0,0 +1,158 @@
+package dns
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// pipeDoTConn returns a dotConn and the server end of its connection.
+func pipeDoTConn(t *testing.T) (*dotConn, *dns.Conn) {
+	client, server := net.Pipe()
+	c := newDoTConn(client)
+	t.Cleanup(c.close)
+	return c, &dns.Conn{Conn: server}
+}
+
+func TestDoTConnMatchesQuestion(t *testing.T) {
+	c, server := pipeDoTConn(t)
+	go func() {
+		q, err := server.ReadMsg()
+		if err != nil {
+			return
+		}
+		// a late answer to another question with the same id comes first.
+		stale := new(dns.Msg)
+		stale.SetQuestion("other.example.", dns.TypeA)
+		stale.Id = q.Id
+		stale.Response = true
+		_ = server.WriteMsg(stale)
+
+		m := new(dns.Msg)
+		m.SetReply(q)
+		m.Question[0].Name = "WWW.Example.COM."
+		_ = server.WriteMsg(m)
+	}()
+
+	r := testQuery("www.example.com.", dns.TypeA)
+	r.Id = 1234
+	resp, err := c.exchange(r, time.Second)
+	if err != nil {
+		t.Fatalf("exchange() error = %v", err)
+	}
+	if resp.Question[0].Name != "WWW.Example.COM." || resp.Id != r.Id {
+		t.Errorf("exchange() = %v, want the answer of %v", resp, r.Question)
+	}
+}
+
+func TestDoTConnTimeout(t *testing.T) {
+	c, server := pipeDoTConn(t)
+	queries := make(chan *dns.Msg, 2)
+	go func() {
+		for {
+			q, err := server.ReadMsg()
+			if err != nil {
+				return
+			}
+			queries <- q
+		}
+	}()
+
+	if _, err := c.exchange(testQuery("slow.example.", dns.TypeA), 50*time.Millisecond); err == nil {
+		t.Fatalf("exchange() without answer succeeded")
+	}
+	slow := <-queries
+
+	done := make(chan *dns.Msg)
+	go func() {
+		resp, _ := c.exchange(testQuery("fast.example.", dns.TypeA), time.Second)
+		done <- resp
+	}()
+	fast := <-queries
+	for _, q := range []*dns.Msg{slow, fast} {
+		m := new(dns.Msg)
+		m.SetReply(q)
+		// the late answer may carry the id reused by the next query.
+		m.Id = fast.Id
+		_ = server.WriteMsg(m)
+	}
+	if resp := <-done; resp == nil || resp.Question[0].Name != "fast.example." {
+		t.Errorf("exchange() = %v, want the answer of fast.example.", resp)
+	}
+}
+
+func TestDoTUpstreamRedialsDeadConn(t *testing.T) {
+	// borrow the certificate of a test https server for the dot server.
+	ts := httptest.NewTLSServer(http.NotFoundHandler())
+	defer ts.Close()
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", ts.TLS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for accepted := 0; ; accepted++ {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn *dns.Conn, answer bool) {
+				defer conn.Close()
+				for {
+					q, err := conn.ReadMsg()
+					if err != nil {
+						return
+					}
+					if !answer {
+						// the first connection stays open but stops answering.
+						continue
+					}
+					m := new(dns.Msg)
+					m.SetReply(q)
+					_ = conn.WriteMsg(m)
+				}
+			}(&dns.Conn{Conn: conn}, accepted > 0)
+		}
+	}()
+
+	u, err := newDoTUpstream(&DoTConfig{Server: ln.Addr().String(), ServerName: "example.com"}, nil, 200*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer u.Close()
+	u.tlsConfig.RootCAs = ts.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs
+
+	for i := 0; i < dotMaxTimeouts; i++ {
+		if _, err := u.Exchange(testQuery("example.com.", dns.TypeA)); err == nil {
+			t.Fatalf("Exchange() %d on the dead connection succeeded", i)
+		}
+	}
+	resp, err := u.Exchange(testQuery("example.com.", dns.TypeA))
+	if err != nil || resp.Question[0].Name != "example.com." {
+		t.Errorf("Exchange() after %d timeouts = %v, %v, want an answer on a new connection", dotMaxTimeouts, resp, err)
+	}
+}
+
+func TestDoTUpstreamClose(t *testing.T) {
+	u, err := newDoTUpstream(&DoTConfig{Server: "127.0.0.1:853"}, nil, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, _ := pipeDoTConn(t)
+	u.conn = c
+	if err := u.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if !c.isClosed() {
+		t.Errorf("connection is open after Close()")
+	}
+	if _, err := u.Exchange(testQuery("example.com.", dns.TypeA)); !errors.Is(err, errUpstreamClosed) {
+		t.Errorf("Exchange() after Close() error = %v, want %v", err, errUpstreamClosed)
+	}
+}
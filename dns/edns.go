@@ -0,0 +1,298 @@
+package dns
+
+import (
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/OpenNHP/opennhp/nhp/log"
+	"github.com/miekg/dns"
+)
+
+// client subnet modes of forwarded queries.
+const (
+	ClientSubnetStrip = "strip"
+	ClientSubnetKeep  = "keep"
+)
+
+const (
+	// defaultEDNSUDPSize is the udp payload size advertised to clients and
+	// upstreams, which avoids ip fragmentation (DNS flag day 2020).
+	defaultEDNSUDPSize = 1232
+
+	// padding block sizes recommended by RFC 8467.
+	queryPaddingBlock    = 128
+	responsePaddingBlock = 468
+
+	// prefix lengths of a client subnet configured as a bare address (RFC 7871 section 11.1).
+	defaultSubnetIPv4Bits = 24
+	defaultSubnetIPv6Bits = 56
+)
+
+// ednsPolicy is an EDNSConfig with its defaults applied.
+type ednsPolicy struct {
+	udpSize uint16
+	// clientSubnet is ClientSubnetStrip, ClientSubnetKeep, or empty to send subnet instead.
+	clientSubnet string
+	subnet       *dns.EDNS0_SUBNET
+	padding      bool
+}
+
+func newEDNSPolicy(conf *EDNSConfig) *ednsPolicy {
+	policy := &ednsPolicy{
+		udpSize:      conf.UDPSize,
+		clientSubnet: ClientSubnetStrip,
+		padding:      !conf.DisablePadding,
+	}
+	if policy.udpSize < dns.MinMsgSize {
+		if policy.udpSize != 0 {
+			log.Error("edns udp size %d is below %d, using %d", conf.UDPSize, dns.MinMsgSize, defaultEDNSUDPSize)
+		}
+		policy.udpSize = defaultEDNSUDPSize
+	}
+
+	switch subnet := strings.ToLower(strings.TrimSpace(conf.ClientSubnet)); subnet {
+	case "", ClientSubnetStrip:
+	case ClientSubnetKeep:
+		policy.clientSubnet = ClientSubnetKeep
+	default:
+		if ecs := parseClientSubnet(subnet); ecs != nil {
+			policy.clientSubnet, policy.subnet = "", ecs
+		} else {
+			log.Error("invalid edns client subnet %q, stripping client subnets", conf.ClientSubnet)
+		}
+	}
+	return policy
+}
+
+// parseClientSubnet parses an address or a network into a client subnet
+// option, or returns nil.
+func parseClientSubnet(subnet string) *dns.EDNS0_SUBNET {
+	if !strings.Contains(subnet, "/") {
+		ip := net.ParseIP(subnet)
+		if ip == nil {
+			return nil
+		}
+		if ip.To4() != nil {
+			subnet = ip.String() + "/" + strconv.Itoa(defaultSubnetIPv4Bits)
+		} else {
+			subnet = ip.String() + "/" + strconv.Itoa(defaultSubnetIPv6Bits)
+		}
+	}
+	_, network, err := net.ParseCIDR(subnet)
+	if err != nil {
+		return nil
+	}
+	bits, _ := network.Mask.Size()
+	ecs := &dns.EDNS0_SUBNET{
+		Code:          dns.EDNS0SUBNET,
+		SourceNetmask: uint8(bits),
+	}
+	if ip4 := network.IP.To4(); ip4 != nil {
+		ecs.Family, ecs.Address = 1, ip4
+	} else {
+		ecs.Family, ecs.Address = 2, network.IP
+	}
+	return ecs
+}
+
+// upstreamQuery prepares a copy of r to be forwarded upstream. The EDNS0
+// options are hop-by-hop and dropped, except the client subnet, which is
+// stripped, kept or replaced. An empty padding option asks encrypted
+// upstreams to pad the query, plain ones drop it.
+func (policy *ednsPolicy) upstreamQuery(r *dns.Msg) *dns.Msg {
+	m := r.Copy()
+	do := false
+	var clientSubnet *dns.EDNS0_SUBNET
+	if opt := m.IsEdns0(); opt != nil {
+		do = opt.Do()
+		for _, option := range opt.Option {
+			if ecs, ok := option.(*dns.EDNS0_SUBNET); ok {
+				clientSubnet = ecs
+			}
+		}
+		m.Extra = removeOPT(m.Extra)
+	}
+	m.SetEdns0(policy.udpSize, do)
+	opt := m.IsEdns0()
+
+	if subnet := policy.forwardedSubnet(clientSubnet); subnet != nil {
+		opt.Option = append(opt.Option, subnet)
+	}
+	if policy.padding {
+		opt.Option = append(opt.Option, &dns.EDNS0_PADDING{})
+	}
+	return m
+}
+
+// forwardedSubnet returns the client subnet option forwarded upstream for
+// the client subnet option of a query, if any.
+func (policy *ednsPolicy) forwardedSubnet(clientSubnet *dns.EDNS0_SUBNET) *dns.EDNS0_SUBNET {
+	switch {
+	case clientSubnet != nil && clientSubnet.SourceNetmask == 0:
+		// the client opted out of client subnets, RFC 7871 section 7.1.2.
+		return clientSubnet
+	case policy.clientSubnet == ClientSubnetKeep:
+		return clientSubnet
+	case policy.subnet != nil:
+		subnet := *policy.subnet
+		return &subnet
+	}
+	return nil
+}
+
+// cacheSubnet returns the client subnet forwarded upstream for r when it
+// depends on the client, as answers tailored to it must not be shared with
+// other clients. The configured subnet is the same for all clients.
+func (policy *ednsPolicy) cacheSubnet(r *dns.Msg) string {
+	opt := r.IsEdns0()
+	if opt == nil {
+		return ""
+	}
+	var clientSubnet *dns.EDNS0_SUBNET
+	for _, option := range opt.Option {
+		if ecs, ok := option.(*dns.EDNS0_SUBNET); ok {
+			clientSubnet = ecs
+		}
+	}
+	subnet := policy.forwardedSubnet(clientSubnet)
+	if subnet == nil || subnet != clientSubnet {
+		return ""
+	}
+	bits := 8 * net.IPv4len
+	if subnet.Family == 2 {
+		bits = 8 * net.IPv6len
+	}
+	mask := net.CIDRMask(int(subnet.SourceNetmask), bits)
+	if mask == nil {
+		return ""
+	}
+	network := &net.IPNet{IP: subnet.Address.Mask(mask), Mask: mask}
+	return network.String()
+}
+
+// reply fixes the OPT record of a reply m to r: none if r has none,
+// otherwise ours, carrying the extended errors of m, the client subnet and
+// the padding if r asked for it.
+func (policy *ednsPolicy) reply(r *dns.Msg, m *dns.Msg, encrypted bool) *dns.Msg {
+	reqOpt := r.IsEdns0()
+	respOpt := m.IsEdns0()
+	if reqOpt == nil {
+		if respOpt != nil {
+			m = m.Copy()
+			m.Extra = removeOPT(m.Extra)
+		}
+		return m
+	}
+
+	m = m.Copy()
+	m.Extra = removeOPT(m.Extra)
+	m.SetEdns0(policy.udpSize, reqOpt.Do())
+	opt := m.IsEdns0()
+	var respSubnet *dns.EDNS0_SUBNET
+	if respOpt != nil {
+		for _, option := range respOpt.Option {
+			switch o := option.(type) {
+			case *dns.EDNS0_EDE:
+				opt.Option = append(opt.Option, o)
+			case *dns.EDNS0_SUBNET:
+				respSubnet = o
+			}
+		}
+	}
+	padded := false
+	for _, option := range reqOpt.Option {
+		switch o := option.(type) {
+		case *dns.EDNS0_SUBNET:
+			if policy.clientSubnet == ClientSubnetKeep && respSubnet != nil {
+				opt.Option = append(opt.Option, respSubnet)
+			} else {
+				// the answer is not tailored to the client subnet, scope 0.
+				echo := *o
+				echo.SourceScope = 0
+				opt.Option = append(opt.Option, &echo)
+			}
+		case *dns.EDNS0_PADDING:
+			padded = true
+		}
+	}
+	if padded && encrypted {
+		opt.Option = append(opt.Option, &dns.EDNS0_PADDING{})
+	}
+	return m
+}
+
+// padMsg fills the padding option of m, if any, so m packs to a multiple of
+// block bytes (RFC 7830).
+func padMsg(m *dns.Msg, block int) {
+	opt := m.IsEdns0()
+	if opt == nil {
+		return
+	}
+	var padding *dns.EDNS0_PADDING
+	for _, option := range opt.Option {
+		if o, ok := option.(*dns.EDNS0_PADDING); ok {
+			padding = o
+		}
+	}
+	if padding == nil {
+		return
+	}
+	padding.Padding = nil
+	if rem := m.Len() % block; rem != 0 {
+		padding.Padding = make([]byte, block-rem)
+	}
+}
+
+// hasPadding reports whether m carries a padding option.
+func hasPadding(m *dns.Msg) bool {
+	if opt := m.IsEdns0(); opt != nil {
+		for _, option := range opt.Option {
+			if _, ok := option.(*dns.EDNS0_PADDING); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// withoutPadding returns m, or a copy of m without its padding options.
+func withoutPadding(m *dns.Msg) *dns.Msg {
+	if !hasPadding(m) {
+		return m
+	}
+	m = m.Copy()
+	opt := m.IsEdns0()
+	options := opt.Option[:0]
+	for _, option := range opt.Option {
+		if _, ok := option.(*dns.EDNS0_PADDING); !ok {
+			options = append(options, option)
+		}
+	}
+	opt.Option = options
+	return m
+}
+
+// isEncrypted reports whether the client of w is connected over tls.
+func isEncrypted(w dns.ResponseWriter) bool {
+	stater, ok := w.(dns.ConnectionStater)
+	return ok && stater.ConnectionState() != nil
+}
+
+func removeOPT(rrs []dns.RR) []dns.RR {
+	result := make([]dns.RR, 0, len(rrs))
+	for _, rr := range rrs {
+		if rr.Header().Rrtype != dns.TypeOPT {
+			result = append(result, rr)
+		}
+	}
+	return result
+}
+
+// badVersion answers queries of an unsupported EDNS version with BADVERS
+// and our version 0 (RFC 6891 section 6.1.3).
+func (p *ProxyService) badVersion(w dns.ResponseWriter, r *dns.Msg) {
+	m := new(dns.Msg)
+	m.SetRcode(r, dns.RcodeBadVers)
+	p.writeMsg(w, r, m)
+}
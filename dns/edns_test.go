@@ -0,0 +1,357 @@
+package dns
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// funcUpstream answers queries with a function.
+type funcUpstream struct {
+	answer func(r *dns.Msg) (*dns.Msg, error)
+	calls  atomic.Int32
+}
+
+func (u *funcUpstream) Address() string {
+	return "func"
+}
+
+func (u *funcUpstream) Exchange(r *dns.Msg) (*dns.Msg, error) {
+	u.calls.Add(1)
+	return u.answer(r)
+}
+
+// tlsRecordWriter is a client connection over tls recording the answer.
+type tlsRecordWriter struct {
+	*recordWriter
+}
+
+func (w tlsRecordWriter) ConnectionState() *tls.ConnectionState {
+	return &tls.ConnectionState{}
+}
+
+// ednsQuery is a query with the DNSSEC OK bit and options.
+func ednsQuery(name string, qtype uint16, options ...dns.EDNS0) *dns.Msg {
+	r := testQuery(name, qtype)
+	r.SetEdns0(4096, true)
+	opt := r.IsEdns0()
+	opt.Option = append(opt.Option, options...)
+	return r
+}
+
+func subnetOption(subnet string) *dns.EDNS0_SUBNET {
+	return parseClientSubnet(subnet)
+}
+
+func msgSubnet(m *dns.Msg) string {
+	if opt := m.IsEdns0(); opt != nil {
+		for _, option := range opt.Option {
+			if ecs, ok := option.(*dns.EDNS0_SUBNET); ok {
+				return fmt.Sprintf("%s/%d/%d", ecs.Address, ecs.SourceNetmask, ecs.SourceScope)
+			}
+		}
+	}
+	return ""
+}
+
+func TestEDNSUpstreamQuery(t *testing.T) {
+	tests := []struct {
+		name   string
+		subnet string
+		client string
+		want   string
+	}{
+		{name: "strip without subnet"},
+		{name: "strip", client: "203.0.113.0/24"},
+		// an opt-out is forwarded whatever the mode, RFC 7871 section 7.1.2.
+		{name: "strip opt-out", client: "0.0.0.0/0", want: "0.0.0.0/0/0"},
+		{name: "keep", subnet: "keep", client: "203.0.113.0/24", want: "203.0.113.0/24/0"},
+		{name: "keep without subnet", subnet: "Keep"},
+		{name: "keep opt-out", subnet: "keep", client: "::/0", want: "::/0/0"},
+		{name: "replace address", subnet: "198.51.100.7", client: "203.0.113.0/24", want: "198.51.100.0/24/0"},
+		{name: "replace v6 address", subnet: "2001:db8::1", want: "2001:db8::/56/0"},
+		{name: "replace network", subnet: "10.0.0.0/8", want: "10.0.0.0/8/0"},
+		{name: "replace opt-out", subnet: "10.0.0.0/8", client: "0.0.0.0/0", want: "0.0.0.0/0/0"},
+		{name: "invalid subnet strips", subnet: "bogus", client: "203.0.113.0/24"},
+	}
+	for _, tt := range tests {
+		for _, padding := range []bool{true, false} {
+			policy := newEDNSPolicy(&EDNSConfig{ClientSubnet: tt.subnet, DisablePadding: !padding})
+			options := []dns.EDNS0{&dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: "0123456789abcdef"}}
+			if len(tt.client) > 0 {
+				options = append(options, subnetOption(tt.client))
+			}
+			r := ednsQuery("www.example.com.", dns.TypeA, options...)
+			m := policy.upstreamQuery(r)
+
+			opt := m.IsEdns0()
+			if opt == nil || opt.UDPSize() != defaultEDNSUDPSize || !opt.Do() {
+				t.Errorf("%s: OPT %v", tt.name, opt)
+				continue
+			}
+			if subnet := msgSubnet(m); subnet != tt.want {
+				t.Errorf("%s: forwarded subnet %q, want %q", tt.name, subnet, tt.want)
+			}
+			// the cookie is hop-by-hop.
+			want := 0
+			if len(tt.want) > 0 {
+				want++
+			}
+			if padding {
+				want++
+			}
+			if len(opt.Option) != want || hasPadding(m) != padding {
+				t.Errorf("%s: forwarded options %v", tt.name, opt.Option)
+			}
+		}
+	}
+
+	r := testQuery("www.example.com.", dns.TypeA)
+	m := newEDNSPolicy(&EDNSConfig{UDPSize: 100}).upstreamQuery(r)
+	if opt := m.IsEdns0(); opt == nil || opt.UDPSize() != defaultEDNSUDPSize || opt.Do() {
+		t.Errorf("query without OPT forwarded with %v", opt)
+	}
+	if r.IsEdns0() != nil {
+		t.Error("query of the client is changed")
+	}
+}
+
+func TestEDNSCacheSubnet(t *testing.T) {
+	tests := []struct {
+		subnet string
+		client string
+		want   string
+	}{
+		{subnet: "keep", client: "203.0.113.9/24", want: "203.0.113.0/24"},
+		{subnet: "keep", client: "2001:db8:1:2::/64", want: "2001:db8:1:2::/64"},
+		{subnet: "keep", client: "0.0.0.0/0", want: "0.0.0.0/0"},
+		{subnet: "keep"},
+		{subnet: "strip", client: "203.0.113.9/24"},
+		{subnet: "strip", client: "0.0.0.0/0", want: "0.0.0.0/0"},
+		// the configured subnet is the same for all clients.
+		{subnet: "198.51.100.0/24", client: "203.0.113.9/24"},
+		{subnet: "198.51.100.0/24"},
+	}
+	for _, tt := range tests {
+		policy := newEDNSPolicy(&EDNSConfig{ClientSubnet: tt.subnet})
+		var options []dns.EDNS0
+		if len(tt.client) > 0 {
+			ecs := subnetOption(tt.client)
+			// the address bits beyond the prefix are not part of the key.
+			ecs.Address = net.ParseIP(strings.Split(tt.client, "/")[0])
+			options = append(options, ecs)
+		}
+		if subnet := policy.cacheSubnet(ednsQuery("www.example.com.", dns.TypeA, options...)); subnet != tt.want {
+			t.Errorf("%s of client %s: cache subnet %q, want %q", tt.subnet, tt.client, subnet, tt.want)
+		}
+	}
+}
+
+func TestEDNSForwardCacheSubnet(t *testing.T) {
+	// the upstream answers the address of the client subnet.
+	upstream := &funcUpstream{answer: func(r *dns.Msg) (*dns.Msg, error) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		address := "192.0.2.1"
+		for _, option := range r.IsEdns0().Option {
+			if ecs, ok := option.(*dns.EDNS0_SUBNET); ok && ecs.SourceNetmask > 0 {
+				address = ecs.Address.String()
+			}
+		}
+		rr, _ := dns.NewRR(r.Question[0].Name + " 300 IN A " + address)
+		m.Answer = append(m.Answer, rr)
+		return m, nil
+	}}
+	p := testCacheProxy()
+	p.edns.Store(newEDNSPolicy(&EDNSConfig{ClientSubnet: ClientSubnetKeep}))
+	p.upstreams.Store(&upstreamRouter{
+		defaultPool: NewUpstreamPool("", []Upstream{upstream}),
+		groups:      make(map[string]*UpstreamPool),
+	})
+
+	tests := []struct {
+		client string
+		answer string
+		calls  int32
+	}{
+		{client: "203.0.113.0/24", answer: "203.0.113.0", calls: 1},
+		{client: "198.51.100.0/24", answer: "198.51.100.0", calls: 2},
+		{client: "203.0.113.0/24", answer: "203.0.113.0", calls: 2},
+		{answer: "192.0.2.1", calls: 3},
+		{client: "198.51.100.0/24", answer: "198.51.100.0", calls: 3},
+	}
+	for i, tt := range tests {
+		var options []dns.EDNS0
+		if len(tt.client) > 0 {
+			options = append(options, subnetOption(tt.client))
+		}
+		w := newRecordWriter("127.0.0.1")
+		p.forwardUpstreamDNS(w, ednsQuery("www.example.com.", dns.TypeA, options...), "")
+		if len(w.msg.Answer) != 1 || w.msg.Answer[0].(*dns.A).A.String() != tt.answer {
+			t.Errorf("#%d from %s: answer %v, want %s", i, tt.client, w.msg.Answer, tt.answer)
+		}
+		if calls := upstream.calls.Load(); calls != tt.calls {
+			t.Errorf("#%d from %s: %d upstream queries, want %d", i, tt.client, calls, tt.calls)
+		}
+	}
+}
+
+func TestEDNSReply(t *testing.T) {
+	response := func(r *dns.Msg, options ...dns.EDNS0) *dns.Msg {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		m.SetEdns0(512, false)
+		opt := m.IsEdns0()
+		opt.Option = append(opt.Option, options...)
+		return m
+	}
+	blocked := &dns.EDNS0_EDE{InfoCode: dns.ExtendedErrorCodeBlocked}
+	scoped := subnetOption("203.0.113.0/24")
+	scoped.SourceScope = 16
+
+	// no OPT in the reply to a query without one.
+	r := testQuery("www.example.com.", dns.TypeA)
+	w := newRecordWriter("127.0.0.1")
+	p := &ProxyService{}
+	p.edns.Store(newEDNSPolicy(&EDNSConfig{}))
+	p.writeMsg(w, r, response(r, blocked))
+	if w.msg.IsEdns0() != nil {
+		t.Errorf("reply without OPT query has %v", w.msg.IsEdns0())
+	}
+
+	tests := []struct {
+		name      string
+		subnet    string
+		options   []dns.EDNS0
+		encrypted bool
+		reply     []dns.EDNS0
+		want      string
+		padding   bool
+	}{
+		{name: "extended error", reply: []dns.EDNS0{blocked}},
+		{
+			// the answer is not tailored to the stripped subnet.
+			name:    "strip echoes scope 0",
+			options: []dns.EDNS0{subnetOption("203.0.113.0/24")},
+			reply:   []dns.EDNS0{scoped},
+			want:    "203.0.113.0/24/0",
+		},
+		{
+			name:    "keep echoes the upstream scope",
+			subnet:  ClientSubnetKeep,
+			options: []dns.EDNS0{subnetOption("203.0.113.0/24")},
+			reply:   []dns.EDNS0{scoped},
+			want:    "203.0.113.0/24/16",
+		},
+		{
+			name:    "keep without an upstream subnet",
+			subnet:  ClientSubnetKeep,
+			options: []dns.EDNS0{subnetOption("203.0.113.0/24")},
+			want:    "203.0.113.0/24/0",
+		},
+		{name: "no subnet asked", reply: []dns.EDNS0{scoped}},
+		{name: "padding over udp", options: []dns.EDNS0{&dns.EDNS0_PADDING{}}},
+		{name: "padding over tls", options: []dns.EDNS0{&dns.EDNS0_PADDING{}}, encrypted: true, padding: true},
+		{name: "no padding asked", encrypted: true, reply: []dns.EDNS0{&dns.EDNS0_PADDING{Padding: make([]byte, 10)}}},
+	}
+	for _, tt := range tests {
+		p.edns.Store(newEDNSPolicy(&EDNSConfig{ClientSubnet: tt.subnet}))
+		r := ednsQuery("www.example.com.", dns.TypeA, tt.options...)
+		rw := newRecordWriter("127.0.0.1")
+		var w dns.ResponseWriter = rw
+		if tt.encrypted {
+			w = tlsRecordWriter{rw}
+		}
+		resp := response(r, tt.reply...)
+		p.writeMsg(w, r, resp)
+
+		m := rw.msg
+		opt := m.IsEdns0()
+		if opt == nil || opt.UDPSize() != defaultEDNSUDPSize || !opt.Do() || opt.Version() != 0 {
+			t.Errorf("%s: OPT %v", tt.name, opt)
+			continue
+		}
+		if subnet := msgSubnet(m); subnet != tt.want {
+			t.Errorf("%s: subnet %q, want %q", tt.name, subnet, tt.want)
+		}
+		var ede *dns.EDNS0_EDE
+		for _, option := range opt.Option {
+			if o, ok := option.(*dns.EDNS0_EDE); ok {
+				ede = o
+			}
+		}
+		if hasEDE := len(tt.reply) > 0 && tt.reply[0] == blocked; (ede != nil) != hasEDE {
+			t.Errorf("%s: extended error %v", tt.name, ede)
+		}
+		if hasPadding(m) != tt.padding {
+			t.Errorf("%s: padding %t, want %t", tt.name, hasPadding(m), tt.padding)
+		}
+		if resp.IsEdns0().UDPSize() != 512 {
+			t.Errorf("%s: upstream response is changed", tt.name)
+		}
+	}
+}
+
+func TestPadMsg(t *testing.T) {
+	for _, block := range []int{queryPaddingBlock, responsePaddingBlock} {
+		for records := 0; records < 40; records += 3 {
+			m := testQuery("www.example.com.", dns.TypeA)
+			m.Compress = true
+			for i := 0; i < records; i++ {
+				rr, _ := dns.NewRR(fmt.Sprintf("www.example.com. 300 IN A 192.0.2.%d", i))
+				m.Answer = append(m.Answer, rr)
+			}
+			m.SetEdns0(defaultEDNSUDPSize, false)
+			opt := m.IsEdns0()
+			opt.Option = append(opt.Option, &dns.EDNS0_PADDING{Padding: make([]byte, 7)})
+			padMsg(m, block)
+			buf, err := m.Pack()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(buf)%block != 0 {
+				t.Errorf("%d records padded to %d bytes, want a multiple of %d", records, len(buf), block)
+			}
+			if withoutPadding(m) == m || hasPadding(withoutPadding(m)) || !hasPadding(m) {
+				t.Errorf("%d records: padding is not removed from a copy", records)
+			}
+		}
+	}
+
+	// without a padding option, nothing is added.
+	m := testQuery("www.example.com.", dns.TypeA)
+	m.SetEdns0(defaultEDNSUDPSize, false)
+	size := m.Len()
+	padMsg(m, responsePaddingBlock)
+	if m.Len() != size || hasPadding(m) || withoutPadding(m) != m {
+		t.Error("message without padding option is padded")
+	}
+}
+
+func TestEDNSBadVersion(t *testing.T) {
+	p := &ProxyService{}
+	p.edns.Store(newEDNSPolicy(&EDNSConfig{}))
+	r := ednsQuery("www.example.com.", dns.TypeA)
+	r.IsEdns0().SetVersion(1)
+	w := newRecordWriter("127.0.0.1")
+	p.badVersion(w, r)
+
+	// the extended rcode is carried by the OPT record.
+	buf, err := w.msg.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := new(dns.Msg)
+	if err := m.Unpack(buf); err != nil {
+		t.Fatal(err)
+	}
+	opt := m.IsEdns0()
+	if m.Rcode != dns.RcodeBadVers || opt == nil || opt.Version() != 0 || m.Id != r.Id || len(m.Answer) > 0 {
+		t.Errorf("answer to version 1: rcode %s, OPT %v", dns.RcodeToString[m.Rcode], opt)
+	}
+}
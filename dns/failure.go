@@ -0,0 +1,173 @@
+package dns
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	com "github.com/OpenNHP/opennhp/nhp/common"
+	"github.com/OpenNHP/opennhp/nhp/log"
+	"github.com/miekg/dns"
+)
+
+// failure responses to a query for a resource whose knock failed.
+const (
+	FailureNXDomain = "nxdomain"
+	FailureServFail = "servfail"
+	FailureRefused  = "refused"
+	FailureNoData   = "nodata"
+	FailureSinkhole = "sinkhole"
+)
+
+const (
+	defaultFailureTTL = 10
+)
+
+var (
+	errUnknownResource = errors.New("unknown nhp resource")
+
+	defaultSinkholeIPv4 = net.IPv4zero
+	defaultSinkholeIPv6 = net.IPv6unspecified
+)
+
+// failurePolicy is a FailureConfig with its defaults applied.
+type failurePolicy struct {
+	response     string
+	ttl          uint32
+	sinkholeIPv4 net.IP
+	sinkholeIPv6 net.IP
+}
+
+func newFailurePolicy(conf *FailureConfig) *failurePolicy {
+	policy := &failurePolicy{
+		response:     parseFailureResponse(conf.Response, FailureNXDomain),
+		ttl:          conf.TTL,
+		sinkholeIPv4: defaultSinkholeIPv4,
+		sinkholeIPv6: defaultSinkholeIPv6,
+	}
+	if policy.ttl == 0 {
+		policy.ttl = defaultFailureTTL
+	}
+	if len(conf.SinkholeIPv4) > 0 {
+		if ip := net.ParseIP(conf.SinkholeIPv4).To4(); ip != nil {
+			policy.sinkholeIPv4 = ip
+		} else {
+			log.Error("invalid sinkhole ipv4 address %s, using %s", conf.SinkholeIPv4, defaultSinkholeIPv4)
+		}
+	}
+	if len(conf.SinkholeIPv6) > 0 {
+		if ip := net.ParseIP(conf.SinkholeIPv6); ip != nil && ip.To4() == nil {
+			policy.sinkholeIPv6 = ip
+		} else {
+			log.Error("invalid sinkhole ipv6 address %s, using %s", conf.SinkholeIPv6, defaultSinkholeIPv6)
+		}
+	}
+	return policy
+}
+
+func parseFailureResponse(response string, fallback string) string {
+	response = strings.ToLower(strings.TrimSpace(response))
+	switch response {
+	case "":
+		return fallback
+	case FailureNXDomain, FailureServFail, FailureRefused, FailureNoData, FailureSinkhole:
+		return response
+	default:
+		log.Error("unknown failure response %q, using %s", response, fallback)
+		return fallback
+	}
+}
+
+// newEDE builds an Extended DNS Error (RFC 8914) option carrying the reason of
+// a failed knock.
+func newEDE(infoCode uint16, reason error) *dns.EDNS0_EDE {
+	ede := &dns.EDNS0_EDE{InfoCode: infoCode}
+	if reason != nil {
+		ede.ExtraText = reason.Error()
+	}
+	return ede
+}
+
+// knockAckErr is a knock denied by the nhp server with its error code.
+type knockAckErr struct {
+	code string
+	err  error
+}
+
+func (e *knockAckErr) Error() string {
+	return e.err.Error()
+}
+
+func (e *knockAckErr) Unwrap() error {
+	return e.err
+}
+
+// knockAckError is the reason the nhp server denied a knock.
+func knockAckError(ackMsg *com.ServerKnockAckMsg) error {
+	err := com.ErrorCodeToError(ackMsg.ErrCode)
+	if err == nil {
+		if len(ackMsg.ErrMsg) > 0 {
+			err = errors.New(ackMsg.ErrMsg)
+		} else {
+			err = fmt.Errorf("nhp server error code %s", ackMsg.ErrCode)
+		}
+	}
+	return &knockAckErr{code: ackMsg.ErrCode, err: err}
+}
+
+// failAnswer answers a query for resId, which could not be knocked, with the
+// failure response of the resource or the global one.
+// The reason is attached as ede if the query supports EDNS0.
+func (p *ProxyService) failAnswer(w dns.ResponseWriter, r *dns.Msg, resId string, ede *dns.EDNS0_EDE) {
+	policy := p.failure.Load()
+	response, ttl := policy.response, policy.ttl
+	if resource := p.getResource(resId); resource != nil {
+		response = parseFailureResponse(resource.FailureResponse, response)
+		if resource.FailureTTL > 0 {
+			ttl = resource.FailureTTL
+		}
+	}
+
+	m := policy.answer(r, response, ttl, ede)
+	log.Debug("domain :%s answered with failure response %s", r.Question[0].Name, response)
+	p.writeMsg(w, r, m)
+}
+
+// answer synthesizes a response to r, with the SOA of negative answers and
+// the ttl of sinkhole records set to ttl.
+func (policy *failurePolicy) answer(r *dns.Msg, response string, ttl uint32, ede *dns.EDNS0_EDE) *dns.Msg {
+	m := new(dns.Msg)
+	switch response {
+	case FailureServFail:
+		m.SetRcode(r, dns.RcodeServerFailure)
+	case FailureRefused:
+		m.SetRcode(r, dns.RcodeRefused)
+	case FailureSinkhole:
+		m.SetReply(r)
+		question := r.Question[0]
+		hdr := dns.RR_Header{Name: question.Name, Rrtype: question.Qtype, Class: dns.ClassINET, Ttl: ttl}
+		switch question.Qtype {
+		case dns.TypeA:
+			m.Answer = append(m.Answer, &dns.A{Hdr: hdr, A: policy.sinkholeIPv4})
+		case dns.TypeAAAA:
+			m.Answer = append(m.Answer, &dns.AAAA{Hdr: hdr, AAAA: policy.sinkholeIPv6})
+		default:
+			m.Ns = append(m.Ns, negativeSOA(question.Name, ttl))
+		}
+	case FailureNoData:
+		m.SetReply(r)
+		m.Ns = append(m.Ns, negativeSOA(r.Question[0].Name, ttl))
+	default:
+		m.SetRcode(r, dns.RcodeNameError)
+		m.Ns = append(m.Ns, negativeSOA(r.Question[0].Name, ttl))
+	}
+	// servfail and refused are no data of the zone.
+	m.Authoritative = m.Rcode != dns.RcodeServerFailure && m.Rcode != dns.RcodeRefused
+	if ede != nil && r.IsEdns0() != nil {
+		m.SetEdns0(defaultEDNSUDPSize, false)
+		opt := m.IsEdns0()
+		opt.Option = append(opt.Option, ede)
+	}
+	return m
+}
@@ -0,0 +1,126 @@
+package dns
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/OpenNHP/opennhp/nhp/log"
+	"github.com/miekg/dns"
+)
+
+// defaultUpstreamGroup names the pool built from the [Upstream] section itself,
+// so rules can send a subdomain of a forwarded suffix back to it.
+const defaultUpstreamGroup = "default"
+
+type forwardRule struct {
+	suffix string
+	labels int
+	group  string
+}
+
+// upstreamRouter picks the upstream pool of a query name by the forward rules.
+type upstreamRouter struct {
+	defaultPool *UpstreamPool
+	groups      map[string]*UpstreamPool
+	// ordered by specificity, most labels first, keeping the config order on ties.
+	rules   []*forwardRule
+	timeout time.Duration
+}
+
+func (p *ProxyService) newUpstreamRouter(conf *UpstreamConfig) *upstreamRouter {
+	router := &upstreamRouter{
+		defaultPool: p.newDefaultUpstreamPool(conf),
+		groups:      make(map[string]*UpstreamPool),
+		timeout:     upstreamTimeout(conf),
+	}
+
+	timeout := router.timeout
+	for _, group := range conf.Groups {
+		name := strings.ToLower(group.Name)
+		if len(name) == 0 || name == defaultUpstreamGroup {
+			log.Error("upstream group name %q is reserved or empty, ignored", group.Name)
+			continue
+		}
+		if _, found := router.groups[name]; found {
+			log.Error("duplicate upstream group %s, ignored", group.Name)
+			continue
+		}
+		router.groups[name] = p.newUpstreamPool(name, group.Strategy, group.Servers, group.DoH, group.DoT, timeout)
+	}
+
+	for _, rule := range conf.Rules {
+		group := strings.ToLower(rule.Group)
+		if _, found := router.groups[group]; !found && group != defaultUpstreamGroup {
+			log.Error("forward rule %s refers to unknown upstream group %s, ignored", rule.Suffix, rule.Group)
+			continue
+		}
+		suffix := dns.Fqdn(strings.ToLower(strings.Trim(strings.TrimSpace(rule.Suffix), ".")))
+		router.rules = append(router.rules, &forwardRule{
+			suffix: suffix,
+			labels: dns.CountLabel(suffix),
+			group:  group,
+		})
+	}
+	sort.SliceStable(router.rules, func(i, j int) bool {
+		return router.rules[i].labels > router.rules[j].labels
+	})
+	return router
+}
+
+// close releases the connections of the upstreams once the queries in
+// flight, which may be retried once, are answered or timed out.
+func (router *upstreamRouter) close() {
+	time.AfterFunc(2*router.timeout, func() {
+		router.defaultPool.Close()
+		for _, pool := range router.groups {
+			pool.Close()
+		}
+	})
+}
+
+// pool returns the upstream pool for a query name and the name of its group.
+func (router *upstreamRouter) pool(name string) (*UpstreamPool, string) {
+	name = normalizeName(name)
+	for _, rule := range router.rules {
+		if !inZone(name, rule.suffix) {
+			continue
+		}
+		if pool, found := router.groups[rule.group]; found {
+			return pool, rule.group
+		}
+		break
+	}
+	return router.defaultPool, defaultUpstreamGroup
+}
+
+// group returns the upstream pool of a group name.
+func (router *upstreamRouter) group(group string) (*UpstreamPool, bool) {
+	if group == defaultUpstreamGroup {
+		return router.defaultPool, true
+	}
+	pool, found := router.groups[group]
+	return pool, found
+}
+
+// exchangeUpstream forwards r to the upstream group, or to the pool selected by
+// its question name if group is empty.
+func (p *ProxyService) exchangeUpstream(r *dns.Msg, group string) (*dns.Msg, string, error) {
+	var name string
+	if len(r.Question) > 0 {
+		name = r.Question[0].Name
+	}
+	router := p.upstreams.Load()
+	pool, found := router.group(group)
+	if !found {
+		if len(group) > 0 {
+			log.Warning("domain :%s forwarded to unknown upstream group %s, using the forward rules", name, group)
+		}
+		pool, group = router.pool(name)
+	}
+	resp, upstream, err := pool.Exchange(p.edns.Load().upstreamQuery(r))
+	if err == nil && group != defaultUpstreamGroup {
+		log.Debug("domain :%s forwarded to upstream group %s", name, group)
+	}
+	return resp, upstream, err
+}
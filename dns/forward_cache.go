@@ -0,0 +1,160 @@
+package dns
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	defaultCacheMaxTTL         = 86400
+	defaultCacheMaxNegativeTTL = 3600
+)
+
+// forwardCache caches answers of forwarded queries for the lowest ttl of
+// their records, and negative answers for the SOA minimum (RFC 2308).
+type forwardCache struct {
+	cache *StealthDNSCache
+	conf  atomic.Pointer[CacheConfig]
+}
+
+func newForwardCache(conf *CacheConfig) *forwardCache {
+	c := &forwardCache{
+		cache: NewStealthDNSCache(0, conf.MaxEntries),
+	}
+	c.setConfig(conf)
+	return c
+}
+
+func (c *forwardCache) setConfig(conf *CacheConfig) {
+	copied := *conf
+	c.conf.Store(&copied)
+	c.cache.SetMaxSize(conf.MaxEntries)
+	if conf.Disable {
+		c.cache.Flush()
+	}
+}
+
+// forwardCacheKey identifies a query by name, type, class, DNSSEC OK and
+// Checking Disabled bits, the upstream group a policy rule forwarded it to,
+// and the client subnet forwarded with it.
+func forwardCacheKey(r *dns.Msg, group, subnet string) string {
+	q := r.Question[0]
+	do := false
+	if opt := r.IsEdns0(); opt != nil {
+		do = opt.Do()
+	}
+	key := fmt.Sprintf("%s|%d|%d|%t", strings.ToLower(q.Name), q.Qtype, q.Qclass, do)
+	if r.CheckingDisabled {
+		key += "|cd"
+	}
+	if len(group) > 0 {
+		key += "|" + group
+	}
+	if len(subnet) > 0 {
+		key += "|ecs=" + subnet
+	}
+	return key
+}
+
+// get returns a copy of the cached answer of r, with the ttls rewritten to
+// the remaining cache lifetime.
+func (c *forwardCache) get(r *dns.Msg, group, subnet string) *dns.Msg {
+	if c.conf.Load().Disable || len(r.Question) != 1 {
+		return nil
+	}
+	item, found := c.cache.GetCache(forwardCacheKey(r, group, subnet))
+	if !found {
+		return nil
+	}
+	remaining := item.remainingTTL()
+
+	m := item.value.(*dns.Msg).Copy()
+	m.Id = r.Id
+	for _, section := range [][]dns.RR{m.Answer, m.Ns, m.Extra} {
+		for _, rr := range section {
+			if rr.Header().Rrtype != dns.TypeOPT {
+				rr.Header().Ttl = remaining
+			}
+		}
+	}
+	return m
+}
+
+func (c *forwardCache) set(r *dns.Msg, group, subnet string, resp *dns.Msg) {
+	conf := c.conf.Load()
+	if conf.Disable || len(r.Question) != 1 {
+		return
+	}
+	ttl, ok := cacheTTL(resp, conf)
+	if !ok {
+		return
+	}
+	c.cache.SetCacheWithTTL(forwardCacheKey(r, group, subnet), resp.Copy(), ttl)
+}
+
+// cacheTTL returns how long resp may be cached, clamped by the config.
+func cacheTTL(resp *dns.Msg, conf *CacheConfig) (time.Duration, bool) {
+	if resp.Truncated || len(resp.Question) != 1 {
+		return 0, false
+	}
+
+	var ttl uint32
+	switch {
+	case resp.Rcode == dns.RcodeSuccess && len(resp.Answer) > 0:
+		ttl = minRRTTL(resp.Answer)
+		if ttl < conf.MinTTL {
+			ttl = conf.MinTTL
+		}
+		maxTTL := conf.MaxTTL
+		if maxTTL == 0 {
+			maxTTL = defaultCacheMaxTTL
+		}
+		if ttl > maxTTL {
+			ttl = maxTTL
+		}
+	case resp.Rcode == dns.RcodeNameError || resp.Rcode == dns.RcodeSuccess:
+		// negative answers are only cached with an SOA record, RFC 2308 section 5.
+		var soa *dns.SOA
+		for _, rr := range resp.Ns {
+			if v, ok := rr.(*dns.SOA); ok {
+				soa = v
+				break
+			}
+		}
+		if soa == nil {
+			return 0, false
+		}
+		ttl = soa.Hdr.Ttl
+		if soa.Minttl < ttl {
+			ttl = soa.Minttl
+		}
+		maxTTL := conf.MaxNegativeTTL
+		if maxTTL == 0 {
+			maxTTL = defaultCacheMaxNegativeTTL
+		}
+		if ttl > maxTTL {
+			ttl = maxTTL
+		}
+	default:
+		return 0, false
+	}
+
+	if ttl == 0 {
+		return 0, false
+	}
+	return time.Duration(ttl) * time.Second, true
+}
+
+func minRRTTL(rrs []dns.RR) uint32 {
+	var ttl uint32
+	for i, rr := range rrs {
+		if i == 0 || rr.Header().Ttl < ttl {
+			ttl = rr.Header().Ttl
+		}
+	}
+	return ttl
+}
@@ -4,4 +4,6 @@ type Handler interface {
 	SetStealthDNS() (bool, error)
 	RemoveStealthDNS()
 	GetUpstreamDNS() string
+	GetUpstreamDNSList() []string
+	GetWifiSSIDs() []string
 }
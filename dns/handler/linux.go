@@ -102,6 +102,32 @@ func (h *LinuxHandler) GetUpstreamDNS() string {
 	return h.upstreamDNS
 }
 
+// GetUpstreamDNSList returns all dns servers detected before the stealth dns was set up.
+func (h *LinuxHandler) GetUpstreamDNSList() []string {
+	return h.backupDNS
+}
+
+// GetWifiSSIDs returns the SSIDs of the connected wireless networks.
+func (h *LinuxHandler) GetWifiSSIDs() []string {
+	var ssids []string
+	if output, err := exec.Command("nmcli", "-t", "-f", "active,ssid", "dev", "wifi").Output(); err == nil {
+		scanner := bufio.NewScanner(strings.NewReader(string(output)))
+		for scanner.Scan() {
+			// colons in the ssid are escaped by nmcli.
+			if ssid, ok := strings.CutPrefix(scanner.Text(), "yes:"); ok && len(ssid) > 0 {
+				ssids = append(ssids, strings.ReplaceAll(ssid, "\\:", ":"))
+			}
+		}
+		return ssids
+	}
+	if output, err := exec.Command("iwgetid", "-r").Output(); err == nil {
+		if ssid := strings.TrimSpace(string(output)); len(ssid) > 0 {
+			ssids = append(ssids, ssid)
+		}
+	}
+	return ssids
+}
+
 func (h *LinuxHandler) detectDNSManagement() error {
 	h.dnsManagement = &DNSManagement{Method: "unknown"}
 	resolv := "/etc/resolv.conf"
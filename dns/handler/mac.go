@@ -284,6 +284,42 @@ func (h *MacHandler) GetUpstreamDNS() string {
 	return h.upstreamDNS
 }
 
+// GetUpstreamDNSList returns all dns servers detected before the stealth dns was set up.
+func (h *MacHandler) GetUpstreamDNSList() []string {
+	return h.backupDNS
+}
+
+// GetWifiSSIDs returns the SSIDs of the connected wireless networks.
+func (h *MacHandler) GetWifiSSIDs() []string {
+	output, err := exec.Command("networksetup", "-listallhardwareports").Output()
+	if err != nil {
+		return nil
+	}
+	var ssids []string
+	wifiPort := false
+	scanner := bufio.NewScanner(strings.NewReader(string(output)))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if port, ok := strings.CutPrefix(line, "Hardware Port:"); ok {
+			port = strings.TrimSpace(port)
+			wifiPort = port == "Wi-Fi" || port == "AirPort"
+			continue
+		}
+		device, ok := strings.CutPrefix(line, "Device:")
+		if !ok || !wifiPort {
+			continue
+		}
+		network, err := exec.Command("networksetup", "-getairportnetwork", strings.TrimSpace(device)).Output()
+		if err != nil {
+			continue
+		}
+		if ssid, ok := strings.CutPrefix(strings.TrimSpace(string(network)), "Current Wi-Fi Network:"); ok {
+			ssids = append(ssids, strings.TrimSpace(ssid))
+		}
+	}
+	return ssids
+}
+
 func (h *MacHandler) isValidIP(ip string) bool {
 	parsed := net.ParseIP(ip)
 	return parsed != nil && parsed.To4() != nil // Only accept IPv4 addresses
@@ -62,6 +62,32 @@ func (h *WindowsHandler) GetUpstreamDNS() string {
 	return h.upstreamDNS
 }
 
+// GetUpstreamDNSList returns all dns servers detected before the stealth dns was set up.
+func (h *WindowsHandler) GetUpstreamDNSList() []string {
+	return h.backupDNS
+}
+
+// GetWifiSSIDs returns the SSIDs of the connected wireless networks.
+func (h *WindowsHandler) GetWifiSSIDs() []string {
+	output, err := exec.Command("netsh", "wlan", "show", "interfaces").Output()
+	if err != nil {
+		return nil
+	}
+	text, _ := h.decodeFromCodePage(output)
+	var ssids []string
+	scanner := bufio.NewScanner(strings.NewReader(text))
+	for scanner.Scan() {
+		// "SSID : name", not to be confused with "BSSID : mac".
+		key, value, found := strings.Cut(scanner.Text(), ":")
+		if found && strings.TrimSpace(key) == "SSID" {
+			if ssid := strings.TrimSpace(value); len(ssid) > 0 {
+				ssids = append(ssids, ssid)
+			}
+		}
+	}
+	return ssids
+}
+
 func (h *WindowsHandler) SetStealthDNS() (bool, error) {
 	if !h.isAdmin {
 		log.Warning("The current account does not have administrator privileges. Please manually configure the alternate DNS.")
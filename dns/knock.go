@@ -0,0 +1,184 @@
+package dns
+
+import (
+	"errors"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	com "github.com/OpenNHP/opennhp/nhp/common"
+	"github.com/OpenNHP/opennhp/nhp/log"
+	"github.com/miekg/dns"
+)
+
+const knockTimeout = 5 * time.Second
+
+// knockError is a failed knock with the Extended DNS Error info code of its reason.
+type knockError struct {
+	infoCode uint16
+	err      error
+}
+
+func (e *knockError) Error() string {
+	return e.err.Error()
+}
+
+func (e *knockError) Unwrap() error {
+	return e.err
+}
+
+// knockEDE builds the Extended DNS Error of a failed knock.
+func knockEDE(err error) *dns.EDNS0_EDE {
+	var kerr *knockError
+	if errors.As(err, &kerr) {
+		return newEDE(kerr.infoCode, kerr.err)
+	}
+	return newEDE(dns.ExtendedErrorCodeOther, err)
+}
+
+// knockResource returns the acknowledgement of a knocked resource and the
+// seconds its answers may be cached. The resource is knocked once, names
+// below it and concurrent queries share the cached acknowledgement.
+func (p *ProxyService) knockResource(resId string) (*com.ServerKnockAckMsg, uint32, error) {
+	if ackMsg, ttl, found := p.cachedKnock(resId); found {
+		return ackMsg, ttl, nil
+	}
+
+	resultCh := p.dnsCache.group.DoChan(resId, func() (interface{}, error) {
+		if ackMsg, _, found := p.cachedKnock(resId); found {
+			return ackMsg, nil
+		}
+
+		ackMsg, err := p.knock(resId)
+		if errors.Is(err, errUnknownResource) {
+			return nil, &knockError{dns.ExtendedErrorCodeBlocked, err}
+		}
+		if err != nil {
+			return nil, &knockError{dns.ExtendedErrorCodeNoReachableAuthority, err}
+		}
+		if ackMsg == nil {
+			return nil, &knockError{dns.ExtendedErrorCodeNoReachableAuthority, errors.New("request nhp-server fail")}
+		}
+		if !strings.EqualFold(ackMsg.ErrCode, "0") {
+			return nil, &knockError{dns.ExtendedErrorCodeProhibited, knockAckError(ackMsg)}
+		}
+		if len(ackMsg.ResourceHost) == 0 {
+			return nil, &knockError{dns.ExtendedErrorCodeOther, errors.New("nhp server returns no resource host")}
+		}
+		log.Debug("nhp knock success")
+
+		p.dnsCache.SetCacheWithTTL(resId, ackMsg, time.Duration(cacheOpenTime(ackMsg.OpenTime))*time.Second)
+		p.scheduleReknock(resId, ackMsg.OpenTime)
+		return ackMsg, nil
+	})
+
+	// waiting result
+	select {
+	case result := <-resultCh:
+		if result.Err != nil {
+			return nil, 0, result.Err
+		}
+		ackMsg := result.Val.(*com.ServerKnockAckMsg)
+		if _, ttl, found := p.cachedKnock(resId); found {
+			return ackMsg, ttl, nil
+		}
+		return ackMsg, cacheOpenTime(ackMsg.OpenTime), nil
+	case <-time.After(knockTimeout):
+		return nil, 0, &knockError{dns.ExtendedErrorCodeNoReachableAuthority, errors.New("timeout waiting for knock")}
+	}
+}
+
+// cachedKnock returns the cached acknowledgement of resId and its remaining ttl.
+func (p *ProxyService) cachedKnock(resId string) (*com.ServerKnockAckMsg, uint32, bool) {
+	item, found := p.dnsCache.GetCache(resId)
+	if !found {
+		return nil, 0, false
+	}
+	return item.value.(*com.ServerKnockAckMsg), item.remainingTTL(), true
+}
+
+// resourceHosts returns the hosts answering name, a name of resId, ordered
+// by their key in the resource host map. With SubdomainHosts enabled, a
+// subdomain listed in the map, either by its labels below the resource or by
+// its full name, is answered with its own host only.
+func (p *ProxyService) resourceHosts(resId string, name string, subdomain string, ackMsg *com.ServerKnockAckMsg) []string {
+	hosts := make(map[string]string, len(ackMsg.ResourceHost))
+	keys := make([]string, 0, len(ackMsg.ResourceHost))
+	for key, host := range ackMsg.ResourceHost {
+		key = strings.ToLower(strings.TrimSuffix(key, "."))
+		hosts[key] = host
+		keys = append(keys, key)
+	}
+
+	if resource := p.getResource(resId); len(subdomain) > 0 && resource != nil && resource.SubdomainHosts {
+		for _, key := range []string{subdomain, strings.TrimSuffix(normalizeName(name), ".")} {
+			if host, found := hosts[key]; found {
+				return []string{host}
+			}
+		}
+	}
+
+	sort.Strings(keys)
+	result := make([]string, 0, len(keys))
+	for _, key := range keys {
+		result = append(result, hosts[key])
+	}
+	return result
+}
+
+// splitHosts separates the ip addresses of the query family from host names.
+// Addresses of the other family are dropped.
+func splitHosts(hosts []string, qtype uint16) (ips []net.IP, names []string) {
+	for _, host := range hosts {
+		host, _ = parseResourceHost(host)
+		ip := net.ParseIP(host)
+		switch {
+		case ip == nil:
+			if len(host) > 0 {
+				names = append(names, host)
+			}
+		case ip.To4() != nil:
+			if qtype == dns.TypeA {
+				ips = append(ips, ip.To4())
+			}
+		default:
+			if qtype == dns.TypeAAAA {
+				ips = append(ips, ip)
+			}
+		}
+	}
+	return ips, names
+}
+
+// parseResourceHost splits a resource host of the knock answer, which may
+// carry the port of the resource as "host:port".
+func parseResourceHost(value string) (string, uint16) {
+	value = strings.TrimSpace(value)
+	if host, port, err := net.SplitHostPort(value); err == nil {
+		if n, err := strconv.ParseUint(port, 10, 16); err == nil {
+			return trimBrackets(host), uint16(n)
+		}
+	}
+	return value, 0
+}
+
+// resourcePort is the first port carried by the resource hosts, or 0.
+func resourcePort(hosts []string) uint16 {
+	for _, host := range hosts {
+		if _, port := parseResourceHost(host); port != 0 {
+			return port
+		}
+	}
+	return 0
+}
+
+// rotateIPs rotates ips by n, spreading clients over the resource hosts.
+func rotateIPs(ips []net.IP, n uint32) []net.IP {
+	if len(ips) < 2 {
+		return ips
+	}
+	offset := int(n % uint32(len(ips)))
+	return append(ips[offset:len(ips):len(ips)], ips[:offset]...)
+}
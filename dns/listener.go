@@ -0,0 +1,216 @@
+package dns
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/OpenNHP/opennhp/nhp/log"
+	"github.com/miekg/dns"
+
+	"github.com/OpenNHP/StealthDNS/cert"
+	"github.com/OpenNHP/StealthDNS/common"
+)
+
+const (
+	ProtocolUDP   = "udp"
+	ProtocolTCP   = "tcp"
+	ProtocolBoth  = "both"
+	ProtocolTLS   = "tls"
+	ProtocolHTTPS = "https"
+)
+
+// dnsListener is a running server feeding queries into ProxyService.ServeDNS.
+type dnsListener interface {
+	ListenAndServe() error
+	Shutdown() error
+}
+
+// listenEndpoints expands the [Listen] config into network/address pairs,
+// keyed by "network://address", with the path for https so that a changed
+// DoHPath rebinds the server. An empty config listens on 127.0.0.1:53 over
+// both udp and tcp.
+func listenEndpoints(conf *ListenConfig) map[string][2]string {
+	addrs := conf.Addrs
+	if len(addrs) == 0 {
+		addrs = []*ListenAddr{{Ip: common.StealthDnsIp, Port: common.DnsUdpPort, Protocol: ProtocolBoth}}
+	}
+
+	endpoints := make(map[string][2]string)
+	for _, addr := range addrs {
+		protocol := strings.ToLower(addr.Protocol)
+		port := addr.Port
+		if port == 0 {
+			switch protocol {
+			case ProtocolTLS:
+				port = common.DnsTlsPort
+			case ProtocolHTTPS:
+				port = common.DnsHttpsPort
+			default:
+				port = common.DnsUdpPort
+			}
+		}
+
+		var ips []string
+		if len(addr.Interface) > 0 {
+			ifIps, err := interfaceIps(addr.Interface)
+			if err != nil {
+				log.Error("listen on interface %s fail: %v", addr.Interface, err)
+				continue
+			}
+			ips = ifIps
+		} else if len(addr.Ip) > 0 {
+			if net.ParseIP(addr.Ip) == nil {
+				log.Error("invalid listen ip %s, ignored", addr.Ip)
+				continue
+			}
+			ips = []string{addr.Ip}
+		} else {
+			ips = []string{common.StealthDnsIp}
+		}
+
+		var networks []string
+		switch protocol {
+		case ProtocolUDP, ProtocolTCP, ProtocolTLS, ProtocolHTTPS:
+			networks = []string{protocol}
+		case ProtocolBoth, "":
+			networks = []string{ProtocolUDP, ProtocolTCP}
+		default:
+			log.Error("invalid listen protocol %s, ignored", addr.Protocol)
+			continue
+		}
+
+		for _, ip := range ips {
+			hostPort := net.JoinHostPort(ip, strconv.Itoa(port))
+			for _, network := range networks {
+				key := network + "://" + hostPort
+				if network == ProtocolHTTPS {
+					key += dohPath(conf.DoHPath)
+				}
+				endpoints[key] = [2]string{network, hostPort}
+			}
+		}
+	}
+	return endpoints
+}
+
+func interfaceIps(name string) ([]string, error) {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, err
+	}
+	var ips []string
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && !ipNet.IP.IsLinkLocalUnicast() {
+			ips = append(ips, ipNet.IP.String())
+		}
+	}
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("no usable address on interface %s", name)
+	}
+	return ips, nil
+}
+
+// bindListeners starts a dns server for every configured endpoint that is
+// not listening yet and shuts down the servers that are no longer configured.
+// A server failing to bind on startup stops the service, while a failure
+// after a config reload only drops that endpoint.
+func (p *ProxyService) bindListeners(conf *ListenConfig, fatal bool) {
+	endpoints := listenEndpoints(conf)
+
+	p.serversLock.Lock()
+	defer p.serversLock.Unlock()
+	if p.servers == nil {
+		p.servers = make(map[string]dnsListener)
+	}
+
+	for key, server := range p.servers {
+		if _, found := endpoints[key]; !found {
+			log.Info("stop listening on %s", key)
+			delete(p.servers, key)
+			if err := server.Shutdown(); err != nil {
+				log.Debug("dns server %s shutdown: %v", key, err)
+			}
+		}
+	}
+
+	for key, endpoint := range endpoints {
+		if _, found := p.servers[key]; found {
+			continue
+		}
+		server, err := p.newListener(endpoint[0], endpoint[1], conf)
+		if err != nil {
+			log.Error("listen on %s fail: %v", key, err)
+			continue
+		}
+		p.servers[key] = server
+		log.Info("listening on %s", key)
+		go p.startServer(key, server, fatal)
+	}
+}
+
+func (p *ProxyService) newListener(network, addr string, conf *ListenConfig) (dnsListener, error) {
+	switch network {
+	case ProtocolUDP, ProtocolTCP:
+		return &dns.Server{
+			Addr:    addr,
+			Net:     network,
+			Handler: p,
+		}, nil
+	}
+
+	// encrypted listeners serve a certificate issued by the local root CA.
+	host, _, _ := net.SplitHostPort(addr)
+	certificate, err := cert.IssueCertificate([]string{"localhost", host})
+	if err != nil {
+		log.Error("no certificate for %s: %v, create the local root CA with \"stealth-dns install-root-ca\"", addr, err)
+		return nil, err
+	}
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{*certificate},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if network == ProtocolTLS {
+		return &dns.Server{
+			Addr:      addr,
+			Net:       "tcp-tls",
+			TLSConfig: tlsConfig,
+			Handler:   p,
+		}, nil
+	}
+	return newDoHServer(addr, conf.DoHPath, tlsConfig, p), nil
+}
+
+func (p *ProxyService) startServer(key string, server dnsListener, fatal bool) {
+	err := server.ListenAndServe()
+	if err != nil {
+		log.Error("dns server listen on %s fail: %v", key, err)
+		if fatal {
+			p.Stop()
+			return
+		}
+		p.serversLock.Lock()
+		if p.servers[key] == server {
+			delete(p.servers, key)
+		}
+		p.serversLock.Unlock()
+	}
+}
+
+// shutdownListeners stops all running dns servers.
+func (p *ProxyService) shutdownListeners() {
+	p.serversLock.Lock()
+	defer p.serversLock.Unlock()
+	for key, server := range p.servers {
+		if err := server.Shutdown(); err != nil {
+			log.Debug("dns server %s shutdown: %v", key, err)
+		}
+	}
+	p.servers = nil
+}
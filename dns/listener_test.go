@@ -0,0 +1,47 @@
+package dns
+
+import (
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestListenEndpoints(t *testing.T) {
+	tests := []struct {
+		name string
+		conf ListenConfig
+		want []string
+	}{
+		{
+			name: "default",
+			want: []string{"tcp://127.0.0.1:53", "udp://127.0.0.1:53"},
+		},
+		{
+			name: "encrypted with default ports and path",
+			conf: ListenConfig{Addrs: []*ListenAddr{{Ip: "127.0.0.1", Protocol: "TLS"}, {Ip: "::1", Protocol: ProtocolHTTPS}}},
+			want: []string{"https://[::1]:443/dns-query", "tls://127.0.0.1:853"},
+		},
+		{
+			name: "doh path",
+			conf: ListenConfig{DoHPath: "/resolve", Addrs: []*ListenAddr{{Ip: "127.0.0.1", Port: 8443, Protocol: ProtocolHTTPS}}},
+			want: []string{"https://127.0.0.1:8443/resolve"},
+		},
+		{
+			name: "invalid entries are ignored",
+			conf: ListenConfig{Addrs: []*ListenAddr{{Ip: "localhost"}, {Ip: "127.0.0.1", Protocol: "quic"}, {Ip: "127.0.0.2", Port: 5353, Protocol: ProtocolUDP}}},
+			want: []string{"udp://127.0.0.2:5353"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			for key := range listenEndpoints(&tt.conf) {
+				got = append(got, key)
+			}
+			sort.Strings(got)
+			if strings.Join(got, " ") != strings.Join(tt.want, " ") {
+				t.Errorf("listenEndpoints() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,340 @@
+package dns
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/OpenNHP/opennhp/nhp/log"
+	"github.com/OpenNHP/opennhp/nhp/utils"
+	"github.com/miekg/dns"
+
+	"github.com/OpenNHP/StealthDNS/common"
+)
+
+const (
+	// localRouteTable is the name of the table answering from hosts and zone files.
+	localRouteTable = "local"
+
+	defaultLocalTTL = 60
+	maxCNAMEChain   = 8
+)
+
+// localZone is the records of a zone file.
+type localZone struct {
+	origin  string
+	soa     *dns.SOA
+	records map[string][]dns.RR
+}
+
+// localStore is the in-memory authoritative data of the hosts and zone files.
+type localStore struct {
+	ttl   uint32
+	hosts map[string][]dns.RR
+	// ordered by specificity, most labels first.
+	zones []*localZone
+}
+
+func (p *ProxyService) loadLocalData(conf *LocalConfig) {
+	p.localLock.Lock()
+	defer p.localLock.Unlock()
+
+	for _, watch := range p.localWatches {
+		_ = watch.Close()
+	}
+	p.localWatches = nil
+
+	files := make([]string, 0, len(conf.HostsFiles)+len(conf.ZoneFiles))
+	for _, file := range conf.HostsFiles {
+		files = append(files, localFilePath(file))
+	}
+	for _, zone := range conf.ZoneFiles {
+		files = append(files, localFilePath(zone.File))
+	}
+	for _, file := range files {
+		fileName := file
+		p.localWatches = append(p.localWatches, utils.WatchFile(fileName, func() {
+			log.Info("local data file: %s has been updated", fileName)
+			p.reloadLocalData(conf)
+		}))
+	}
+	p.updateLocalStore(conf)
+}
+
+func (p *ProxyService) reloadLocalData(conf *LocalConfig) {
+	p.localLock.Lock()
+	defer p.localLock.Unlock()
+	p.updateLocalStore(conf)
+}
+
+// updateLocalStore rebuilds the local store, the local lock must be held.
+func (p *ProxyService) updateLocalStore(conf *LocalConfig) {
+	if len(conf.HostsFiles) == 0 && len(conf.ZoneFiles) == 0 {
+		p.local.Store(nil)
+		return
+	}
+
+	store := &localStore{
+		ttl:   conf.TTL,
+		hosts: make(map[string][]dns.RR),
+	}
+	if store.ttl == 0 {
+		store.ttl = defaultLocalTTL
+	}
+	for _, file := range conf.HostsFiles {
+		if err := store.loadHosts(localFilePath(file)); err != nil {
+			log.Error("failed to load hosts file %s: %v", file, err)
+		}
+	}
+	for _, zone := range conf.ZoneFiles {
+		if err := store.loadZone(localFilePath(zone.File), zone.Origin); err != nil {
+			log.Error("failed to load zone file %s: %v", zone.File, err)
+		}
+	}
+	sort.SliceStable(store.zones, func(i, j int) bool {
+		return dns.CountLabel(store.zones[i].origin) > dns.CountLabel(store.zones[j].origin)
+	})
+	log.Info("local data loaded: %d host names, %d zones", len(store.hosts), len(store.zones))
+	p.local.Store(store)
+}
+
+func localFilePath(file string) string {
+	if filepath.IsAbs(file) {
+		return file
+	}
+	return filepath.Join(common.ExeDirPath, file)
+}
+
+// loadHosts reads a hosts format file, "address name [aliases...]" per line.
+// The reverse names of the addresses are added as PTR records.
+func (s *localStore) loadHosts(file string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return s.parseHosts(f, file)
+}
+
+func (s *localStore) parseHosts(r io.Reader, file string) error {
+	scanner := bufio.NewScanner(r)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		ip := net.ParseIP(fields[0])
+		if ip == nil {
+			log.Warning("hosts file %s line %d: invalid address %s", file, lineNo, fields[0])
+			continue
+		}
+		for i, host := range fields[1:] {
+			name := normalizeName(host)
+			hdr := dns.RR_Header{Name: name, Class: dns.ClassINET, Ttl: s.ttl}
+			if ip4 := ip.To4(); ip4 != nil {
+				hdr.Rrtype = dns.TypeA
+				s.hosts[name] = append(s.hosts[name], &dns.A{Hdr: hdr, A: ip4})
+			} else {
+				hdr.Rrtype = dns.TypeAAAA
+				s.hosts[name] = append(s.hosts[name], &dns.AAAA{Hdr: hdr, AAAA: ip})
+			}
+			if i == 0 {
+				// the canonical name is the reverse name of the address.
+				reverse, err := dns.ReverseAddr(ip.String())
+				if err == nil {
+					s.hosts[reverse] = append(s.hosts[reverse], &dns.PTR{
+						Hdr: dns.RR_Header{Name: reverse, Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: s.ttl},
+						Ptr: name,
+					})
+				}
+			}
+		}
+	}
+	return scanner.Err()
+}
+
+// loadZone reads an RFC 1035 master file. Without an SOA record in the file,
+// one is synthesized for the origin.
+func (s *localStore) loadZone(file string, origin string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return s.parseZone(f, file, origin)
+}
+
+func (s *localStore) parseZone(r io.Reader, file string, origin string) error {
+	zone := &localZone{
+		origin:  normalizeName(origin),
+		records: make(map[string][]dns.RR),
+	}
+	zp := dns.NewZoneParser(r, zone.origin, file)
+	zp.SetDefaultTTL(s.ttl)
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		rr.Header().Name = normalizeName(rr.Header().Name)
+		if soa, isSOA := rr.(*dns.SOA); isSOA {
+			if zone.soa == nil {
+				zone.soa = soa
+				zone.origin = soa.Hdr.Name
+			}
+			continue
+		}
+		zone.records[rr.Header().Name] = append(zone.records[rr.Header().Name], rr)
+	}
+	if err := zp.Err(); err != nil {
+		return err
+	}
+	if zone.origin == "." {
+		log.Warning("zone file %s has no origin nor SOA record, ignored", file)
+		return nil
+	}
+	if zone.soa == nil {
+		zone.soa = syntheticSOA(zone.origin, s.ttl)
+	}
+	zone.records[zone.origin] = append(zone.records[zone.origin], zone.soa)
+
+	// empty non-terminals exist, they are answered with NODATA.
+	for name := range zone.records {
+		if !inZone(name, zone.origin) {
+			log.Warning("zone file %s: %s is out of zone %s, ignored", file, name, zone.origin)
+			delete(zone.records, name)
+			continue
+		}
+		for parent := name; parent != zone.origin; {
+			off, end := dns.NextLabel(parent, 0)
+			if end {
+				break
+			}
+			parent = parent[off:]
+			if _, found := zone.records[parent]; !found {
+				zone.records[parent] = []dns.RR{}
+			}
+		}
+	}
+	s.zones = append(s.zones, zone)
+	return nil
+}
+
+// routeLocal answers the names of the hosts files and the zone files locally.
+func (p *ProxyService) routeLocal(name string, qtype uint16) *Route {
+	store := p.local.Load()
+	if store == nil {
+		return nil
+	}
+	if _, found := store.hosts[name]; !found && store.zone(name) == nil {
+		return nil
+	}
+	return &Route{
+		Action: RouteLocal,
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+			p.writeMsg(w, r, store.answer(r))
+		}),
+	}
+}
+
+func (s *localStore) zone(name string) *localZone {
+	for _, zone := range s.zones {
+		if inZone(name, zone.origin) {
+			return zone
+		}
+	}
+	return nil
+}
+
+func (s *localStore) answer(r *dns.Msg) *dns.Msg {
+	question := r.Question[0]
+	name := normalizeName(question.Name)
+	m := new(dns.Msg)
+	m.SetReply(r)
+	m.Authoritative = true
+
+	// a host name is pinned, it has no other records than the ones of the hosts files.
+	if rrs, found := s.hosts[name]; found {
+		m.Answer = matchRecords(rrs, question.Name, question.Qtype)
+		if len(m.Answer) == 0 {
+			if zone := s.zone(name); zone != nil {
+				m.Ns = append(m.Ns, zone.negativeSOA())
+			} else {
+				m.Ns = append(m.Ns, negativeSOA(name, s.ttl))
+			}
+		}
+		return m
+	}
+
+	zone := s.zone(name)
+	owner, ownerName := name, question.Name
+	for i := 0; i < maxCNAMEChain; i++ {
+		rrs, found := zone.lookup(owner)
+		if !found {
+			if i == 0 {
+				m.Rcode = dns.RcodeNameError
+			}
+			break
+		}
+		if answer := matchRecords(rrs, ownerName, question.Qtype); len(answer) > 0 {
+			m.Answer = append(m.Answer, answer...)
+			break
+		}
+		cname := matchRecords(rrs, ownerName, dns.TypeCNAME)
+		if len(cname) == 0 {
+			break
+		}
+		m.Answer = append(m.Answer, cname[0])
+		owner = normalizeName(cname[0].(*dns.CNAME).Target)
+		ownerName = owner
+		if !inZone(owner, zone.origin) {
+			break
+		}
+	}
+	if len(m.Answer) == 0 {
+		m.Ns = append(m.Ns, zone.negativeSOA())
+	}
+	return m
+}
+
+// negativeSOA is the SOA record of a NXDOMAIN or NODATA answer of the zone,
+// with the negative caching time as its ttl (RFC 2308 section 3).
+func (zone *localZone) negativeSOA() *dns.SOA {
+	soa := dns.Copy(zone.soa).(*dns.SOA)
+	soa.Hdr.Ttl = min(soa.Hdr.Ttl, soa.Minttl)
+	return soa
+}
+
+// lookup returns the records of name, synthesized from a wildcard of its
+// closest encloser (RFC 4592) if name doesn't exist.
+func (zone *localZone) lookup(name string) ([]dns.RR, bool) {
+	if rrs, found := zone.records[name]; found {
+		return rrs, true
+	}
+	for parent := name; parent != zone.origin; {
+		off, end := dns.NextLabel(parent, 0)
+		if end {
+			break
+		}
+		parent = parent[off:]
+		if _, found := zone.records[parent]; found {
+			rrs, found := zone.records["*."+parent]
+			return rrs, found
+		}
+	}
+	return nil, false
+}
+
+// matchRecords returns copies of the records of type qtype, owned by name.
+func matchRecords(rrs []dns.RR, name string, qtype uint16) []dns.RR {
+	var result []dns.RR
+	for _, rr := range rrs {
+		if qtype == dns.TypeANY || rr.Header().Rrtype == qtype {
+			copied := dns.Copy(rr)
+			copied.Header().Name = name
+			result = append(result, copied)
+		}
+	}
+	return result
+}
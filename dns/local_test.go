@@ -0,0 +1,175 @@
+package dns
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+const testZone = `$ORIGIN lab.example.com.
+$TTL 300
+@        IN SOA ns1 hostmaster 7 3600 600 86400 30
+@        IN NS  ns1
+ns1      IN A   10.0.0.1
+www      IN CNAME web
+web      IN A   10.0.0.2
+ext      IN CNAME www.example.org.
+loop1    IN CNAME loop2
+loop2    IN CNAME loop1
+*.apps   IN A   10.0.0.3
+a.b.deep IN TXT "deep"
+printer  IN A   10.0.0.9
+other.example.com. IN A 10.0.0.4
+`
+
+const testHosts = `# pinned names
+10.0.0.5 nas.lab.example.com nas # storage
+2001:db8::5 nas.lab.example.com
+10.0.0.6 Router.Home
+not-an-address broken.home
+`
+
+func testLocalStore(t *testing.T) *localStore {
+	store := &localStore{ttl: defaultLocalTTL, hosts: make(map[string][]dns.RR)}
+	if err := store.parseZone(strings.NewReader(testZone), "lab.zone", ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.parseHosts(strings.NewReader(testHosts), "hosts"); err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+func TestLocalStoreAnswer(t *testing.T) {
+	store := testLocalStore(t)
+	tests := []struct {
+		name   string
+		qtype  uint16
+		rcode  int
+		answer []string
+		soa    string
+	}{
+		{name: "web.lab.example.com.", qtype: dns.TypeA, answer: []string{"web.lab.example.com.\t300\tIN\tA\t10.0.0.2"}},
+		{name: "WEB.Lab.Example.com.", qtype: dns.TypeA, answer: []string{"WEB.Lab.Example.com.\t300\tIN\tA\t10.0.0.2"}},
+		// CNAME chasing inside the zone, and ending at a name outside of it.
+		{name: "www.lab.example.com.", qtype: dns.TypeA, answer: []string{
+			"www.lab.example.com.\t300\tIN\tCNAME\tweb.lab.example.com.",
+			"web.lab.example.com.\t300\tIN\tA\t10.0.0.2",
+		}},
+		{name: "www.lab.example.com.", qtype: dns.TypeCNAME, answer: []string{"www.lab.example.com.\t300\tIN\tCNAME\tweb.lab.example.com."}},
+		{name: "ext.lab.example.com.", qtype: dns.TypeA, answer: []string{"ext.lab.example.com.\t300\tIN\tCNAME\twww.example.org."}},
+		{name: "loop1.lab.example.com.", qtype: dns.TypeA, answer: []string{
+			"loop1.lab.example.com.\t300\tIN\tCNAME\tloop2.lab.example.com.",
+			"loop2.lab.example.com.\t300\tIN\tCNAME\tloop1.lab.example.com.",
+			"loop1.lab.example.com.\t300\tIN\tCNAME\tloop2.lab.example.com.",
+			"loop2.lab.example.com.\t300\tIN\tCNAME\tloop1.lab.example.com.",
+			"loop1.lab.example.com.\t300\tIN\tCNAME\tloop2.lab.example.com.",
+			"loop2.lab.example.com.\t300\tIN\tCNAME\tloop1.lab.example.com.",
+			"loop1.lab.example.com.\t300\tIN\tCNAME\tloop2.lab.example.com.",
+			"loop2.lab.example.com.\t300\tIN\tCNAME\tloop1.lab.example.com.",
+		}},
+		// wildcard synthesis below the closest encloser only.
+		{name: "x.apps.lab.example.com.", qtype: dns.TypeA, answer: []string{"x.apps.lab.example.com.\t300\tIN\tA\t10.0.0.3"}},
+		{name: "y.x.apps.lab.example.com.", qtype: dns.TypeA, answer: []string{"y.x.apps.lab.example.com.\t300\tIN\tA\t10.0.0.3"}},
+		{name: "x.apps.lab.example.com.", qtype: dns.TypeAAAA, soa: "lab.example.com."},
+		{name: "apps.lab.example.com.", qtype: dns.TypeA, soa: "lab.example.com."},
+		// an empty non-terminal exists, but has no data.
+		{name: "b.deep.lab.example.com.", qtype: dns.TypeTXT, soa: "lab.example.com."},
+		{name: "deep.lab.example.com.", qtype: dns.TypeA, soa: "lab.example.com."},
+		{name: "a.b.deep.lab.example.com.", qtype: dns.TypeTXT, answer: []string{"a.b.deep.lab.example.com.\t300\tIN\tTXT\t\"deep\""}},
+		{name: "missing.lab.example.com.", qtype: dns.TypeA, rcode: dns.RcodeNameError, soa: "lab.example.com."},
+		{name: "web.lab.example.com.", qtype: dns.TypeMX, soa: "lab.example.com."},
+		{name: "lab.example.com.", qtype: dns.TypeSOA, answer: []string{"lab.example.com.\t300\tIN\tSOA\tns1.lab.example.com. hostmaster.lab.example.com. 7 3600 600 86400 30"}},
+		// pinned host names only have the addresses of the hosts file.
+		{name: "nas.lab.example.com.", qtype: dns.TypeA, answer: []string{"nas.lab.example.com.\t60\tIN\tA\t10.0.0.5"}},
+		{name: "nas.lab.example.com.", qtype: dns.TypeAAAA, answer: []string{"nas.lab.example.com.\t60\tIN\tAAAA\t2001:db8::5"}},
+		{name: "nas.lab.example.com.", qtype: dns.TypeMX, soa: "lab.example.com."},
+		{name: "router.home.", qtype: dns.TypeAAAA, soa: "router.home."},
+		{name: "5.0.0.10.in-addr.arpa.", qtype: dns.TypePTR, answer: []string{"5.0.0.10.in-addr.arpa.\t60\tIN\tPTR\tnas.lab.example.com."}},
+		{name: "6.0.0.10.in-addr.arpa.", qtype: dns.TypePTR, answer: []string{"6.0.0.10.in-addr.arpa.\t60\tIN\tPTR\trouter.home."}},
+		{
+			name:   "5.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa.",
+			qtype:  dns.TypePTR,
+			answer: []string{"5.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa.\t60\tIN\tPTR\tnas.lab.example.com."},
+		},
+	}
+	for _, tt := range tests {
+		m := store.answer(testQuery(tt.name, tt.qtype))
+		if m.Rcode != tt.rcode || !m.Authoritative {
+			t.Errorf("%s %s: rcode %s, aa %t", tt.name, dns.Type(tt.qtype), dns.RcodeToString[m.Rcode], m.Authoritative)
+		}
+		var answer []string
+		for _, rr := range m.Answer {
+			answer = append(answer, rr.String())
+		}
+		if strings.Join(answer, "\n") != strings.Join(tt.answer, "\n") {
+			t.Errorf("%s %s: answer\n%s\nwant\n%s", tt.name, dns.Type(tt.qtype), strings.Join(answer, "\n"), strings.Join(tt.answer, "\n"))
+		}
+		if len(tt.soa) == 0 {
+			if len(m.Ns) > 0 {
+				t.Errorf("%s %s: authority %v", tt.name, dns.Type(tt.qtype), m.Ns)
+			}
+			continue
+		}
+		if len(m.Ns) != 1 || m.Ns[0].Header().Name != tt.soa {
+			t.Errorf("%s %s: authority %v, want the SOA of %s", tt.name, dns.Type(tt.qtype), m.Ns, tt.soa)
+		}
+	}
+}
+
+func TestLocalZoneNegativeTTL(t *testing.T) {
+	store := testLocalStore(t)
+	m := store.answer(testQuery("missing.lab.example.com.", dns.TypeA))
+	// the negative caching time is the SOA minimum, RFC 2308 section 3.
+	if soa, ok := m.Ns[0].(*dns.SOA); !ok || soa.Hdr.Ttl != 30 || soa.Serial != 7 {
+		t.Errorf("negative answer authority %v", m.Ns[0])
+	}
+	// the record of the zone keeps its ttl.
+	if soa := store.zones[0].soa; soa.Hdr.Ttl != 300 {
+		t.Errorf("zone SOA ttl changed to %d", soa.Hdr.Ttl)
+	}
+	m = store.answer(testQuery("nas.lab.example.com.", dns.TypeTXT))
+	if soa, ok := m.Ns[0].(*dns.SOA); !ok || soa.Hdr.Ttl != 30 || soa.Serial != 7 {
+		t.Errorf("pinned name NODATA authority %v, want the zone SOA", m.Ns[0])
+	}
+}
+
+func TestParseZone(t *testing.T) {
+	store := testLocalStore(t)
+	zone := store.zones[0]
+	if zone.origin != "lab.example.com." {
+		t.Errorf("origin %s, want the SOA owner", zone.origin)
+	}
+	if _, found := zone.records["other.example.com."]; found {
+		t.Error("out of zone record is kept")
+	}
+	for _, name := range []string{"deep.lab.example.com.", "b.deep.lab.example.com.", "apps.lab.example.com."} {
+		if rrs, found := zone.records[name]; !found || len(rrs) != 0 {
+			t.Errorf("empty non-terminal %s: %v, %t", name, rrs, found)
+		}
+	}
+	if _, found := store.hosts["broken.home."]; found {
+		t.Error("host with an invalid address is kept")
+	}
+
+	// without an SOA record the zone is its given origin.
+	if err := store.parseZone(strings.NewReader("web IN A 10.1.0.1\n"), "corp.zone", "Corp.Example"); err != nil {
+		t.Fatal(err)
+	}
+	corp := store.zones[1]
+	if corp.origin != "corp.example." || corp.soa == nil || corp.soa.Hdr.Name != "corp.example." {
+		t.Errorf("origin %s, SOA %v", corp.origin, corp.soa)
+	}
+	if rrs := corp.records["web.corp.example."]; len(rrs) != 1 || rrs[0].Header().Ttl != defaultLocalTTL {
+		t.Errorf("records of web.corp.example. %v", rrs)
+	}
+
+	// neither an origin nor an SOA record.
+	if err := store.parseZone(strings.NewReader("web.example. IN A 10.1.0.1\n"), "none.zone", ""); err != nil || len(store.zones) != 2 {
+		t.Errorf("zone without origin loaded: %v", err)
+	}
+	if err := store.parseZone(strings.NewReader("web IN BOGUS 1\n"), "bad.zone", "bad.example"); err == nil {
+		t.Error("malformed zone file is loaded")
+	}
+}
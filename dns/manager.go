@@ -1,6 +1,9 @@
 package dns
 
 import (
+	"net"
+	"strings"
+
 	"github.com/OpenNHP/StealthDNS/common"
 	"github.com/OpenNHP/StealthDNS/dns/handler"
 	"github.com/OpenNHP/opennhp/nhp/log"
@@ -40,3 +43,28 @@ func (d *Manager) GetUpstreamDNS() string {
 	log.Debug("upstream dns is %s", upstreamDNS)
 	return upstreamDNS
 }
+
+// GetUpstreamDNSList returns every detected system dns server except the stealth dns itself,
+// falling back to the single upstream dns when none was detected.
+func (d *Manager) GetUpstreamDNSList() []string {
+	var upstreamDNSList []string
+	seen := make(map[string]bool)
+	for _, dnsIp := range d.handler.GetUpstreamDNSList() {
+		dnsIp = strings.TrimSpace(dnsIp)
+		if net.ParseIP(dnsIp) == nil || strings.EqualFold(dnsIp, common.StealthDnsIp) || seen[dnsIp] {
+			continue
+		}
+		seen[dnsIp] = true
+		upstreamDNSList = append(upstreamDNSList, dnsIp)
+	}
+	if len(upstreamDNSList) == 0 {
+		upstreamDNSList = append(upstreamDNSList, d.GetUpstreamDNS())
+	}
+	log.Debug("upstream dns list is %v", upstreamDNSList)
+	return upstreamDNSList
+}
+
+// GetWifiSSIDs returns the SSIDs of the connected wireless networks.
+func (d *Manager) GetWifiSSIDs() []string {
+	return d.handler.GetWifiSSIDs()
+}
@@ -0,0 +1,708 @@
+package dns
+
+import (
+	"fmt"
+	"net"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/OpenNHP/opennhp/nhp/log"
+	"github.com/miekg/dns"
+)
+
+// policy rule actions.
+const (
+	PolicyProtect = "protect"
+	PolicyForward = "forward"
+	PolicyBlock   = "block"
+	PolicyRewrite = "rewrite"
+)
+
+const (
+	// policyRouteTable is the table name of the routes decided by policy rules.
+	policyRouteTable = "policy"
+
+	networkRefreshInterval = 30 * time.Second
+)
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// PolicyQuery is what the policy rules match a query on.
+type PolicyQuery struct {
+	Name   string
+	Qtype  uint16
+	Client net.IP
+	Time   time.Time
+}
+
+// PolicyRuleTrace is the outcome of a rule evaluated for a query.
+type PolicyRuleTrace struct {
+	Index   int    `json:"index"`
+	Name    string `json:"name"`
+	Matched bool   `json:"matched"`
+	// Reason is the first condition the query failed.
+	Reason string `json:"reason,omitempty"`
+}
+
+// PolicyExplanation is the dry-run evaluation of a query: the rules evaluated
+// in order up to the matching one, and the resulting route.
+type PolicyExplanation struct {
+	Name       string            `json:"name"`
+	Qtype      string            `json:"qtype"`
+	Client     string            `json:"client"`
+	Time       time.Time         `json:"time"`
+	SSIDs      []string          `json:"ssids"`
+	Interfaces []string          `json:"interfaces"`
+	Rules      []PolicyRuleTrace `json:"rules"`
+	// Rule is the name of the matching rule, empty if none matched.
+	Rule string `json:"rule,omitempty"`
+	// Action is the route of the query, decided by the matching rule or by
+	// the route tables if none matched.
+	Action string `json:"action"`
+	Detail string `json:"detail,omitempty"`
+	Table  string `json:"table,omitempty"`
+}
+
+func (e *PolicyExplanation) String() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "query: %s %s from %s at %s\n", e.Name, e.Qtype, e.Client, e.Time.Format("Mon 15:04"))
+	fmt.Fprintf(&sb, "network: ssids %v, interfaces %v\n", e.SSIDs, e.Interfaces)
+	for _, rule := range e.Rules {
+		if rule.Matched {
+			fmt.Fprintf(&sb, "  #%d %s: matched\n", rule.Index, rule.Name)
+		} else {
+			fmt.Fprintf(&sb, "  #%d %s: %s\n", rule.Index, rule.Name, rule.Reason)
+		}
+	}
+	if len(e.Rule) > 0 {
+		fmt.Fprintf(&sb, "decision: %s %s by rule %s", e.Action, e.Detail, e.Rule)
+	} else if len(e.Table) > 0 {
+		fmt.Fprintf(&sb, "decision: no rule matched, %s %s by route table %s", e.Action, e.Detail, e.Table)
+	} else {
+		fmt.Fprintf(&sb, "decision: no rule matched, %s", e.Action)
+	}
+	return strings.TrimSpace(sb.String())
+}
+
+// timeRange is a range of minutes of the day, a range ending before it starts
+// spans midnight.
+type timeRange struct {
+	from int
+	to   int
+}
+
+func (t timeRange) contains(minute int) bool {
+	if t.from <= t.to {
+		return minute >= t.from && minute < t.to
+	}
+	return minute >= t.from || minute < t.to
+}
+
+// policyRule is a compiled PolicyRule. Empty conditions match any query.
+type policyRule struct {
+	index      int
+	name       string
+	exact      map[string]bool
+	wildcards  []string
+	types      map[uint16]bool
+	clients    []*net.IPNet
+	times      []timeRange
+	days       map[time.Weekday]bool
+	ssids      []string
+	interfaces []string
+
+	action   string
+	resource string
+	upstream string
+	response string
+	rewrite  []string
+	ttl      uint32
+}
+
+// policyEngine evaluates the rules of policy.toml in order, the first
+// matching rule decides the route of a query.
+type policyEngine struct {
+	rules []*policyRule
+}
+
+func newPolicyEngine(conf *PolicyRules) *policyEngine {
+	engine := &policyEngine{}
+	for i, ruleConf := range conf.Rules {
+		rule, err := compilePolicyRule(i+1, ruleConf)
+		if err != nil {
+			log.Error("policy rule %s is invalid, ignored: %v", policyRuleName(i+1, ruleConf), err)
+			continue
+		}
+		engine.rules = append(engine.rules, rule)
+	}
+	log.Info("policy loaded with %d rules", len(engine.rules))
+	return engine
+}
+
+func policyRuleName(index int, conf *PolicyRule) string {
+	if len(conf.Name) > 0 {
+		return conf.Name
+	}
+	return fmt.Sprintf("#%d", index)
+}
+
+func compilePolicyRule(index int, conf *PolicyRule) (*policyRule, error) {
+	rule := &policyRule{
+		index:    index,
+		name:     policyRuleName(index, conf),
+		action:   strings.ToLower(strings.TrimSpace(conf.Action)),
+		resource: strings.ToLower(strings.TrimSpace(conf.Resource)),
+		upstream: strings.ToLower(strings.TrimSpace(conf.Upstream)),
+		response: strings.ToLower(strings.TrimSpace(conf.Response)),
+		ttl:      conf.TTL,
+	}
+
+	for _, domain := range conf.Domains {
+		pattern := normalizeName(strings.TrimSpace(domain))
+		if pattern == "." || pattern == "*." {
+			return nil, fmt.Errorf("invalid domain %q", domain)
+		}
+		if rule.exact == nil {
+			rule.exact = make(map[string]bool)
+		}
+		if suffix, ok := strings.CutPrefix(pattern, "*."); ok {
+			rule.wildcards = append(rule.wildcards, suffix)
+		} else {
+			rule.exact[pattern] = true
+		}
+	}
+	// the most specific wildcard gives the subdomain of a protected name.
+	sort.SliceStable(rule.wildcards, func(i, j int) bool {
+		return dns.CountLabel(rule.wildcards[i]) > dns.CountLabel(rule.wildcards[j])
+	})
+
+	for _, typeName := range conf.Types {
+		qtype, found := dns.StringToType[strings.ToUpper(strings.TrimSpace(typeName))]
+		if !found {
+			return nil, fmt.Errorf("unknown query type %q", typeName)
+		}
+		if rule.types == nil {
+			rule.types = make(map[uint16]bool)
+		}
+		rule.types[qtype] = true
+	}
+
+	for _, client := range conf.Clients {
+		client = strings.TrimSpace(client)
+		if !strings.Contains(client, "/") {
+			ip := net.ParseIP(client)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid client address %q", client)
+			}
+			if ip.To4() != nil {
+				client += "/32"
+			} else {
+				client += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(client)
+		if err != nil {
+			return nil, fmt.Errorf("invalid client network %q", client)
+		}
+		rule.clients = append(rule.clients, network)
+	}
+
+	for _, times := range conf.Times {
+		t, err := parseTimeRange(times)
+		if err != nil {
+			return nil, err
+		}
+		rule.times = append(rule.times, t)
+	}
+
+	for _, day := range conf.Days {
+		weekday, found := weekdays[strings.ToLower(strings.TrimSpace(day))]
+		if !found {
+			return nil, fmt.Errorf("unknown day %q", day)
+		}
+		if rule.days == nil {
+			rule.days = make(map[time.Weekday]bool)
+		}
+		rule.days[weekday] = true
+	}
+
+	for _, ssid := range conf.SSIDs {
+		rule.ssids = append(rule.ssids, strings.TrimSpace(ssid))
+	}
+	for _, iface := range conf.Interfaces {
+		if _, err := path.Match(iface, ""); err != nil {
+			return nil, fmt.Errorf("invalid interface pattern %q", iface)
+		}
+		rule.interfaces = append(rule.interfaces, iface)
+	}
+
+	switch rule.action {
+	case PolicyProtect:
+		if len(rule.resource) == 0 {
+			return nil, fmt.Errorf("protect action without resource")
+		}
+	case PolicyForward:
+	case PolicyBlock:
+		switch rule.response {
+		case "", FailureNXDomain, FailureServFail, FailureRefused, FailureNoData, FailureSinkhole:
+		default:
+			return nil, fmt.Errorf("unknown block response %q", conf.Response)
+		}
+	case PolicyRewrite:
+		rewrite, err := parseRewrite(conf.Rewrite)
+		if err != nil {
+			return nil, err
+		}
+		rule.rewrite = rewrite
+	default:
+		return nil, fmt.Errorf("unknown action %q", conf.Action)
+	}
+	return rule, nil
+}
+
+// parseTimeRange parses "HH:MM-HH:MM", the end is excluded.
+func parseTimeRange(s string) (timeRange, error) {
+	from, to, found := strings.Cut(strings.TrimSpace(s), "-")
+	if !found {
+		return timeRange{}, fmt.Errorf("invalid time range %q", s)
+	}
+	var t timeRange
+	var err error
+	if t.from, err = parseMinute(from); err != nil {
+		return timeRange{}, fmt.Errorf("invalid time range %q", s)
+	}
+	if t.to, err = parseMinute(to); err != nil {
+		return timeRange{}, fmt.Errorf("invalid time range %q", s)
+	}
+	return t, nil
+}
+
+func parseMinute(s string) (int, error) {
+	hour, minute, found := strings.Cut(strings.TrimSpace(s), ":")
+	if !found {
+		return 0, fmt.Errorf("invalid time %q", s)
+	}
+	h, err := strconv.Atoi(hour)
+	if err != nil || h < 0 || h > 24 {
+		return 0, fmt.Errorf("invalid time %q", s)
+	}
+	m, err := strconv.Atoi(minute)
+	if err != nil || m < 0 || m > 59 || (h == 24 && m > 0) {
+		return 0, fmt.Errorf("invalid time %q", s)
+	}
+	return h*60 + m, nil
+}
+
+// parseRewrite validates the rewrite of a rule: addresses, or a single name.
+func parseRewrite(targets []string) ([]string, error) {
+	if len(targets) == 0 {
+		return nil, fmt.Errorf("rewrite action without targets")
+	}
+	var rewrite []string
+	for _, target := range targets {
+		target = strings.TrimSpace(target)
+		if ip := net.ParseIP(target); ip != nil {
+			rewrite = append(rewrite, ip.String())
+			continue
+		}
+		if len(targets) > 1 {
+			return nil, fmt.Errorf("rewrite to %q, a name must be the only target", target)
+		}
+		name := normalizeName(target)
+		if _, ok := dns.IsDomainName(name); !ok || name == "." {
+			return nil, fmt.Errorf("invalid rewrite target %q", target)
+		}
+		rewrite = append(rewrite, name)
+	}
+	return rewrite, nil
+}
+
+// matchDomain reports whether the normalised name matches the domains of the
+// rule, with the labels below the wildcard it matched.
+func (rule *policyRule) matchDomain(name string) (string, bool) {
+	if rule.exact == nil {
+		return "", true
+	}
+	if rule.exact[name] {
+		return "", true
+	}
+	for _, suffix := range rule.wildcards {
+		if subdomain, ok := strings.CutSuffix(name, "."+suffix); ok {
+			return subdomain, true
+		}
+	}
+	return "", false
+}
+
+// match returns the route of a query matching the rule, or nil with the
+// first condition the query failed.
+func (rule *policyRule) match(query *PolicyQuery, name string, network *networkMonitor) (*Route, string) {
+	subdomain, ok := rule.matchDomain(name)
+	if !ok {
+		return nil, fmt.Sprintf("domain %s does not match", name)
+	}
+	if rule.types != nil && !rule.types[query.Qtype] {
+		return nil, fmt.Sprintf("query type %s does not match", dns.TypeToString[query.Qtype])
+	}
+	if rule.clients != nil && !rule.matchClient(query.Client) {
+		return nil, fmt.Sprintf("client %s does not match", query.Client)
+	}
+	if rule.days != nil && !rule.days[query.Time.Weekday()] {
+		return nil, fmt.Sprintf("day %s does not match", query.Time.Weekday())
+	}
+	if rule.times != nil && !rule.matchTime(query.Time) {
+		return nil, fmt.Sprintf("time %s is out of the time ranges", query.Time.Format("15:04"))
+	}
+	if rule.ssids != nil || rule.interfaces != nil {
+		state := network.current()
+		if rule.ssids != nil && !matchAny(rule.ssids, state.ssids, func(pattern, ssid string) bool {
+			return pattern == ssid
+		}) {
+			return nil, fmt.Sprintf("ssids %v do not match", state.ssids)
+		}
+		if rule.interfaces != nil && !matchAny(rule.interfaces, state.interfaces, func(pattern, iface string) bool {
+			matched, _ := path.Match(pattern, iface)
+			return matched
+		}) {
+			return nil, fmt.Sprintf("interfaces %v do not match", state.interfaces)
+		}
+	}
+
+	route := &Route{Table: policyRouteTable, Rule: rule.name}
+	switch rule.action {
+	case PolicyProtect:
+		route.Action = RouteProtected
+		route.ResourceId = rule.resource
+		route.Subdomain = subdomain
+	case PolicyForward:
+		route.Action = RouteForward
+		route.Upstream = rule.upstream
+	case PolicyBlock:
+		route.Action = RouteBlock
+		route.Response = rule.response
+		route.TTL = rule.ttl
+	case PolicyRewrite:
+		route.Action = RouteRewrite
+		route.Rewrite = rule.rewrite
+		route.TTL = rule.ttl
+	}
+	return route, ""
+}
+
+func (rule *policyRule) matchClient(client net.IP) bool {
+	if client == nil {
+		return false
+	}
+	for _, network := range rule.clients {
+		if network.Contains(client) {
+			return true
+		}
+	}
+	return false
+}
+
+func (rule *policyRule) matchTime(t time.Time) bool {
+	minute := t.Hour()*60 + t.Minute()
+	for _, times := range rule.times {
+		if times.contains(minute) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchAny(patterns []string, values []string, match func(pattern, value string) bool) bool {
+	for _, pattern := range patterns {
+		for _, value := range values {
+			if match(pattern, value) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// evaluate returns the route of the first rule matching the query, or nil.
+// The evaluated rules are appended to trace if it is not nil.
+func (engine *policyEngine) evaluate(query *PolicyQuery, network *networkMonitor, trace *[]PolicyRuleTrace) *Route {
+	if engine == nil {
+		return nil
+	}
+	name := normalizeName(query.Name)
+	for _, rule := range engine.rules {
+		route, reason := rule.match(query, name, network)
+		if trace != nil {
+			*trace = append(*trace, PolicyRuleTrace{
+				Index:   rule.index,
+				Name:    rule.name,
+				Matched: route != nil,
+				Reason:  reason,
+			})
+		}
+		if route != nil {
+			return route
+		}
+	}
+	return nil
+}
+
+// explain evaluates a query without answering it. fallback routes the query
+// if no rule matches.
+func (engine *policyEngine) explain(query *PolicyQuery, network *networkMonitor, fallback func(name string, qtype uint16) *Route) *PolicyExplanation {
+	e := &PolicyExplanation{
+		Name:   normalizeName(query.Name),
+		Qtype:  dns.TypeToString[query.Qtype],
+		Client: query.Client.String(),
+		Time:   query.Time,
+		Rules:  []PolicyRuleTrace{},
+	}
+	state := network.current()
+	e.SSIDs, e.Interfaces = state.ssids, state.interfaces
+
+	route := engine.evaluate(query, network, &e.Rules)
+	if route != nil {
+		e.Rule = route.Rule
+	} else if fallback != nil {
+		route = fallback(query.Name, query.Qtype)
+	}
+	if route == nil {
+		e.Action = RouteForward.String()
+		return e
+	}
+	e.Action = route.Action.String()
+	if route.Rule == "" {
+		e.Table = route.Table
+	}
+	switch route.Action {
+	case RouteProtected:
+		e.Detail = "resource " + route.ResourceId
+		if len(route.Subdomain) > 0 {
+			e.Detail += " subdomain " + route.Subdomain
+		}
+	case RouteForward:
+		if len(route.Upstream) > 0 {
+			e.Detail = "upstream group " + route.Upstream
+		}
+	case RouteBlock:
+		e.Detail = route.Response
+		if len(e.Detail) == 0 {
+			e.Detail = "default response"
+		}
+	case RouteRewrite:
+		e.Detail = strings.Join(route.Rewrite, ", ")
+	}
+	return e
+}
+
+// ExplainPolicy evaluates a query by the policy rules, as a dry run. A
+// query matching no rule is routed by the route tables.
+func (p *ProxyService) ExplainPolicy(name string, qtype uint16, client net.IP) *PolicyExplanation {
+	query := &PolicyQuery{Name: name, Qtype: qtype, Client: client, Time: time.Now()}
+	var fallback func(name string, qtype uint16) *Route
+	if p.router != nil {
+		fallback = p.router.Route
+	}
+	return p.policy.Load().explain(query, p.network, fallback)
+}
+
+// ExplainPolicyFile evaluates a query by the rules of a policy file, without
+// a running proxy. The route tables are not consulted.
+func ExplainPolicyFile(file string, query *PolicyQuery) (*PolicyExplanation, error) {
+	rules, err := readPolicyRules(file)
+	if err != nil {
+		return nil, err
+	}
+	manager := NewDNSManager()
+	return newPolicyEngine(rules).explain(query, newNetworkMonitor(manager.GetWifiSSIDs), nil), nil
+}
+
+// routeQuery routes a query by the policy rules, then by the route tables.
+func (p *ProxyService) routeQuery(w dns.ResponseWriter, r *dns.Msg) *Route {
+	question := r.Question[0]
+	query := &PolicyQuery{
+		Name:   question.Name,
+		Qtype:  question.Qtype,
+		Client: clientIP(w.RemoteAddr()),
+		Time:   time.Now(),
+	}
+	if route := p.policy.Load().evaluate(query, p.network, nil); route != nil {
+		return route
+	}
+	return p.router.Route(question.Name, question.Qtype)
+}
+
+func clientIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		return a.IP
+	case *net.TCPAddr:
+		return a.IP
+	default:
+		return nil
+	}
+}
+
+// networkState is the network the host is connected to.
+type networkState struct {
+	ssids      []string
+	interfaces []string
+}
+
+// networkMonitor caches the network state, refreshed in the background once
+// it is older than networkRefreshInterval, so queries never wait for it.
+type networkMonitor struct {
+	ssidFunc   func() []string
+	state      atomic.Pointer[networkState]
+	updated    atomic.Int64
+	refreshing atomic.Bool
+}
+
+func newNetworkMonitor(ssidFunc func() []string) *networkMonitor {
+	return &networkMonitor{ssidFunc: ssidFunc}
+}
+
+func (m *networkMonitor) current() *networkState {
+	state := m.state.Load()
+	if state == nil {
+		return m.refresh()
+	}
+	if time.Since(time.Unix(0, m.updated.Load())) > networkRefreshInterval && m.refreshing.CompareAndSwap(false, true) {
+		go func() {
+			defer m.refreshing.Store(false)
+			m.refresh()
+		}()
+	}
+	return state
+}
+
+func (m *networkMonitor) refresh() *networkState {
+	state := &networkState{
+		ssids:      m.ssidFunc(),
+		interfaces: activeInterfaces(),
+	}
+	m.state.Store(state)
+	m.updated.Store(time.Now().UnixNano())
+	return state
+}
+
+// activeInterfaces returns the names of the interfaces that are up with a
+// routable address.
+func activeInterfaces() []string {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		log.Error("list network interfaces fail: %v", err)
+		return nil
+	}
+	var names []string
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if ipNet, ok := addr.(*net.IPNet); ok && !ipNet.IP.IsLinkLocalUnicast() {
+				names = append(names, iface.Name)
+				break
+			}
+		}
+	}
+	return names
+}
+
+// rewriteWriter captures the answer of a rewrite target, resolved with the
+// original client's address. writeMsg hands it the unshaped answer.
+type rewriteWriter struct {
+	dns.ResponseWriter
+	msg   *dns.Msg
+	depth int
+}
+
+func (w *rewriteWriter) WriteMsg(m *dns.Msg) error {
+	w.msg = m
+	return nil
+}
+
+// rewriteAnswer answers with the addresses of a rewrite route, or with a CNAME
+// to its name followed by the answer of the name, which is routed again.
+func (p *ProxyService) rewriteAnswer(w dns.ResponseWriter, r *dns.Msg, route *Route) {
+	question := r.Question[0]
+	ttl := route.TTL
+	if ttl == 0 {
+		ttl = defaultLocalTTL
+	}
+	m := new(dns.Msg)
+	m.SetReply(r)
+	m.Authoritative = true
+
+	if ip := net.ParseIP(route.Rewrite[0]); ip != nil {
+		hdr := dns.RR_Header{Name: question.Name, Rrtype: question.Qtype, Class: dns.ClassINET, Ttl: ttl}
+		for _, target := range route.Rewrite {
+			ip := net.ParseIP(target)
+			if ip4 := ip.To4(); ip4 != nil && question.Qtype == dns.TypeA {
+				m.Answer = append(m.Answer, &dns.A{Hdr: hdr, A: ip4})
+			} else if ip4 == nil && question.Qtype == dns.TypeAAAA {
+				m.Answer = append(m.Answer, &dns.AAAA{Hdr: hdr, AAAA: ip})
+			}
+		}
+		if len(m.Answer) == 0 {
+			m.Ns = append(m.Ns, negativeSOA(question.Name, ttl))
+		}
+		p.writeMsg(w, r, m)
+		return
+	}
+
+	target := route.Rewrite[0]
+	m.Answer = append(m.Answer, &dns.CNAME{
+		Hdr:    dns.RR_Header{Name: question.Name, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: ttl},
+		Target: target,
+	})
+	if question.Qtype == dns.TypeCNAME {
+		p.writeMsg(w, r, m)
+		return
+	}
+
+	depth := 0
+	if rw, ok := w.(*rewriteWriter); ok {
+		depth = rw.depth + 1
+	}
+	if depth >= maxCNAMEChain {
+		log.Warning("domain :%s rewrite chain is too long, last rewritten to %s", question.Name, target)
+		m := new(dns.Msg)
+		m.SetRcode(r, dns.RcodeServerFailure)
+		p.writeMsg(w, r, m)
+		return
+	}
+	sub := r.Copy()
+	sub.Question[0].Name = target
+	targetWriter := &rewriteWriter{ResponseWriter: w, depth: depth}
+	p.serve(targetWriter, sub)
+	if resp := targetWriter.msg; resp == nil || resp.Rcode == dns.RcodeServerFailure || resp.Rcode == dns.RcodeRefused {
+		// a failed target fails the rewritten name too.
+		m := new(dns.Msg)
+		m.SetRcode(r, dns.RcodeServerFailure)
+		p.writeMsg(w, r, m)
+		return
+	}
+	resp := targetWriter.msg
+	m.Rcode = resp.Rcode
+	m.Truncated = resp.Truncated
+	m.Answer = append(m.Answer, resp.Answer...)
+	m.Ns = append(m.Ns, resp.Ns...)
+	m.Extra = append(m.Extra, resp.Extra...)
+	p.writeMsg(w, r, m)
+}
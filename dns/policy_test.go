@@ -0,0 +1,524 @@
+package dns
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// recordWriter is a udp client connection recording the answer.
+type recordWriter struct {
+	remote net.Addr
+	msg    *dns.Msg
+}
+
+func newRecordWriter(client string) *recordWriter {
+	return &recordWriter{remote: &net.UDPAddr{IP: net.ParseIP(client), Port: 5353}}
+}
+
+func (w *recordWriter) LocalAddr() net.Addr {
+	return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 53}
+}
+func (w *recordWriter) RemoteAddr() net.Addr      { return w.remote }
+func (w *recordWriter) WriteMsg(m *dns.Msg) error { w.msg = m; return nil }
+func (w *recordWriter) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+func (w *recordWriter) Close() error        { return nil }
+func (w *recordWriter) TsigStatus() error   { return nil }
+func (w *recordWriter) TsigTimersOnly(bool) {}
+func (w *recordWriter) Hijack()             {}
+
+// testNetwork is a network monitor with a fixed state.
+func testNetwork(ssids, interfaces []string) *networkMonitor {
+	m := newNetworkMonitor(func() []string { return ssids })
+	m.state.Store(&networkState{ssids: ssids, interfaces: interfaces})
+	m.updated.Store(time.Now().Add(time.Hour).UnixNano())
+	return m
+}
+
+func TestCompilePolicyRule(t *testing.T) {
+	tests := []struct {
+		name    string
+		rule    PolicyRule
+		wantErr string
+	}{
+		{name: "forward", rule: PolicyRule{Action: "Forward", Domains: []string{"*.corp.example"}, Upstream: "corp"}},
+		{name: "protect", rule: PolicyRule{Action: "protect", Resource: "demo"}},
+		{name: "block", rule: PolicyRule{Action: "block", Response: "Sinkhole"}},
+		{name: "rewrite addresses", rule: PolicyRule{Action: "rewrite", Rewrite: []string{"10.0.0.1", "2001:db8::1"}}},
+		{name: "rewrite name", rule: PolicyRule{Action: "rewrite", Rewrite: []string{"target.example"}}},
+		{name: "all conditions", rule: PolicyRule{
+			Action:     "block",
+			Domains:    []string{"example.com", "*.example.org"},
+			Types:      []string{"a", "AAAA"},
+			Clients:    []string{"192.0.2.1", "10.0.0.0/8", "2001:db8::/32"},
+			Times:      []string{"09:00-17:00", "22:00-24:00"},
+			Days:       []string{"Mon", "sat"},
+			SSIDs:      []string{"home"},
+			Interfaces: []string{"utun*"},
+		}},
+		{name: "root domain", rule: PolicyRule{Action: "block", Domains: []string{"."}}, wantErr: "invalid domain"},
+		{name: "root wildcard", rule: PolicyRule{Action: "block", Domains: []string{"*"}}, wantErr: "invalid domain"},
+		{name: "type", rule: PolicyRule{Action: "block", Types: []string{"BOGUS"}}, wantErr: "unknown query type"},
+		{name: "client", rule: PolicyRule{Action: "block", Clients: []string{"host"}}, wantErr: "invalid client address"},
+		{name: "network", rule: PolicyRule{Action: "block", Clients: []string{"10.0.0.0/33"}}, wantErr: "invalid client network"},
+		{name: "time", rule: PolicyRule{Action: "block", Times: []string{"9-17"}}, wantErr: "invalid time range"},
+		{name: "day", rule: PolicyRule{Action: "block", Days: []string{"monday"}}, wantErr: "unknown day"},
+		{name: "interface", rule: PolicyRule{Action: "block", Interfaces: []string{"eth["}}, wantErr: "invalid interface pattern"},
+		{name: "protect without resource", rule: PolicyRule{Action: "protect"}, wantErr: "without resource"},
+		{name: "block response", rule: PolicyRule{Action: "block", Response: "drop"}, wantErr: "unknown block response"},
+		{name: "rewrite without targets", rule: PolicyRule{Action: "rewrite"}, wantErr: "without targets"},
+		{name: "rewrite names", rule: PolicyRule{Action: "rewrite", Rewrite: []string{"10.0.0.1", "a.example"}}, wantErr: "must be the only target"},
+		{name: "action", rule: PolicyRule{Action: "drop"}, wantErr: "unknown action"},
+	}
+	for _, tt := range tests {
+		rule, err := compilePolicyRule(1, &tt.rule)
+		if len(tt.wantErr) == 0 {
+			if err != nil || rule == nil {
+				t.Errorf("%s: %v", tt.name, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("%s: error %v, want %q", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestPolicyMatchDomain(t *testing.T) {
+	rule, err := compilePolicyRule(1, &PolicyRule{
+		Action:  "forward",
+		Domains: []string{"Exact.Example.com", "*.example.org", "*.deep.example.org"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name      string
+		match     bool
+		subdomain string
+	}{
+		{name: "exact.example.com.", match: true},
+		{name: "www.exact.example.com.", match: false},
+		{name: "example.org.", match: false},
+		{name: "www.example.org.", match: true, subdomain: "www"},
+		{name: "a.b.example.org.", match: true, subdomain: "a.b"},
+		// the most specific wildcard gives the subdomain.
+		{name: "a.deep.example.org.", match: true, subdomain: "a"},
+		{name: "badexample.org.", match: false},
+	}
+	for _, tt := range tests {
+		subdomain, match := rule.matchDomain(tt.name)
+		if match != tt.match || subdomain != tt.subdomain {
+			t.Errorf("matchDomain(%s) = %q, %t, want %q, %t", tt.name, subdomain, match, tt.subdomain, tt.match)
+		}
+	}
+
+	all, _ := compilePolicyRule(2, &PolicyRule{Action: "forward"})
+	if _, match := all.matchDomain("anything.example."); !match {
+		t.Error("rule without domains does not match any name")
+	}
+}
+
+func TestParseTimeRange(t *testing.T) {
+	tests := []struct {
+		times   string
+		in      []string
+		out     []string
+		wantErr bool
+	}{
+		{times: "09:00-17:30", in: []string{"09:00", "12:00", "17:29"}, out: []string{"08:59", "17:30", "23:00"}},
+		// a range ending before it starts spans midnight.
+		{times: "22:00-06:00", in: []string{"22:00", "23:59", "00:00", "05:59"}, out: []string{"06:00", "12:00", "21:59"}},
+		{times: " 20:00 - 24:00 ", in: []string{"20:00", "23:59"}, out: []string{"00:00", "19:59"}},
+		{times: "00:00-24:00", in: []string{"00:00", "12:00", "23:59"}},
+		{times: "10:00-10:00", out: []string{"10:00", "11:00"}},
+		{times: "9:00", wantErr: true},
+		{times: "09:00-25:00", wantErr: true},
+		{times: "24:30-01:00", wantErr: true},
+		{times: "09:60-10:00", wantErr: true},
+		{times: "09-10", wantErr: true},
+		{times: "ab:00-10:00", wantErr: true},
+	}
+	for _, tt := range tests {
+		r, err := parseTimeRange(tt.times)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseTimeRange(%q) error %v", tt.times, err)
+			continue
+		}
+		for _, clock := range tt.in {
+			if minute, _ := parseMinute(clock); !r.contains(minute) {
+				t.Errorf("%q does not contain %s", tt.times, clock)
+			}
+		}
+		for _, clock := range tt.out {
+			if minute, _ := parseMinute(clock); r.contains(minute) {
+				t.Errorf("%q contains %s", tt.times, clock)
+			}
+		}
+	}
+}
+
+func TestPolicyConditions(t *testing.T) {
+	// 2024-01-06 is a Saturday.
+	saturday := time.Date(2024, 1, 6, 23, 30, 0, 0, time.Local)
+	network := testNetwork([]string{"Home WiFi"}, []string{"eth0", "utun3"})
+	tests := []struct {
+		name   string
+		rule   PolicyRule
+		query  PolicyQuery
+		match  bool
+		reason string
+	}{
+		{
+			name:   "type",
+			rule:   PolicyRule{Types: []string{"AAAA"}},
+			query:  PolicyQuery{Qtype: dns.TypeA},
+			reason: "query type A",
+		},
+		{
+			name:  "client network",
+			rule:  PolicyRule{Clients: []string{"10.0.0.0/8", "2001:db8::1"}},
+			query: PolicyQuery{Client: net.ParseIP("10.1.2.3")},
+			match: true,
+		},
+		{
+			name:  "client v6 address",
+			rule:  PolicyRule{Clients: []string{"10.0.0.0/8", "2001:db8::1"}},
+			query: PolicyQuery{Client: net.ParseIP("2001:db8::1")},
+			match: true,
+		},
+		{
+			name:   "other client",
+			rule:   PolicyRule{Clients: []string{"10.0.0.0/8"}},
+			query:  PolicyQuery{Client: net.ParseIP("192.168.1.1")},
+			reason: "client 192.168.1.1",
+		},
+		{
+			name:   "unknown client",
+			rule:   PolicyRule{Clients: []string{"10.0.0.0/8"}},
+			query:  PolicyQuery{},
+			reason: "client <nil>",
+		},
+		{
+			name:  "day",
+			rule:  PolicyRule{Days: []string{"sat", "sun"}},
+			query: PolicyQuery{Time: saturday},
+			match: true,
+		},
+		{
+			name:   "other day",
+			rule:   PolicyRule{Days: []string{"mon"}},
+			query:  PolicyQuery{Time: saturday},
+			reason: "day Saturday",
+		},
+		{
+			name:  "time across midnight",
+			rule:  PolicyRule{Times: []string{"08:00-09:00", "22:00-07:00"}},
+			query: PolicyQuery{Time: saturday},
+			match: true,
+		},
+		{
+			name:   "time",
+			rule:   PolicyRule{Times: []string{"08:00-17:00"}},
+			query:  PolicyQuery{Time: saturday},
+			reason: "time 23:30",
+		},
+		{
+			name:  "ssid",
+			rule:  PolicyRule{SSIDs: []string{"Office", "Home WiFi"}},
+			match: true,
+		},
+		{
+			name:   "ssids are exact",
+			rule:   PolicyRule{SSIDs: []string{"home wifi"}},
+			reason: "ssids [Home WiFi]",
+		},
+		{
+			name:  "interface glob",
+			rule:  PolicyRule{Interfaces: []string{"utun*"}},
+			match: true,
+		},
+		{
+			name:   "other interfaces",
+			rule:   PolicyRule{Interfaces: []string{"wg?"}},
+			reason: "interfaces [eth0 utun3]",
+		},
+	}
+	for _, tt := range tests {
+		tt.rule.Action = "forward"
+		rule, err := compilePolicyRule(1, &tt.rule)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		query := tt.query
+		query.Name = "www.example.com"
+		if query.Qtype == 0 {
+			query.Qtype = dns.TypeA
+		}
+		if query.Time.IsZero() {
+			query.Time = saturday
+		}
+		route, reason := rule.match(&query, normalizeName(query.Name), network)
+		if (route != nil) != tt.match || !strings.HasPrefix(reason, tt.reason) {
+			t.Errorf("%s: route %v reason %q, want match %t reason %q", tt.name, route, reason, tt.match, tt.reason)
+		}
+	}
+}
+
+func TestPolicyFirstMatch(t *testing.T) {
+	engine := newPolicyEngine(&PolicyRules{Rules: []*PolicyRule{
+		{Name: "lab", Domains: []string{"*.lab.example.com"}, Action: "rewrite", Rewrite: []string{"10.0.0.1"}, TTL: 30},
+		{Name: "kids", Domains: []string{"*.example.com"}, Clients: []string{"192.168.1.0/24"}, Action: "block", Response: "refused"},
+		{Domains: []string{"*.example.com"}, Action: "forward", Upstream: "corp"},
+		{Name: "app", Domains: []string{"*.app.example.net"}, Action: "protect", Resource: "App"},
+		{Name: "broken", Action: "drop"},
+		{Name: "all", Action: "block"},
+	}})
+	network := testNetwork(nil, nil)
+	tests := []struct {
+		name   string
+		client string
+		rule   string
+		action RouteAction
+		trace  int
+	}{
+		{name: "www.lab.example.com", client: "192.168.1.2", rule: "lab", action: RouteRewrite, trace: 1},
+		{name: "www.example.com", client: "192.168.1.2", rule: "kids", action: RouteBlock, trace: 2},
+		{name: "www.example.com", client: "10.0.0.2", rule: "#3", action: RouteForward, trace: 3},
+		{name: "api.v1.app.example.net", client: "10.0.0.2", rule: "app", action: RouteProtected, trace: 4},
+		// the invalid rule is dropped.
+		{name: "example.org", client: "10.0.0.2", rule: "all", action: RouteBlock, trace: 5},
+	}
+	for _, tt := range tests {
+		var trace []PolicyRuleTrace
+		query := &PolicyQuery{Name: tt.name, Qtype: dns.TypeA, Client: net.ParseIP(tt.client), Time: time.Now()}
+		route := engine.evaluate(query, network, &trace)
+		if route == nil || route.Rule != tt.rule || route.Action != tt.action || route.Table != policyRouteTable {
+			t.Errorf("%s from %s: route %+v, want %s by %s", tt.name, tt.client, route, tt.action, tt.rule)
+			continue
+		}
+		if len(trace) != tt.trace || !trace[len(trace)-1].Matched {
+			t.Errorf("%s from %s: trace %+v", tt.name, tt.client, trace)
+		}
+	}
+
+	route := engine.evaluate(&PolicyQuery{Name: "www.example.com", Client: net.ParseIP("10.0.0.2"), Time: time.Now()}, network, nil)
+	if route.Upstream != "corp" {
+		t.Errorf("forward route to %q, want corp", route.Upstream)
+	}
+	route = engine.evaluate(&PolicyQuery{Name: "api.v1.app.example.net", Time: time.Now()}, network, nil)
+	if route.ResourceId != "app" || route.Subdomain != "api.v1" {
+		t.Errorf("protect route of resource %q subdomain %q", route.ResourceId, route.Subdomain)
+	}
+	var nilEngine *policyEngine
+	if route := nilEngine.evaluate(&PolicyQuery{Name: "example.com"}, network, nil); route != nil {
+		t.Errorf("route %+v without a policy", route)
+	}
+}
+
+// testRewriteProxy is a proxy routing by rules, with the local store answering
+// the rewrite targets of the lab zone.
+func testRewriteProxy(t *testing.T, rules ...*PolicyRule) *ProxyService {
+	p := &ProxyService{router: NewDomainRouter(), network: testNetwork(nil, nil)}
+	p.edns.Store(newEDNSPolicy(&EDNSConfig{}))
+	p.policy.Store(newPolicyEngine(&PolicyRules{Rules: rules}))
+	store := &localStore{ttl: defaultLocalTTL, hosts: make(map[string][]dns.RR)}
+	if err := store.parseZone(strings.NewReader(testZone), "lab.zone", ""); err != nil {
+		t.Fatal(err)
+	}
+	p.local.Store(store)
+	p.router.SetTable(localRouteTable, RoutePriorityLocal, RouteTableFunc(p.routeLocal))
+	return p
+}
+
+func TestRewriteAnswer(t *testing.T) {
+	p := testRewriteProxy(t,
+		&PolicyRule{Name: "ip", Domains: []string{"ip.example"}, Action: "rewrite", Rewrite: []string{"192.0.2.1", "2001:db8::1"}, TTL: 30},
+		&PolicyRule{Name: "alias", Domains: []string{"alias.example"}, Action: "rewrite", Rewrite: []string{"ip.example"}},
+		&PolicyRule{Name: "chain", Domains: []string{"chain.example"}, Action: "rewrite", Rewrite: []string{"alias.example"}},
+		&PolicyRule{Name: "local", Domains: []string{"lab.example"}, Action: "rewrite", Rewrite: []string{"www.lab.example.com"}},
+		&PolicyRule{Name: "missing", Domains: []string{"missing.example"}, Action: "rewrite", Rewrite: []string{"missing.lab.example.com"}},
+		&PolicyRule{Name: "loop1", Domains: []string{"loop1.example"}, Action: "rewrite", Rewrite: []string{"loop2.example"}},
+		&PolicyRule{Name: "loop2", Domains: []string{"loop2.example"}, Action: "rewrite", Rewrite: []string{"loop1.example"}},
+	)
+	tests := []struct {
+		name   string
+		qtype  uint16
+		rcode  int
+		answer []string
+		ns     int
+	}{
+		{name: "ip.example.", qtype: dns.TypeA, answer: []string{"ip.example.\t30\tIN\tA\t192.0.2.1"}},
+		{name: "ip.example.", qtype: dns.TypeAAAA, answer: []string{"ip.example.\t30\tIN\tAAAA\t2001:db8::1"}},
+		{name: "ip.example.", qtype: dns.TypeMX, ns: 1},
+		{name: "alias.example.", qtype: dns.TypeA, answer: []string{
+			"alias.example.\t60\tIN\tCNAME\tip.example.",
+			"ip.example.\t30\tIN\tA\t192.0.2.1",
+		}},
+		{name: "alias.example.", qtype: dns.TypeCNAME, answer: []string{"alias.example.\t60\tIN\tCNAME\tip.example."}},
+		// a rewrite target is routed again, by the rules and the route tables.
+		{name: "chain.example.", qtype: dns.TypeA, answer: []string{
+			"chain.example.\t60\tIN\tCNAME\talias.example.",
+			"alias.example.\t60\tIN\tCNAME\tip.example.",
+			"ip.example.\t30\tIN\tA\t192.0.2.1",
+		}},
+		{name: "lab.example.", qtype: dns.TypeA, answer: []string{
+			"lab.example.\t60\tIN\tCNAME\twww.lab.example.com.",
+			"www.lab.example.com.\t300\tIN\tCNAME\tweb.lab.example.com.",
+			"web.lab.example.com.\t300\tIN\tA\t10.0.0.2",
+		}},
+		{name: "missing.example.", qtype: dns.TypeA, rcode: dns.RcodeNameError, answer: []string{
+			"missing.example.\t60\tIN\tCNAME\tmissing.lab.example.com.",
+		}, ns: 1},
+		// the chain depth is limited.
+		{name: "loop1.example.", qtype: dns.TypeA, rcode: dns.RcodeServerFailure},
+	}
+	for _, tt := range tests {
+		w := newRecordWriter("127.0.0.1")
+		p.serve(w, testQuery(tt.name, tt.qtype))
+		m := w.msg
+		if m == nil {
+			t.Fatalf("%s %s: no answer", tt.name, dns.Type(tt.qtype))
+		}
+		var answer []string
+		for _, rr := range m.Answer {
+			answer = append(answer, rr.String())
+		}
+		if m.Rcode != tt.rcode || strings.Join(answer, "\n") != strings.Join(tt.answer, "\n") || len(m.Ns) != tt.ns {
+			t.Errorf("%s %s: %s answer\n%s\nauthority %v", tt.name, dns.Type(tt.qtype), dns.RcodeToString[m.Rcode], strings.Join(answer, "\n"), m.Ns)
+		}
+	}
+}
+
+func TestRewriteAnswerOverUDP(t *testing.T) {
+	p := testRewriteProxy(t,
+		&PolicyRule{Name: "cdn", Domains: []string{"cdn.example"}, Action: "rewrite", Rewrite: []string{"big.example.net"}},
+	)
+	p.forwardCache = newForwardCache(&CacheConfig{})
+	upstream := &funcUpstream{answer: func(r *dns.Msg) (*dns.Msg, error) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		for i := 1; i <= 100; i++ {
+			rr, _ := dns.NewRR(fmt.Sprintf("%s 300 IN A 192.0.2.%d", r.Question[0].Name, i))
+			m.Answer = append(m.Answer, rr)
+		}
+		return m, nil
+	}}
+	p.upstreams.Store(&upstreamRouter{
+		defaultPool: NewUpstreamPool("", []Upstream{upstream}),
+		groups:      make(map[string]*UpstreamPool),
+	})
+
+	for _, size := range []uint16{0, 1232} {
+		r := testQuery("cdn.example.", dns.TypeA)
+		if size > 0 {
+			r.SetEdns0(size, false)
+		}
+		w := newRecordWriter("127.0.0.1")
+		p.serve(w, r)
+		m := w.msg
+		limit := max(dns.MinMsgSize, int(size))
+		if m == nil || !m.Truncated || m.Len() > limit {
+			t.Fatalf("size %d: answer %v, want truncated to %d bytes", size, m, limit)
+		}
+		// the merged answer is shaped once, filling the payload size.
+		if len(m.Answer) == 0 || m.Answer[0].Header().Rrtype != dns.TypeCNAME || m.Len()+16 <= limit {
+			t.Errorf("size %d: %d records in %d bytes, want the cname and the addresses filling %d bytes", size, len(m.Answer), m.Len(), limit)
+		}
+		opts := 0
+		for _, rr := range m.Extra {
+			if rr.Header().Rrtype == dns.TypeOPT {
+				opts++
+			}
+		}
+		if want := min(int(size), 1); opts != want {
+			t.Errorf("size %d: %d OPT records, want %d", size, opts, want)
+		}
+	}
+
+	// the answer of the target is merged before it is shaped.
+	r := testQuery("big.example.net.", dns.TypeA)
+	resp, _ := upstream.Exchange(r)
+	targetWriter := &rewriteWriter{ResponseWriter: newRecordWriter("127.0.0.1")}
+	p.writeMsg(targetWriter, r, resp)
+	if m := targetWriter.msg; m == nil || m.Truncated || len(m.Answer) != 100 {
+		t.Errorf("rewrite target answer is shaped: %v", m)
+	}
+}
+
+func TestExplainPolicyFile(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "policy.toml")
+	content := `[[Rules]]
+Name = "kids"
+Domains = ["*.games.example"]
+Clients = ["192.168.1.0/24"]
+Action = "block"
+
+[[Rules]]
+Name = "corp"
+Domains = ["*.corp.example"]
+Action = "forward"
+Upstream = "corp"
+`
+	if err := os.WriteFile(file, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	at := time.Date(2024, 1, 6, 23, 30, 0, 0, time.Local)
+	tests := []struct {
+		query PolicyQuery
+		lines []string
+	}{
+		{
+			query: PolicyQuery{Name: "www.corp.example", Qtype: dns.TypeA, Client: net.ParseIP("192.168.1.2"), Time: at},
+			lines: []string{
+				"query: www.corp.example. A from 192.168.1.2 at Sat 23:30",
+				"  #1 kids: domain www.corp.example. does not match",
+				"  #2 corp: matched",
+				"decision: forward upstream group corp by rule corp",
+			},
+		},
+		{
+			query: PolicyQuery{Name: "x.games.example", Qtype: dns.TypeAAAA, Client: net.ParseIP("10.0.0.1"), Time: at},
+			lines: []string{
+				"query: x.games.example. AAAA from 10.0.0.1 at Sat 23:30",
+				"  #1 kids: client 10.0.0.1 does not match",
+				"  #2 corp: domain x.games.example. does not match",
+				"decision: no rule matched, forward",
+			},
+		},
+	}
+	for _, tt := range tests {
+		e, err := ExplainPolicyFile(file, &tt.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines := strings.Split(e.String(), "\n")
+		// the second line is the network state of the host.
+		if len(lines) != len(tt.lines)+1 || !strings.HasPrefix(lines[1], "network: ") {
+			t.Errorf("explanation of %s:\n%s", tt.query.Name, e)
+			continue
+		}
+		lines = append(lines[:1], lines[2:]...)
+		if strings.Join(lines, "\n") != strings.Join(tt.lines, "\n") {
+			t.Errorf("explanation of %s:\n%s\nwant\n%s", tt.query.Name, strings.Join(lines, "\n"), strings.Join(tt.lines, "\n"))
+		}
+	}
+
+	if _, err := ExplainPolicyFile(filepath.Join(t.TempDir(), "missing.toml"), &tests[0].query); err != nil {
+		t.Errorf("missing policy file: %v", err)
+	}
+	if err := os.WriteFile(file, []byte("[[Rules]\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ExplainPolicyFile(file, &tests[0].query); err == nil {
+		t.Error("malformed policy file is explained")
+	}
+}
@@ -2,12 +2,11 @@ package dns
 
 import (
 	"encoding/json"
-	"errors"
 	"fmt"
+	"io"
 	"net"
 	"os"
 	"path/filepath"
-	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -31,10 +30,30 @@ type ProxyService struct {
 	localIp    string
 	localMac   string
 
-	server *dns.Server
-
-	upstreamDNS string
-	dnsCache    *StealthDNSCache
+	servers     map[string]dnsListener
+	serversLock sync.Mutex
+
+	systemDNS []string
+	upstreams atomic.Pointer[upstreamRouter]
+	dnsCache  *StealthDNSCache
+
+	forwardCache *forwardCache
+	reknock      *reknockScheduler
+	roundRobin   atomic.Uint32
+	router       *DomainRouter
+	reverse      *reverseTable
+	blocklist    *blocklist
+	policy       atomic.Pointer[policyEngine]
+	network      *networkMonitor
+
+	local        atomic.Pointer[localStore]
+	localLock    sync.Mutex
+	localWatches []io.Closer
+	failure      atomic.Pointer[failurePolicy]
+	edns         atomic.Pointer[ednsPolicy]
+	dnssec       atomic.Pointer[dnssecValidator]
+	queryLog     atomic.Pointer[queryLog]
+	admin        atomic.Pointer[adminServer]
 
 	domainMap     map[string]string
 	domainMapLock sync.Mutex
@@ -57,18 +76,41 @@ func (p *ProxyService) Start(dirPath string, logLevel int) (err error) {
 	if err != nil {
 		return err
 	}
-	p.dnsCache = NewStealthDNSCache(time.Duration(10) * time.Second)
+	p.dnsCache = NewStealthDNSCache(time.Duration(10)*time.Second, 0)
+	p.dnsCache.StartJanitor(cacheCleanupInterval)
+	p.forwardCache = newForwardCache(&p.config.Cache)
+	p.forwardCache.cache.StartJanitor(cacheCleanupInterval)
+	p.reknock = newReknockScheduler(&p.config.Reknock)
+
+	p.router = NewDomainRouter()
+	p.router.SetTable(nhpRouteTable, RoutePriorityProtected, RouteTableFunc(p.routeNhpZone))
+	p.reverse = newReverseTable()
+	p.reverse.startJanitor(cacheCleanupInterval)
+	p.router.SetTable(reverseRouteTable, RoutePriorityLocal, RouteTableFunc(p.routeReverse))
+	p.router.SetTable(localRouteTable, RoutePriorityLocal, RouteTableFunc(p.routeLocal))
+	p.loadLocalData(&p.config.Local)
+	p.blocklist = newBlocklist()
+	p.blocklist.setConfig(&p.config.Block)
+	p.router.SetTable(blockRouteTable, RoutePriorityBlock, RouteTableFunc(p.routeBlock))
 
 	err = p.loadResources()
 	if err != nil {
 		return err
 	}
+	p.network = newNetworkMonitor(func() []string {
+		if p.dnsManager == nil {
+			return nil
+		}
+		return p.dnsManager.GetWifiSSIDs()
+	})
+	p.loadPolicy()
 
 	p.dnsManager = NewDNSManager()
 	if !p.dnsManager.SetStealthDNS() {
 		log.Warning("Stealth DNS setup failed. Please ensure the DNS proxy address 127.0.0.1 is set as the alternate DNS.")
 	}
-	p.upstreamDNS = p.dnsManager.GetUpstreamDNS()
+	p.systemDNS = p.dnsManager.GetUpstreamDNSList()
+	p.upstreams.Store(p.newUpstreamRouter(&p.config.Upstream))
 	p.nhpAgent, err = agent.NewNhpAgent(dirPath)
 	if err != nil {
 		log.Error("init nhp-agent fail: %v", err)
@@ -78,26 +120,14 @@ func (p *ProxyService) Start(dirPath string, logLevel int) (err error) {
 	if err != nil {
 		return err
 	}
-	listenAddr := fmt.Sprintf("%s:%d", common.StealthDnsIp, common.DnsUdpPort)
-
-	p.server = &dns.Server{
-		Addr:    listenAddr,
-		Net:     "udp",
-		Handler: p,
-	}
-	go p.startServer()
+	// all udp and tcp listeners share the same handler, tcp serves clients
+	// retrying after a truncated udp answer.
+	p.bindListeners(&p.config.Listen, true)
+	p.admin.Store(p.newAdminServer(&p.config.Admin))
 	p.running.Store(true)
 	return nil
 }
 
-func (p *ProxyService) startServer() {
-	err := p.server.ListenAndServe()
-	if err != nil {
-		log.Error("dns server listen fail: %v", err)
-		p.Stop()
-	}
-}
-
 func (p *ProxyService) Stop() {
 	if p.running.Load() {
 		if !p.running.CompareAndSwap(true, false) {
@@ -114,9 +144,14 @@ func (p *ProxyService) Stop() {
 	if p.nhpAgent != nil {
 		_ = p.nhpAgent.AgentClose()
 	}
-	if p.server != nil {
-		_ = p.server.Shutdown()
-	}
+	p.shutdownListeners()
+	p.dnsCache.StopJanitor()
+	p.forwardCache.cache.StopJanitor()
+	p.reverse.stopJanitor()
+	p.reknock.stop()
+	p.blocklist.close()
+	p.queryLog.Load().close()
+	p.admin.Load().close()
 	log.Info("===========================")
 	log.Info("=== Stealth DNS stopped ===")
 	log.Info("===========================")
@@ -125,118 +160,169 @@ func (p *ProxyService) Stop() {
 }
 
 func (p *ProxyService) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
+	if l := p.queryLog.Load(); l != nil {
+		w = l.writer(w, r)
+	}
+	if len(r.Question) == 0 {
+		m := new(dns.Msg)
+		m.SetRcode(r, dns.RcodeFormatError)
+		go p.writeMsg(w, r, m)
+		return
+	}
+	if opt := r.IsEdns0(); opt != nil && opt.Version() != 0 {
+		go p.badVersion(w, r)
+		return
+	}
+	go p.serve(w, r)
+}
+
+// serve answers r by its route.
+func (p *ProxyService) serve(w dns.ResponseWriter, r *dns.Msg) {
 	domainName := r.Question[0].Name
-	log.Debug("domain name：%s, question type：%s", domainName, dns.TypeToString[r.Question[0].Qtype])
-	if strings.Contains(domainName, common.NhpDomainNameSuffix) {
-		resId := domainName[:strings.Index(domainName, common.NhpDomainNameSuffix)]
-		if r.Question[0].Qtype == common.Type_A || r.Question[0].Qtype == common.Type_AAAA {
-			// only process domain name resolution requests of type A or AAAA
-			go p.nhpServer(w, r, resId)
-		} else {
-			go p.noAnswer(w, r)
+	qtype := r.Question[0].Qtype
+	log.Debug("domain name：%s, question type：%s", domainName, dns.TypeToString[qtype])
+	if r.Question[0].Qclass == dns.ClassCHAOS {
+		p.refuseChaos(w, r)
+		return
+	}
+
+	route := p.routeQuery(w, r)
+	logQueryRoute(w, route)
+	if len(route.Rule) > 0 {
+		log.Debug("domain :%s routed to %s by policy rule %s", domainName, route.Action, route.Rule)
+	}
+	switch route.Action {
+	case RouteProtected:
+		switch qtype {
+		case dns.TypeANY:
+			p.anyAnswer(w, r)
+		case dns.TypeA, dns.TypeAAAA, dns.TypeSRV, dns.TypeHTTPS, dns.TypeSVCB, dns.TypeTXT:
+			// only process the record types synthesized from the knock answer
+			p.nhpServer(w, r, route)
+		default:
+			// real domains forward the other types, .nhp names have none.
+			p.noAnswer(w, r)
 		}
-	} else {
-		go p.forwardUpstreamDNS(w, r)
+	case RouteBlock:
+		log.Debug("domain :%s blocked by route table %s", domainName, route.Table)
+		p.blockAnswer(w, r, route)
+	case RouteLocal:
+		log.Debug("domain :%s answered locally by route table %s", domainName, route.Table)
+		route.Handler.ServeDNS(w, r)
+	case RouteRewrite:
+		p.rewriteAnswer(w, r, route)
+	default:
+		p.forwardUpstreamDNS(w, r, route.Upstream)
 	}
 }
 
-func (p *ProxyService) forwardUpstreamDNS(w dns.ResponseWriter, r *dns.Msg) {
-	// forward to upstream DNS
+// Router returns the domain router, more route tables may be added to it.
+func (p *ProxyService) Router() *DomainRouter {
+	return p.router
+}
 
-	client := &dns.Client{
-		Timeout: 5 * time.Second,
+// forwardUpstreamDNS forwards r to the upstream group, or to the group
+// selected by the forward rules if group is empty.
+func (p *ProxyService) forwardUpstreamDNS(w dns.ResponseWriter, r *dns.Msg, group string) {
+	subnet := p.edns.Load().cacheSubnet(r)
+	if m := p.forwardCache.get(r, group, subnet); m != nil {
+		log.Debug("domain :%s answered from cache", r.Question[0].Name)
+		logQueryUpstream(w, "", true)
+		p.writeMsg(w, r, dnssecReply(r, m))
+		return
 	}
-	resp, _, err := client.Exchange(r, p.upstreamDNS+":53")
+
+	// validate unless the client checks itself, RFC 4035 section 3.2.2.
+	validator := p.dnssec.Load()
+	query := r
+	if validator != nil && !r.CheckingDisabled {
+		query = validator.query(r)
+	}
+
+	// forward to upstream DNS
+	resp, upstream, err := p.exchangeUpstream(query, group)
 	if err != nil {
 		log.Warning("domain :%s request upstream DNS fail: %v", r.Question[0].Name, err)
 		m := new(dns.Msg)
 		m.SetRcode(r, dns.RcodeServerFailure)
-		_ = w.WriteMsg(m)
+		p.writeMsg(w, r, m)
 		return
 	}
+	log.Debug("domain :%s answered by upstream DNS %s", r.Question[0].Name, upstream)
+	logQueryUpstream(w, upstream, false)
+	if query != r {
+		resp = validator.validate(r, resp)
+	}
+	p.forwardCache.set(r, group, subnet, resp)
 	resp.Id = r.Id
-	_ = w.WriteMsg(resp)
-	return
+	p.writeMsg(w, r, dnssecReply(r, resp))
 }
 
-func (p *ProxyService) nhpServer(w dns.ResponseWriter, r *dns.Msg, resId string) {
-	if item, found := p.dnsCache.GetCache(resId); found {
-		item.value.Id = r.Id
-		_ = w.WriteMsg(item.value)
+func (p *ProxyService) nhpServer(w dns.ResponseWriter, r *dns.Msg, route *Route) {
+	resId := route.ResourceId
+	if p.getResource(resId) == nil {
+		log.Debug("domain :%s is no nhp resource", r.Question[0].Name)
+		p.nxDomain(w, r)
 		return
 	}
+	p.reknock.touch(resId)
+	ackMsg, ttl, err := p.knockResource(resId)
+	if err != nil {
+		log.Error("query dns Answer fail,err is %v", err)
+		logQueryKnock(w, "", err)
+		p.failAnswer(w, r, resId, knockEDE(err))
+		return
+	}
+	logQueryKnock(w, ackMsg.ErrCode, nil)
 
-	resultCh := p.dnsCache.group.DoChan(resId, func() (interface{}, error) {
-		if item, found := p.dnsCache.GetCache(resId); found {
-			item.value.Id = r.Id
-			_ = w.WriteMsg(item.value)
-			return item.value, nil
-		}
-
-		ackMsg, err := p.knock(resId)
+	var m *dns.Msg
+	switch r.Question[0].Qtype {
+	case dns.TypeA, dns.TypeAAAA:
+		m, err = p.addressAnswer(r, route, ackMsg, ttl)
 		if err != nil {
-			p.noAnswer(w, r)
-			return nil, err
-		}
-		if ackMsg == nil {
-			p.noAnswer(w, r)
-			return nil, errors.New("request nhp-server fail")
-		}
-		if !strings.EqualFold(ackMsg.ErrCode, "0") {
-			p.noAnswer(w, r)
-			return nil, com.ErrorCodeToError(ackMsg.ErrCode)
-		}
-		openTime := ackMsg.OpenTime
-		if openTime > 5 {
-			// The cache time is reduced by 5 seconds to prevent the port from being closed by nhp-ac right after the domain name resolution result is returned.
-			openTime -= 5
-		}
-
-		var m *dns.Msg
-		for _, host := range ackMsg.ResourceHost {
-			if net.ParseIP(host) != nil {
-				//
-				m, err = p.handleQuery(w, r, host, openTime)
-			} else {
-				log.Debug("nhp server returns a domain name as the result, which requires further DNS resolution.")
-				m, err = p.handleUpstreamQuery(w, r, host, openTime)
-			}
-			if err != nil {
-				return nil, err
-			} else {
-				break
-			}
-		}
-
-		if m != nil {
-			p.dnsCache.SetCacheWithTTL(resId, m, time.Duration(openTime)*time.Second)
+			p.failAnswer(w, r, resId, newEDE(dns.ExtendedErrorCodeNetworkError, err))
+			return
 		}
+	case dns.TypeSRV:
+		m = p.srvAnswer(r, route, ackMsg, ttl)
+	case dns.TypeHTTPS, dns.TypeSVCB:
+		m = p.svcbAnswer(r, route, ackMsg, ttl)
+	case dns.TypeTXT:
+		m = txtAnswer(r, ackMsg, ttl)
+	}
+	if m == nil {
+		// the resource has no record of the query type.
+		p.noAnswer(w, r)
+		return
+	}
+	m.Authoritative = true
+	p.writeMsg(w, r, m)
+}
 
-		return nil, err
-	})
-
-	// waiting result
-	select {
-	case result := <-resultCh:
-		if result.Err != nil {
-			log.Error("query dns Answer fail,err is %v", result.Err)
-		} else {
-			log.Debug("nhp knock success")
+// addressAnswer answers A and AAAA queries with the resource hosts of the
+// query family, or nil if there are none.
+func (p *ProxyService) addressAnswer(r *dns.Msg, route *Route, ackMsg *com.ServerKnockAckMsg, ttl uint32) (*dns.Msg, error) {
+	hosts := p.resourceHosts(route.ResourceId, r.Question[0].Name, route.Subdomain, ackMsg)
+	ips, names := splitHosts(hosts, r.Question[0].Qtype)
+	switch {
+	case len(ips) > 0:
+		if resource := p.getResource(route.ResourceId); resource != nil && resource.RoundRobin {
+			ips = rotateIPs(ips, p.roundRobin.Add(1))
 		}
-	case <-time.After(5 * time.Second): // time out
-		log.Error("timeout waiting for creation")
+		return p.handleQuery(r, ips, ttl), nil
+	case len(names) > 0:
+		log.Debug("nhp server returns a domain name as the result, which requires further DNS resolution.")
+		return p.handleUpstreamQuery(r, names[0], ttl)
+	default:
+		return nil, nil
 	}
 }
 
 func (p *ProxyService) queryUpstream(domain string, qtype uint16) (*dns.Msg, error) {
-	client := &dns.Client{
-		Timeout: 5 * time.Second,
-	}
-
 	msg := &dns.Msg{}
 	msg.SetQuestion(dns.Fqdn(domain), qtype)
 
-	response, _, err := client.Exchange(msg, p.upstreamDNS+":53")
+	response, _, err := p.exchangeUpstream(msg, "")
 	if err != nil {
 		return nil, fmt.Errorf("upstream query failed: %v", err)
 	}
@@ -245,9 +331,9 @@ func (p *ProxyService) queryUpstream(domain string, qtype uint16) (*dns.Msg, err
 }
 
 func (p *ProxyService) knock(resId string) (ackMsg *com.ServerKnockAckMsg, err error) {
-	if target, ok := p.resourceMap[resId]; !ok {
+	if target := p.getResource(resId); target == nil {
 		log.Warning("unknow resource [%s],", resId)
-		return nil, nil
+		return nil, errUnknownResource
 	} else {
 		resource, err := p.nhpAgent.AgentKnockResource(target.AuthServiceId, target.ResourceId, target.ServerIp, target.ServerHostname, target.ServerPort)
 		if err != nil {
@@ -262,69 +348,99 @@ func (p *ProxyService) knock(resId string) (ackMsg *com.ServerKnockAckMsg, err e
 	}
 }
 
+// noAnswer answers a protected name without records of the query type with
+// NODATA, negatively cached for the failure ttl.
 func (p *ProxyService) noAnswer(w dns.ResponseWriter, r *dns.Msg) {
 	m := new(dns.Msg)
 	m.SetRcode(r, dns.RcodeSuccess)
-	_ = w.WriteMsg(m)
+	m.Authoritative = true
+	m.Ns = append(m.Ns, negativeSOA(r.Question[0].Name, p.failure.Load().ttl))
+	p.writeMsg(w, r, m)
 }
 
-func (p *ProxyService) handleQuery(w dns.ResponseWriter, r *dns.Msg, ip string, ttl uint32) (*dns.Msg, error) {
+func (p *ProxyService) handleQuery(r *dns.Msg, ips []net.IP, ttl uint32) *dns.Msg {
+	question := r.Question[0]
 	m := new(dns.Msg)
 	m.SetReply(r)
-	var rr dns.RR
-	var err error
-	if r.Question[0].Qtype == 1 {
-		rr, err = dns.NewRR(fmt.Sprintf("%s A %s", r.Question[0].Name, ip))
-	} else {
-		rr, err = dns.NewRR(fmt.Sprintf("%s 3600 IN AAAA %s", r.Question[0].Name, ip))
-	}
-
-	if err == nil {
-		m.Answer = append(m.Answer, rr)
-		m.Answer[0].Header().Ttl = ttl
-		_ = w.WriteMsg(m)
-		return m, nil
-	} else {
-		log.Error("create dns answer fail, %v", err)
-		p.noAnswer(w, r)
-		return nil, err
+	hdr := dns.RR_Header{Name: question.Name, Rrtype: question.Qtype, Class: dns.ClassINET, Ttl: ttl}
+	for _, ip := range ips {
+		if question.Qtype == dns.TypeA {
+			m.Answer = append(m.Answer, &dns.A{Hdr: hdr, A: ip})
+		} else {
+			m.Answer = append(m.Answer, &dns.AAAA{Hdr: hdr, AAAA: ip})
+		}
 	}
+	p.reverse.record(ips, question.Name, ttl)
+	return m
 }
 
-func (p *ProxyService) handleUpstreamQuery(w dns.ResponseWriter, r *dns.Msg, host string, ttl uint32) (*dns.Msg, error) {
+func (p *ProxyService) handleUpstreamQuery(r *dns.Msg, host string, ttl uint32) (*dns.Msg, error) {
 	question := r.Question[0]
 	m := new(dns.Msg)
 	m.SetReply(r)
 	cname := &dns.CNAME{
 		Hdr:    dns.RR_Header{Name: question.Name, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: ttl},
-		Target: host + ".",
+		Target: dns.Fqdn(host),
 	}
-	m = new(dns.Msg)
-	m.SetReply(r)
 	m.Answer = append(m.Answer, cname)
-	client := &dns.Client{
-		Timeout: 5 * time.Second,
-	}
 
 	msg := &dns.Msg{}
 	msg.SetQuestion(dns.Fqdn(host), r.Question[0].Qtype)
 
-	response, _, err := client.Exchange(msg, p.upstreamDNS+":53")
-	if err != nil {
-		log.Error("create dns answer fail, %v", err)
-		p.noAnswer(w, r)
-		return nil, err
+	response := p.forwardCache.get(msg, "", "")
+	if response == nil {
+		var err error
+		response, _, err = p.exchangeUpstream(msg, "")
+		if err != nil {
+			log.Error("create dns answer fail, %v", err)
+			return nil, err
+		}
+		p.forwardCache.set(msg, "", "", response)
 	}
 
-	if len(response.Answer) == 0 {
-		log.Error("create dns answer fail, %v", err)
-		p.noAnswer(w, r)
-		return nil, err
+	if response.Rcode != dns.RcodeSuccess {
+		log.Error("create dns answer fail, %s answered with %s", host, dns.RcodeToString[response.Rcode])
+		return nil, fmt.Errorf("resource host %s answered with %s", host, dns.RcodeToString[response.Rcode])
 	}
 
 	for _, rr := range response.Answer {
 		m.Answer = append(m.Answer, rr)
 	}
-	_ = w.WriteMsg(m)
 	return m, nil
 }
+
+// writeMsg sends m as the reply to r. Answers that do not fit into the
+// udp payload size advertised by the client are truncated and flagged TC,
+// so that the client retries the query over tcp.
+func (p *ProxyService) writeMsg(w dns.ResponseWriter, r *dns.Msg, m *dns.Msg) {
+	if m.Id != r.Id {
+		// cached messages are shared between clients, reply with a copy.
+		m = m.Copy()
+		m.Id = r.Id
+	}
+	if rw, ok := w.(*rewriteWriter); ok {
+		// the answer of a rewrite target is shaped once merged.
+		rw.msg = m
+		return
+	}
+	policy := p.edns.Load()
+	encrypted := isEncrypted(w)
+	m = policy.reply(r, m, encrypted)
+	if _, isUDP := w.RemoteAddr().(*net.UDPAddr); isUDP {
+		// the smaller of the client's payload size and ours.
+		size := dns.MinMsgSize
+		if opt := r.IsEdns0(); opt != nil {
+			size = max(size, min(int(opt.UDPSize()), int(policy.udpSize)))
+		}
+		if m.Len() > size {
+			m = m.Copy()
+			m.Truncate(size)
+		}
+	}
+	if encrypted {
+		padMsg(m, responsePaddingBlock)
+	}
+	if err := w.WriteMsg(m); err != nil {
+		log.Debug("write dns answer to %s fail: %v", w.RemoteAddr(), err)
+	}
+}
@@ -0,0 +1,178 @@
+package dns
+
+import (
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// reverseRouteTable is the name of the table answering PTR queries of knocked
+// resource addresses.
+const reverseRouteTable = "reverse"
+
+// reverseTable maps the addresses of knocked resources to the names they were
+// answered for, until the answers expire. Expired names are removed by a
+// janitor goroutine.
+type reverseTable struct {
+	mu    sync.Mutex
+	names map[string]map[string]time.Time
+
+	janitorStop chan struct{}
+}
+
+func newReverseTable() *reverseTable {
+	return &reverseTable{
+		names: make(map[string]map[string]time.Time),
+	}
+}
+
+// record maps ips to name for ttl seconds.
+func (t *reverseTable) record(ips []net.IP, name string, ttl uint32) {
+	if ttl == 0 {
+		return
+	}
+	name = normalizeName(name)
+	expireTime := time.Now().Add(time.Duration(ttl) * time.Second)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, ip := range ips {
+		key := ip.String()
+		names, found := t.names[key]
+		if !found {
+			names = make(map[string]time.Time)
+			t.names[key] = names
+		}
+		if expireTime.After(names[name]) {
+			names[name] = expireTime
+		}
+	}
+}
+
+// lookup returns the live names of ip, sorted, and the remaining seconds of
+// the one expiring last.
+func (t *reverseTable) lookup(ip net.IP) ([]string, uint32) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := time.Now()
+	var result []string
+	var remaining time.Duration
+	for name, expireTime := range t.names[ip.String()] {
+		if left := expireTime.Sub(now); left > 0 {
+			result = append(result, name)
+			remaining = max(remaining, left)
+		}
+	}
+	sort.Strings(result)
+	return result, uint32((remaining + time.Second - 1) / time.Second)
+}
+
+// cleanup removes the expired names.
+func (t *reverseTable) cleanup() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := time.Now()
+	for key, names := range t.names {
+		for name, expireTime := range names {
+			if now.After(expireTime) {
+				delete(names, name)
+			}
+		}
+		if len(names) == 0 {
+			delete(t.names, key)
+		}
+	}
+}
+
+// startJanitor removes expired names every interval until stopJanitor is called.
+func (t *reverseTable) startJanitor(interval time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.janitorStop != nil {
+		return
+	}
+	stop := make(chan struct{})
+	t.janitorStop = stop
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				t.cleanup()
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+func (t *reverseTable) stopJanitor() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.janitorStop != nil {
+		close(t.janitorStop)
+		t.janitorStop = nil
+	}
+}
+
+// reverseIP parses the address of an in-addr.arpa or ip6.arpa name.
+func reverseIP(name string) net.IP {
+	labels := dns.SplitDomainName(name)
+	switch {
+	case strings.HasSuffix(name, ".in-addr.arpa.") && len(labels) == 6:
+		octets := make([]string, 4)
+		for i := 0; i < 4; i++ {
+			octets[3-i] = labels[i]
+		}
+		return net.ParseIP(strings.Join(octets, ".")).To4()
+	case strings.HasSuffix(name, ".ip6.arpa.") && len(labels) == 34:
+		var sb strings.Builder
+		for i := 31; i >= 0; i-- {
+			if len(labels[i]) != 1 {
+				return nil
+			}
+			sb.WriteString(labels[i])
+			if i%4 == 0 && i > 0 {
+				sb.WriteByte(':')
+			}
+		}
+		return net.ParseIP(sb.String())
+	default:
+		return nil
+	}
+}
+
+// routeReverse answers PTR queries of addresses answered for protected names
+// while their answers are live. Other reverse queries are forwarded.
+func (p *ProxyService) routeReverse(name string, qtype uint16) *Route {
+	if qtype != dns.TypePTR {
+		return nil
+	}
+	ip := reverseIP(name)
+	if ip == nil {
+		return nil
+	}
+	names, ttl := p.reverse.lookup(ip)
+	if len(names) == 0 {
+		return nil
+	}
+	return &Route{
+		Action: RouteLocal,
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+			m := new(dns.Msg)
+			m.SetReply(r)
+			m.Authoritative = true
+			for _, target := range names {
+				m.Answer = append(m.Answer, &dns.PTR{
+					Hdr: dns.RR_Header{Name: r.Question[0].Name, Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: ttl},
+					Ptr: target,
+				})
+			}
+			p.writeMsg(w, r, m)
+		}),
+	}
+}
@@ -0,0 +1,91 @@
+package dns
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestReverseIP(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{name: "4.3.2.1.in-addr.arpa.", want: "1.2.3.4"},
+		{name: "1.0.0.127.in-addr.arpa.", want: "127.0.0.1"},
+		{name: "1.0.8.b.d.0.1.0.0.2.ip6.arpa."},
+		{
+			name: "1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa.",
+			want: "2001:db8::1",
+		},
+		{
+			name: "F.E.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.B.D.0.1.0.0.2.ip6.arpa.",
+			want: "2001:db8::ef",
+		},
+		// an ipv4-mapped address is looked up as the ipv4 address.
+		{
+			name: "4.0.2.0.0.0.0.c.f.f.f.f.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.ip6.arpa.",
+			want: "192.0.2.4",
+		},
+		// partial and malformed names.
+		{name: "3.2.1.in-addr.arpa."},
+		{name: "5.4.3.2.1.in-addr.arpa."},
+		{name: "256.3.2.1.in-addr.arpa."},
+		{name: "04.3.2.1.in-addr.arpa."},
+		{name: "x.3.2.1.in-addr.arpa."},
+		{name: "4.3.2.1.in-addr.arpa.example.com."},
+		{name: "4.3.2.1.example.com."},
+		{name: "10.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa."},
+		{name: "g.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa."},
+		{name: "0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa."},
+	}
+	for _, tt := range tests {
+		got := reverseIP(tt.name)
+		if tt.want == "" {
+			if got != nil {
+				t.Errorf("reverseIP(%s) = %s, want nil", tt.name, got)
+			}
+			continue
+		}
+		if !got.Equal(net.ParseIP(tt.want)) {
+			t.Errorf("reverseIP(%s) = %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestReverseTable(t *testing.T) {
+	table := newReverseTable()
+	ip := net.ParseIP("192.0.2.1")
+	table.record([]net.IP{ip}, "App.Demo.nhp", 60)
+	table.record([]net.IP{ip}, "demo.nhp.", 1)
+	table.record([]net.IP{ip}, "gone.nhp.", 0)
+
+	names, ttl := table.lookup(ip)
+	if len(names) != 2 || names[0] != "app.demo.nhp." || names[1] != "demo.nhp." || ttl != 60 {
+		t.Errorf("lookup = %v, %d", names, ttl)
+	}
+
+	// expired names are skipped by lookups and removed by the janitor.
+	table.mu.Lock()
+	table.names[ip.String()]["app.demo.nhp."] = time.Now().Add(-time.Second)
+	table.names[ip.String()]["demo.nhp."] = time.Now().Add(-time.Second)
+	table.mu.Unlock()
+	if names, _ := table.lookup(ip); len(names) != 0 {
+		t.Errorf("lookup of expired names = %v", names)
+	}
+	table.startJanitor(5 * time.Millisecond)
+	defer table.stopJanitor()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		table.mu.Lock()
+		size := len(table.names)
+		table.mu.Unlock()
+		if size == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("janitor did not remove the expired names")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
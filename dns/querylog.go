@@ -0,0 +1,328 @@
+package dns
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/OpenNHP/opennhp/nhp/log"
+	"github.com/miekg/dns"
+)
+
+// privacy modes of the client addresses and names of the query log.
+const (
+	QueryLogTruncate = "truncate"
+	QueryLogHash     = "hash"
+)
+
+const (
+	defaultQueryLogFile       = "logs/query.log"
+	defaultQueryLogMaxSize    = 100
+	defaultQueryLogMaxAge     = 24 * 60 * 60
+	defaultQueryLogMaxBackups = 7
+
+	// a truncated name keeps this many labels, e.g. "example.com.".
+	queryLogNameLabels = 2
+	// hashes are the first bytes of the HMAC-SHA256.
+	queryLogHashBytes = 8
+)
+
+// queryLogEntry is a line of the query log.
+type queryLogEntry struct {
+	Time       time.Time `json:"time"`
+	Client     string    `json:"client,omitempty"`
+	Name       string    `json:"name"`
+	Type       string    `json:"type"`
+	Route      string    `json:"route,omitempty"`
+	Rule       string    `json:"rule,omitempty"`
+	Upstream   string    `json:"upstream,omitempty"`
+	Cached     bool      `json:"cached,omitempty"`
+	Rcode      string    `json:"rcode"`
+	LatencyMs  float64   `json:"latencyMs"`
+	Knock      string    `json:"knock,omitempty"`
+	KnockError string    `json:"knockError,omitempty"`
+}
+
+// queryLog writes a JSON line per answered query to a file, which is rotated
+// when it exceeds the max size or age.
+type queryLog struct {
+	clientIP   string
+	name       string
+	hashKey    []byte
+	path       string
+	maxSize    int64
+	maxAge     time.Duration
+	maxBackups int
+
+	mu     sync.Mutex
+	file   *os.File
+	size   int64
+	opened time.Time
+}
+
+// newQueryLog returns nil if the query log is disabled or can't be opened.
+func newQueryLog(conf *QueryLogConfig) *queryLog {
+	if !conf.Enable {
+		return nil
+	}
+	l := &queryLog{
+		clientIP:   strings.ToLower(strings.TrimSpace(conf.ClientIP)),
+		name:       strings.ToLower(strings.TrimSpace(conf.Name)),
+		path:       localFilePath(conf.File),
+		maxSize:    int64(conf.MaxSize) << 20,
+		maxAge:     time.Duration(conf.MaxAge) * time.Second,
+		maxBackups: conf.MaxBackups,
+	}
+	if len(conf.File) == 0 {
+		l.path = localFilePath(defaultQueryLogFile)
+	}
+	if l.maxSize <= 0 {
+		l.maxSize = defaultQueryLogMaxSize << 20
+	}
+	if l.maxAge <= 0 {
+		l.maxAge = defaultQueryLogMaxAge * time.Second
+	}
+	if l.maxBackups <= 0 {
+		l.maxBackups = defaultQueryLogMaxBackups
+	}
+	for _, mode := range []string{l.clientIP, l.name} {
+		switch mode {
+		case "", QueryLogTruncate, QueryLogHash:
+		default:
+			log.Error("unknown query log privacy mode %q, logging in full", mode)
+		}
+	}
+	if len(conf.HashKey) > 0 {
+		l.hashKey = []byte(conf.HashKey)
+	} else {
+		// hashes are only comparable until the service restarts.
+		l.hashKey = make([]byte, sha256.Size)
+		_, _ = rand.Read(l.hashKey)
+	}
+
+	if err := l.open(); err != nil {
+		log.Error("failed to open query log %s: %v", l.path, err)
+		return nil
+	}
+	log.Info("logging queries to %s", l.path)
+	return l
+}
+
+// open opens the log file for appending, the lock must be held or l unshared.
+func (l *queryLog) open() error {
+	if err := os.MkdirAll(filepath.Dir(l.path), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(l.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0640)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	// the age of a file left by a previous run counts from its last write.
+	l.file, l.size, l.opened = f, info.Size(), time.Now()
+	if l.size > 0 {
+		l.opened = info.ModTime()
+	}
+	return nil
+}
+
+func (l *queryLog) close() {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file != nil {
+		_ = l.file.Close()
+		l.file = nil
+	}
+}
+
+func (l *queryLog) write(entry *queryLogEntry) {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		log.Error("failed to marshal query log entry: %v", err)
+		return
+	}
+	line = append(line, '\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file == nil {
+		// closed by a config change.
+		return
+	}
+	if l.size > 0 && (l.size+int64(len(line)) > l.maxSize || time.Since(l.opened) >= l.maxAge) {
+		if err := l.rotate(); err != nil {
+			log.Error("failed to rotate query log %s: %v", l.path, err)
+			if l.file == nil {
+				return
+			}
+		}
+	}
+	n, err := l.file.Write(line)
+	l.size += int64(n)
+	if err != nil {
+		log.Error("failed to write query log %s: %v", l.path, err)
+	}
+}
+
+// rotate renames the log file to a backup named by the time of rotation,
+// removes the oldest backups and opens a new file. The lock must be held.
+func (l *queryLog) rotate() error {
+	if err := l.file.Close(); err != nil {
+		log.Warning("failed to close query log %s: %v", l.path, err)
+	}
+	l.file = nil
+	ext := filepath.Ext(l.path)
+	prefix := strings.TrimSuffix(l.path, ext) + "-"
+	backup := prefix + time.Now().Format("20060102T150405.000") + ext
+	if err := os.Rename(l.path, backup); err != nil && !errors.Is(err, os.ErrNotExist) {
+		// keep appending to the current file.
+		if openErr := l.open(); openErr != nil {
+			return openErr
+		}
+		return err
+	}
+
+	if backups, err := filepath.Glob(prefix + "*" + ext); err == nil && len(backups) > l.maxBackups {
+		// the time format sorts the backups from the oldest.
+		sort.Strings(backups)
+		for _, old := range backups[:len(backups)-l.maxBackups] {
+			if err := os.Remove(old); err != nil {
+				log.Warning("failed to remove query log backup %s: %v", old, err)
+			}
+		}
+	}
+	return l.open()
+}
+
+// client returns the client address as the privacy mode allows.
+func (l *queryLog) client(ip net.IP) string {
+	if ip == nil {
+		return ""
+	}
+	switch l.clientIP {
+	case QueryLogTruncate:
+		if ip4 := ip.To4(); ip4 != nil {
+			return ip4.Mask(net.CIDRMask(defaultSubnetIPv4Bits, 32)).String()
+		}
+		return ip.Mask(net.CIDRMask(defaultSubnetIPv6Bits, 128)).String()
+	case QueryLogHash:
+		return l.hash(ip.String())
+	default:
+		return ip.String()
+	}
+}
+
+// queryName returns the query name as the privacy mode allows.
+func (l *queryLog) queryName(name string) string {
+	name = normalizeName(name)
+	switch l.name {
+	case QueryLogTruncate:
+		labels := dns.SplitDomainName(name)
+		if len(labels) <= queryLogNameLabels {
+			return name
+		}
+		return dns.Fqdn(strings.Join(labels[len(labels)-queryLogNameLabels:], "."))
+	case QueryLogHash:
+		return l.hash(name)
+	default:
+		return name
+	}
+}
+
+func (l *queryLog) hash(value string) string {
+	mac := hmac.New(sha256.New, l.hashKey)
+	mac.Write([]byte(value))
+	return hex.EncodeToString(mac.Sum(nil)[:queryLogHashBytes])
+}
+
+// queryLogWriter logs the answer of a query when it is written. The proxy
+// adds how it answered with the logQuery functions.
+type queryLogWriter struct {
+	dns.ResponseWriter
+	log   *queryLog
+	start time.Time
+	entry queryLogEntry
+}
+
+func (l *queryLog) writer(w dns.ResponseWriter, r *dns.Msg) *queryLogWriter {
+	lw := &queryLogWriter{
+		ResponseWriter: w,
+		log:            l,
+		start:          time.Now(),
+	}
+	lw.entry.Client = l.client(clientIP(w.RemoteAddr()))
+	if len(r.Question) > 0 {
+		lw.entry.Name = l.queryName(r.Question[0].Name)
+		lw.entry.Type = dns.Type(r.Question[0].Qtype).String()
+	}
+	return lw
+}
+
+func (lw *queryLogWriter) WriteMsg(m *dns.Msg) error {
+	err := lw.ResponseWriter.WriteMsg(m)
+	lw.entry.Time = lw.start
+	lw.entry.LatencyMs = float64(time.Since(lw.start).Microseconds()) / 1000
+	lw.entry.Rcode = dns.RcodeToString[m.Rcode]
+	lw.log.write(&lw.entry)
+	return err
+}
+
+// ConnectionState keeps the connection of the client visible to isEncrypted.
+func (lw *queryLogWriter) ConnectionState() *tls.ConnectionState {
+	if stater, ok := lw.ResponseWriter.(dns.ConnectionStater); ok {
+		return stater.ConnectionState()
+	}
+	return nil
+}
+
+// logQueryRoute records the route of a logged query.
+func logQueryRoute(w dns.ResponseWriter, route *Route) {
+	if lw, ok := w.(*queryLogWriter); ok {
+		lw.entry.Route = route.Action.String()
+		if route.Action == RouteProtected {
+			lw.entry.Route = "nhp"
+		}
+		lw.entry.Rule = route.Rule
+	}
+}
+
+// logQueryUpstream records the upstream that answered a logged query, or that
+// it was answered from the forward cache.
+func logQueryUpstream(w dns.ResponseWriter, upstream string, cached bool) {
+	if lw, ok := w.(*queryLogWriter); ok {
+		lw.entry.Upstream, lw.entry.Cached = upstream, cached
+	}
+}
+
+// logQueryKnock records the result of the knock of a logged query: the error
+// code of the nhp server, and why the knock failed.
+func logQueryKnock(w dns.ResponseWriter, code string, err error) {
+	if lw, ok := w.(*queryLogWriter); ok {
+		lw.entry.Knock = code
+		if err != nil {
+			var ackErr *knockAckErr
+			if errors.As(err, &ackErr) {
+				lw.entry.Knock = ackErr.code
+			}
+			lw.entry.KnockError = err.Error()
+		}
+	}
+}
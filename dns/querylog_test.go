@@ -0,0 +1,176 @@
+package dns
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func testQueryLog(t *testing.T, conf *QueryLogConfig) *queryLog {
+	conf.Enable = true
+	if len(conf.File) == 0 {
+		conf.File = filepath.Join(t.TempDir(), "query.log")
+	}
+	l := newQueryLog(conf)
+	if l == nil {
+		t.Fatalf("query log %s is not opened", conf.File)
+	}
+	t.Cleanup(l.close)
+	return l
+}
+
+// queryLogBackups returns the rotated backups of l.
+func queryLogBackups(t *testing.T, l *queryLog) []string {
+	backups, err := filepath.Glob(strings.TrimSuffix(l.path, ".log") + "-*.log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return backups
+}
+
+func readQueryLog(t *testing.T, file string) []*queryLogEntry {
+	f, err := os.Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var entries []*queryLogEntry
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		entry := new(queryLogEntry)
+		if err := json.Unmarshal(scanner.Bytes(), entry); err != nil {
+			t.Fatalf("line %q: %v", scanner.Text(), err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func TestQueryLogRotateBySize(t *testing.T) {
+	l := testQueryLog(t, &QueryLogConfig{MaxBackups: 2})
+	l.maxSize = 150
+	for i := 0; i < 10; i++ {
+		// backups are named by the millisecond of rotation.
+		time.Sleep(2 * time.Millisecond)
+		l.write(&queryLogEntry{Name: "www.example.com.", Time: time.Now()})
+	}
+
+	backups := queryLogBackups(t, l)
+	if len(backups) != 2 {
+		t.Fatalf("backups %v, want the 2 newest", backups)
+	}
+	for _, file := range append(backups, l.path) {
+		info, err := os.Stat(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Size() > l.maxSize {
+			t.Errorf("%s has %d bytes, over the max size %d", file, info.Size(), l.maxSize)
+		}
+	}
+	// the oldest backups are removed.
+	last := readQueryLog(t, backups[1])
+	if current := readQueryLog(t, l.path); len(current) == 0 || !current[0].Time.After(last[len(last)-1].Time) {
+		t.Errorf("backup %s is not the newest", backups[1])
+	}
+}
+
+func TestQueryLogRotateByAge(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "query.log")
+	if err := os.WriteFile(file, []byte("{}\n"), 0640); err != nil {
+		t.Fatal(err)
+	}
+	// a log left by a previous run is as old as its last write.
+	old := time.Now().Add(-2 * time.Hour)
+	if err := os.Chtimes(file, old, old); err != nil {
+		t.Fatal(err)
+	}
+	l := testQueryLog(t, &QueryLogConfig{File: file, MaxAge: 3600})
+	l.write(&queryLogEntry{Name: "old.example.com."})
+	if backups := queryLogBackups(t, l); len(backups) != 1 {
+		t.Fatalf("backups %v, want the log of the previous run", backups)
+	}
+
+	time.Sleep(2 * time.Millisecond)
+	l.write(&queryLogEntry{Name: "new.example.com."})
+	if backups := queryLogBackups(t, l); len(backups) != 1 {
+		t.Errorf("backups %v, a new log is rotated", backups)
+	}
+	if entries := readQueryLog(t, file); len(entries) != 2 {
+		t.Errorf("log has %d entries, want 2", len(entries))
+	}
+}
+
+func TestQueryLogPrivacy(t *testing.T) {
+	tests := []struct {
+		clientIP string
+		name     string
+		client   string
+		query    string
+		want     string
+		wantName string
+	}{
+		{client: "192.0.2.7", query: "www.Example.com", want: "192.0.2.7", wantName: "www.example.com."},
+		{clientIP: QueryLogTruncate, name: QueryLogTruncate, client: "192.0.2.7", query: "a.b.example.com.", want: "192.0.2.0", wantName: "example.com."},
+		{clientIP: QueryLogTruncate, name: QueryLogTruncate, client: "2001:db8:1:2:3::7", query: "example.com.", want: "2001:db8:1::", wantName: "example.com."},
+		{clientIP: QueryLogHash, name: QueryLogHash, client: "192.0.2.7", query: "www.example.com."},
+	}
+	for _, tt := range tests {
+		l := testQueryLog(t, &QueryLogConfig{ClientIP: tt.clientIP, Name: tt.name, HashKey: "key"})
+		lw := l.writer(newRecordWriter(tt.client), testQuery(tt.query, dns.TypeA))
+		client, name := lw.entry.Client, lw.entry.Name
+		if tt.clientIP == QueryLogHash {
+			// hashes are hex and only comparable under the same key.
+			if len(client) != 2*queryLogHashBytes || strings.Contains(client, tt.client) || client != l.client(net.ParseIP(tt.client)) {
+				t.Errorf("hashed client %s = %q", tt.client, client)
+			}
+			if len(name) != 2*queryLogHashBytes || strings.Contains(name, "example") || name != l.hash(tt.query) {
+				t.Errorf("hashed name %s = %q", tt.query, name)
+			}
+			other := testQueryLog(t, &QueryLogConfig{ClientIP: QueryLogHash, HashKey: "other"})
+			if other.hash(tt.query) == name {
+				t.Errorf("hash of %s does not depend on the key", tt.query)
+			}
+			continue
+		}
+		if client != tt.want || name != tt.wantName {
+			t.Errorf("%s %s mode %q/%q = %q %q, want %q %q", tt.client, tt.query, tt.clientIP, tt.name, client, name, tt.want, tt.wantName)
+		}
+	}
+}
+
+func TestQueryLogWriter(t *testing.T) {
+	l := testQueryLog(t, &QueryLogConfig{})
+	r := testQuery("www.example.com.", dns.TypeAAAA)
+	lw := l.writer(tlsRecordWriter{newRecordWriter("192.0.2.7")}, r)
+	if !isEncrypted(lw) {
+		t.Error("the tls connection of the client is hidden by the log")
+	}
+	logQueryRoute(lw, &Route{Action: RouteForward, Rule: "work"})
+	logQueryUpstream(lw, "tls://192.0.2.53:853", false)
+	m := new(dns.Msg)
+	m.SetRcode(r, dns.RcodeNameError)
+	if err := lw.WriteMsg(m); err != nil {
+		t.Fatal(err)
+	}
+
+	if plain := l.writer(newRecordWriter("192.0.2.7"), r); isEncrypted(plain) {
+		t.Error("a udp client is logged as encrypted")
+	}
+	entries := readQueryLog(t, l.path)
+	if len(entries) != 1 {
+		t.Fatalf("log has %d entries, want 1", len(entries))
+	}
+	entry := entries[0]
+	if entry.Client != "192.0.2.7" || entry.Name != "www.example.com." || entry.Type != "AAAA" || entry.Rcode != "NXDOMAIN" ||
+		entry.Route != "forward" || entry.Rule != "work" || entry.Upstream != "tls://192.0.2.53:853" {
+		t.Errorf("entry = %+v", entry)
+	}
+}
@@ -0,0 +1,152 @@
+package dns
+
+import (
+	"fmt"
+	"strings"
+
+	com "github.com/OpenNHP/opennhp/nhp/common"
+	"github.com/miekg/dns"
+)
+
+const defaultServiceProtocol = "tcp"
+
+// splitService splits a SRV query name _service._proto.name.
+func splitService(name string) (service, proto, base string, ok bool) {
+	labels := dns.SplitDomainName(name)
+	if len(labels) < 3 || !strings.HasPrefix(labels[0], "_") || !strings.HasPrefix(labels[1], "_") {
+		return "", "", "", false
+	}
+	return labels[0][1:], labels[1][1:], dns.Fqdn(strings.Join(labels[2:], ".")), true
+}
+
+// srvAnswer answers _service._proto.<name> with the port of the matching
+// service of the resource, or the port carried by the knock answer. The
+// addresses of the target are added as additional records.
+func (p *ProxyService) srvAnswer(r *dns.Msg, route *Route, ackMsg *com.ServerKnockAckMsg, ttl uint32) *dns.Msg {
+	question := r.Question[0]
+	service, proto, base, ok := splitService(normalizeName(question.Name))
+	resource := p.getResource(route.ResourceId)
+	if !ok || resource == nil {
+		return nil
+	}
+	var conf *ServiceConfig
+	for _, svc := range resource.Services {
+		svcProto := svc.Protocol
+		if len(svcProto) == 0 {
+			svcProto = defaultServiceProtocol
+		}
+		if strings.EqualFold(svc.Service, service) && strings.EqualFold(svcProto, proto) {
+			conf = svc
+			break
+		}
+	}
+	if conf == nil {
+		return nil
+	}
+
+	// the service labels are part of the subdomain of the route.
+	var subdomain string
+	if parts := strings.SplitN(route.Subdomain, ".", 3); len(parts) == 3 {
+		subdomain = parts[2]
+	}
+	hosts := p.resourceHosts(route.ResourceId, base, subdomain, ackMsg)
+	port := conf.Port
+	if port == 0 {
+		port = resourcePort(hosts)
+	}
+	if port == 0 {
+		return nil
+	}
+
+	m := new(dns.Msg)
+	m.SetReply(r)
+	target := base
+	ipv4, names := splitHosts(hosts, dns.TypeA)
+	ipv6, _ := splitHosts(hosts, dns.TypeAAAA)
+	if len(ipv4) == 0 && len(ipv6) == 0 && len(names) > 0 {
+		target = dns.Fqdn(names[0])
+	}
+	m.Answer = append(m.Answer, &dns.SRV{
+		Hdr:      dns.RR_Header{Name: question.Name, Rrtype: dns.TypeSRV, Class: dns.ClassINET, Ttl: ttl},
+		Priority: conf.Priority,
+		Weight:   conf.Weight,
+		Port:     port,
+		Target:   target,
+	})
+	for _, ip := range ipv4 {
+		m.Extra = append(m.Extra, &dns.A{
+			Hdr: dns.RR_Header{Name: target, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: ttl},
+			A:   ip,
+		})
+	}
+	for _, ip := range ipv6 {
+		m.Extra = append(m.Extra, &dns.AAAA{
+			Hdr:  dns.RR_Header{Name: target, Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: ttl},
+			AAAA: ip,
+		})
+	}
+	return m
+}
+
+// svcbAnswer answers HTTPS and SVCB queries (RFC 9460) of a resource with
+// an HTTPS config, with its alpn, port and address hints.
+func (p *ProxyService) svcbAnswer(r *dns.Msg, route *Route, ackMsg *com.ServerKnockAckMsg, ttl uint32) *dns.Msg {
+	question := r.Question[0]
+	resource := p.getResource(route.ResourceId)
+	if resource == nil || resource.HTTPS == nil {
+		return nil
+	}
+	conf := resource.HTTPS
+	hosts := p.resourceHosts(route.ResourceId, question.Name, route.Subdomain, ackMsg)
+	ipv4, names := splitHosts(hosts, dns.TypeA)
+	ipv6, _ := splitHosts(hosts, dns.TypeAAAA)
+
+	svcb := dns.SVCB{
+		Hdr:      dns.RR_Header{Name: question.Name, Rrtype: question.Qtype, Class: dns.ClassINET, Ttl: ttl},
+		Priority: 1,
+		Target:   ".",
+	}
+	if len(ipv4) == 0 && len(ipv6) == 0 && len(names) > 0 {
+		svcb.Target = dns.Fqdn(names[0])
+	}
+	// keys are in ascending order, as required by the wire format.
+	if len(conf.Alpn) > 0 {
+		svcb.Value = append(svcb.Value, &dns.SVCBAlpn{Alpn: conf.Alpn})
+	}
+	port := conf.Port
+	if port == 0 {
+		port = resourcePort(hosts)
+	}
+	if port != 0 {
+		svcb.Value = append(svcb.Value, &dns.SVCBPort{Port: port})
+	}
+	if len(ipv4) > 0 {
+		svcb.Value = append(svcb.Value, &dns.SVCBIPv4Hint{Hint: ipv4})
+	}
+	if len(ipv6) > 0 {
+		svcb.Value = append(svcb.Value, &dns.SVCBIPv6Hint{Hint: ipv6})
+	}
+
+	m := new(dns.Msg)
+	m.SetReply(r)
+	if question.Qtype == dns.TypeHTTPS {
+		m.Answer = append(m.Answer, &dns.HTTPS{SVCB: svcb})
+	} else {
+		m.Answer = append(m.Answer, &svcb)
+	}
+	return m
+}
+
+// txtAnswer answers with the remaining open time of the resource. It is not
+// cacheable, so clients always see the current value.
+func txtAnswer(r *dns.Msg, ackMsg *com.ServerKnockAckMsg, ttl uint32) *dns.Msg {
+	// ttl is the remaining cache time, which ends before the open time.
+	remaining := ttl + ackMsg.OpenTime - cacheOpenTime(ackMsg.OpenTime)
+	m := new(dns.Msg)
+	m.SetReply(r)
+	m.Answer = append(m.Answer, &dns.TXT{
+		Hdr: dns.RR_Header{Name: r.Question[0].Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 0},
+		Txt: []string{fmt.Sprintf("nhp-open-time=%d", remaining)},
+	})
+	return m
+}
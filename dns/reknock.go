@@ -0,0 +1,158 @@
+package dns
+
+import (
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/OpenNHP/opennhp/nhp/log"
+)
+
+const (
+	defaultReknockBefore      = 10
+	defaultReknockIdleTimeout = 300
+)
+
+// reknockScheduler knocks a resource again shortly before its open time
+// ends, as long as it was queried within the idle timeout. Long-lived
+// connections then keep their port open, while unused resources close.
+type reknockScheduler struct {
+	conf atomic.Pointer[ReknockConfig]
+
+	mu      sync.Mutex
+	entries map[string]*reknockEntry
+	stopped bool
+}
+
+type reknockEntry struct {
+	lastQuery time.Time
+	timer     *time.Timer
+}
+
+func newReknockScheduler(conf *ReknockConfig) *reknockScheduler {
+	s := &reknockScheduler{
+		entries: make(map[string]*reknockEntry),
+	}
+	s.setConfig(conf)
+	return s
+}
+
+func (s *reknockScheduler) setConfig(conf *ReknockConfig) {
+	copied := *conf
+	if copied.Before == 0 {
+		copied.Before = defaultReknockBefore
+	}
+	if copied.IdleTimeout == 0 {
+		copied.IdleTimeout = defaultReknockIdleTimeout
+	}
+	s.conf.Store(&copied)
+}
+
+// touch records a query for a scheduled resId.
+func (s *reknockScheduler) touch(resId string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if entry, found := s.entries[resId]; found {
+		entry.lastQuery = time.Now()
+	}
+}
+
+// idle reports whether resId has not been queried within the idle timeout.
+func (s *reknockScheduler) idle(resId string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry, found := s.entries[resId]
+	if !found {
+		return true
+	}
+	return time.Since(entry.lastQuery) > time.Duration(s.conf.Load().IdleTimeout)*time.Second
+}
+
+// schedule runs fn before an open time of openTime seconds ends.
+func (s *reknockScheduler) schedule(resId string, openTime uint32, fn func()) {
+	conf := s.conf.Load()
+	if conf.Disable || openTime <= conf.Before {
+		return
+	}
+	delay := time.Duration(openTime-conf.Before) * time.Second
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stopped {
+		return
+	}
+	entry, found := s.entries[resId]
+	if !found {
+		// only knocked resources are tracked, so random names don't pile up.
+		entry = &reknockEntry{lastQuery: time.Now()}
+		s.entries[resId] = entry
+	}
+	if entry.timer != nil {
+		entry.timer.Stop()
+	}
+	entry.timer = time.AfterFunc(delay, fn)
+}
+
+// forget drops resId, it will be knocked again on its next query.
+func (s *reknockScheduler) forget(resId string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if entry, found := s.entries[resId]; found {
+		if entry.timer != nil {
+			entry.timer.Stop()
+		}
+		delete(s.entries, resId)
+	}
+}
+
+func (s *reknockScheduler) stop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stopped = true
+	for resId, entry := range s.entries {
+		if entry.timer != nil {
+			entry.timer.Stop()
+		}
+		delete(s.entries, resId)
+	}
+}
+
+func (p *ProxyService) scheduleReknock(resId string, openTime uint32) {
+	p.reknock.schedule(resId, openTime, func() {
+		p.reknockResource(resId)
+	})
+}
+
+// reknockResource renews the open time of a recently queried resource and
+// caches its new acknowledgement.
+func (p *ProxyService) reknockResource(resId string) {
+	if p.reknock.idle(resId) {
+		log.Debug("resource [%s] is idle, let it close", resId)
+		p.reknock.forget(resId)
+		return
+	}
+
+	ackMsg, err := p.knock(resId)
+	if err != nil || ackMsg == nil || !strings.EqualFold(ackMsg.ErrCode, "0") {
+		log.Warning("re-knock resource [%s] fail, it will be knocked on the next query", resId)
+		p.reknock.forget(resId)
+		return
+	}
+	log.Debug("re-knock resource [%s] success, open time %d", resId, ackMsg.OpenTime)
+
+	if len(ackMsg.ResourceHost) > 0 {
+		p.dnsCache.SetCacheWithTTL(resId, ackMsg, time.Duration(cacheOpenTime(ackMsg.OpenTime))*time.Second)
+	}
+	p.scheduleReknock(resId, ackMsg.OpenTime)
+}
+
+// cacheOpenTime is the time a knocked answer is cached for. It is reduced by
+// 5 seconds to prevent the port from being closed by nhp-ac right after the
+// domain name resolution result is returned.
+func cacheOpenTime(openTime uint32) uint32 {
+	if openTime > 5 {
+		return openTime - 5
+	}
+	return openTime
+}
@@ -0,0 +1,170 @@
+package dns
+
+import (
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/miekg/dns"
+
+	"github.com/OpenNHP/StealthDNS/common"
+)
+
+// RouteAction is what the proxy does with a query.
+type RouteAction int
+
+const (
+	// RouteForward sends the query to the upstream dns servers.
+	RouteForward RouteAction = iota
+	// RouteProtected knocks an nhp resource and answers with its hosts.
+	RouteProtected
+	// RouteBlock answers with the block response.
+	RouteBlock
+	// RouteLocal answers from local data by the route's Handler.
+	RouteLocal
+	// RouteRewrite answers with the route's Rewrite addresses or name.
+	RouteRewrite
+)
+
+func (a RouteAction) String() string {
+	switch a {
+	case RouteForward:
+		return "forward"
+	case RouteProtected:
+		return "protected"
+	case RouteBlock:
+		return "block"
+	case RouteLocal:
+		return "local"
+	case RouteRewrite:
+		return "rewrite"
+	default:
+		return "unknown"
+	}
+}
+
+// Route is the routing decision for a query name.
+type Route struct {
+	Action RouteAction
+	// ResourceId is the nhp resource knocked by a protected route.
+	ResourceId string
+	// Subdomain is the labels of a protected name below its resource name.
+	Subdomain string
+	// Handler answers the query of a local route.
+	Handler dns.Handler
+	// Upstream is the upstream group of a forward route, empty to select it
+	// by the forward rules.
+	Upstream string
+	// Response and TTL override the block response of a block route, TTL
+	// is also the ttl of the records of a rewrite route.
+	Response string
+	TTL      uint32
+	// Rewrite is the addresses, or the single name, a rewrite route answers with.
+	Rewrite []string
+	// Table is the name of the table that made the decision.
+	Table string
+	// Rule is the name of the policy rule that made the decision.
+	Rule string
+}
+
+// RouteTable decides the route of a lower-cased, fully qualified query name.
+// It returns nil for names it doesn't route.
+type RouteTable interface {
+	Route(name string, qtype uint16) *Route
+}
+
+// RouteTableFunc adapts a function to a RouteTable.
+type RouteTableFunc func(name string, qtype uint16) *Route
+
+func (f RouteTableFunc) Route(name string, qtype uint16) *Route {
+	return f(name, qtype)
+}
+
+// priorities of the built-in route tables, lower ones are consulted first.
+const (
+	RoutePriorityProtected = 100
+	RoutePriorityLocal     = 200
+	RoutePriorityBlock     = 300
+)
+
+// nhpRouteTable is the name of the table routing the .nhp zone.
+const nhpRouteTable = "nhp"
+
+type routeTableEntry struct {
+	name     string
+	priority int
+	table    RouteTable
+}
+
+// DomainRouter consults its route tables by priority, the first route
+// returned wins. Names not routed by any table are forwarded.
+type DomainRouter struct {
+	mu     sync.RWMutex
+	tables []*routeTableEntry
+}
+
+func NewDomainRouter() *DomainRouter {
+	return &DomainRouter{}
+}
+
+// SetTable adds a route table, replacing the table with the same name.
+// Tables with the same priority are consulted in the order they were added.
+func (router *DomainRouter) SetTable(name string, priority int, table RouteTable) {
+	router.mu.Lock()
+	defer router.mu.Unlock()
+	tables := make([]*routeTableEntry, 0, len(router.tables)+1)
+	for _, entry := range router.tables {
+		if entry.name != name {
+			tables = append(tables, entry)
+		}
+	}
+	tables = append(tables, &routeTableEntry{name: name, priority: priority, table: table})
+	sort.SliceStable(tables, func(i, j int) bool {
+		return tables[i].priority < tables[j].priority
+	})
+	router.tables = tables
+}
+
+// RemoveTable removes the route table with name.
+func (router *DomainRouter) RemoveTable(name string) {
+	router.mu.Lock()
+	defer router.mu.Unlock()
+	tables := make([]*routeTableEntry, 0, len(router.tables))
+	for _, entry := range router.tables {
+		if entry.name != name {
+			tables = append(tables, entry)
+		}
+	}
+	router.tables = tables
+}
+
+// Route returns the route of a query name, which is normalised first.
+func (router *DomainRouter) Route(name string, qtype uint16) *Route {
+	name = normalizeName(name)
+	router.mu.RLock()
+	tables := router.tables
+	router.mu.RUnlock()
+	for _, entry := range tables {
+		if route := entry.table.Route(name, qtype); route != nil {
+			route.Table = entry.name
+			return route
+		}
+	}
+	return &Route{Action: RouteForward}
+}
+
+// normalizeName lower-cases a domain name and makes it fully qualified.
+func normalizeName(name string) string {
+	return dns.Fqdn(strings.ToLower(name))
+}
+
+// nhpZone is the fully qualified zone of the protected resources.
+func nhpZone() string {
+	return dns.Fqdn(strings.TrimPrefix(common.NhpDomainNameSuffix, "."))
+}
+
+// inZone reports whether the normalised name is zone or below it. Both are
+// fully qualified, so the suffix only matches at a label boundary.
+func inZone(name, zone string) bool {
+	return zone == "." || name == zone || strings.HasSuffix(name, "."+zone)
+}
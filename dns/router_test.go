@@ -0,0 +1,131 @@
+package dns
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestDomainRouter(t *testing.T) {
+	p := &ProxyService{router: NewDomainRouter()}
+	p.router.SetTable(nhpRouteTable, RoutePriorityProtected, RouteTableFunc(p.routeNhpZone))
+	p.router.SetTable(domainRouteTable, RoutePriorityProtected, newDomainTable([]*Resource{
+		{
+			ResourceId: "Web",
+			Domains:    []string{"web.example.com", "*.apps.example.com"},
+			Services:   []*ServiceConfig{{Service: "https"}},
+		},
+		{ResourceId: "Mail", Domains: []string{"mail.example.com"}},
+	}))
+	p.router.SetTable(blockRouteTable, RoutePriorityBlock, RouteTableFunc(func(name string, qtype uint16) *Route {
+		if inZone(name, "ads.example.") {
+			return &Route{Action: RouteBlock}
+		}
+		return nil
+	}))
+
+	tests := []struct {
+		name      string
+		qtype     uint16
+		action    RouteAction
+		table     string
+		resId     string
+		subdomain string
+	}{
+		{name: "demo.nhp", action: RouteProtected, table: nhpRouteTable, resId: "demo"},
+		{name: "api.demo.nhp", action: RouteProtected, table: nhpRouteTable, resId: "demo", subdomain: "api"},
+		{name: "v1.API.Demo.NHP.", action: RouteProtected, table: nhpRouteTable, resId: "demo", subdomain: "v1.api"},
+		{name: "nhp.", action: RouteLocal, table: nhpRouteTable},
+		// nhp is only a zone as the last label.
+		{name: "foo.nhp.example.com", action: RouteForward},
+		{name: "foonhp.", action: RouteForward},
+		{name: "WEB.Example.COM", action: RouteProtected, table: domainRouteTable, resId: "web"},
+		{name: "a.b.apps.example.com", action: RouteProtected, table: domainRouteTable, resId: "web", subdomain: "a.b"},
+		{name: "_https._tcp.web.example.com", qtype: dns.TypeSRV, action: RouteProtected, table: domainRouteTable, resId: "web", subdomain: "_https._tcp"},
+		{name: "_https._tcp.web.example.com", action: RouteForward},
+		{name: "_imaps._tcp.mail.example.com", qtype: dns.TypeSRV, action: RouteForward},
+		{name: "web.example.com", qtype: dns.TypeTXT, action: RouteProtected, table: domainRouteTable, resId: "web"},
+		{name: "web.example.com", qtype: dns.TypeHTTPS, action: RouteForward},
+		// types not synthesized for a resource are left to the real zone.
+		{name: "web.example.com", qtype: dns.TypeMX, action: RouteForward},
+		{name: "a.apps.example.com", qtype: dns.TypeCAA, action: RouteForward},
+		{name: "apps.example.com", action: RouteForward},
+		{name: "x.ads.example", action: RouteBlock, table: blockRouteTable},
+		{name: "example.org", action: RouteForward},
+	}
+	for _, tt := range tests {
+		qtype := tt.qtype
+		if qtype == 0 {
+			qtype = dns.TypeA
+		}
+		route := p.router.Route(tt.name, qtype)
+		if route.Action != tt.action || route.Table != tt.table || route.ResourceId != tt.resId || route.Subdomain != tt.subdomain {
+			t.Errorf("route of %s = %s by %q, resource %q subdomain %q, want %s by %q, resource %q subdomain %q",
+				tt.name, route.Action, route.Table, route.ResourceId, route.Subdomain,
+				tt.action, tt.table, tt.resId, tt.subdomain)
+		}
+	}
+}
+
+func TestProtectedDomainForwardsOtherTypes(t *testing.T) {
+	upstream := &funcUpstream{answer: func(r *dns.Msg) (*dns.Msg, error) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		rr, _ := dns.NewRR(r.Question[0].Name + " 300 IN " + map[uint16]string{
+			dns.TypeMX:  "MX 10 mx.example.com.",
+			dns.TypeCAA: "CAA 0 issue \"ca.example.net\"",
+		}[r.Question[0].Qtype])
+		m.Answer = append(m.Answer, rr)
+		return m, nil
+	}}
+	p := testCacheProxy()
+	p.edns.Store(newEDNSPolicy(&EDNSConfig{}))
+	p.router.SetTable(domainRouteTable, RoutePriorityProtected, newDomainTable([]*Resource{
+		{ResourceId: "web", Domains: []string{"example.com", "*.example.com"}},
+	}))
+	p.upstreams.Store(&upstreamRouter{
+		defaultPool: NewUpstreamPool("", []Upstream{upstream}),
+		groups:      make(map[string]*UpstreamPool),
+	})
+
+	for _, q := range []*dns.Msg{
+		testQuery("example.com.", dns.TypeMX),
+		testQuery("example.com.", dns.TypeCAA),
+		testQuery("www.example.com.", dns.TypeCAA),
+	} {
+		w := newRecordWriter("127.0.0.1")
+		p.serve(w, q)
+		if w.msg == nil || len(w.msg.Answer) != 1 || w.msg.Answer[0].Header().Rrtype != q.Question[0].Qtype {
+			t.Errorf("%s %s = %v, want the upstream answer", q.Question[0].Name, dns.Type(q.Question[0].Qtype), w.msg)
+		}
+	}
+	if calls := upstream.calls.Load(); calls != 3 {
+		t.Errorf("%d upstream queries, want 3", calls)
+	}
+}
+
+func TestDomainRouterTables(t *testing.T) {
+	router := NewDomainRouter()
+	table := func(action RouteAction) RouteTable {
+		return RouteTableFunc(func(name string, qtype uint16) *Route {
+			return &Route{Action: action}
+		})
+	}
+	router.SetTable("block", RoutePriorityBlock, table(RouteBlock))
+	router.SetTable("local", RoutePriorityLocal, table(RouteLocal))
+	if route := router.Route("example.com", dns.TypeA); route.Table != "local" {
+		t.Errorf("route by %s, want the table of the lowest priority", route.Table)
+	}
+
+	// a table of the same name is replaced.
+	router.SetTable("local", RoutePriorityLocal, RouteTableFunc(func(name string, qtype uint16) *Route {
+		return nil
+	}))
+	if route := router.Route("example.com", dns.TypeA); route.Table != "block" {
+		t.Errorf("route by %s, want block", route.Table)
+	}
+	router.RemoveTable("block")
+	if route := router.Route("example.com", dns.TypeA); route.Action != RouteForward {
+		t.Errorf("route %s without tables, want forward", route.Action)
+	}
+}
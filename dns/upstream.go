@@ -0,0 +1,342 @@
+package dns
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/OpenNHP/opennhp/nhp/log"
+	"github.com/miekg/dns"
+
+	"github.com/OpenNHP/StealthDNS/common"
+)
+
+const (
+	StrategyFailover = "failover"
+	StrategyParallel = "parallel"
+	StrategyFastest  = "fastest"
+
+	defaultUpstreamTimeout = 2 * time.Second
+	// an upstream is taken out of rotation after this many consecutive failures.
+	maxUpstreamFailures = 3
+	minUpstreamBackoff  = 5 * time.Second
+	maxUpstreamBackoff  = 60 * time.Second
+)
+
+var errNoUpstream = errors.New("no upstream dns available")
+
+// Upstream is a dns server queries are forwarded to.
+type Upstream interface {
+	Exchange(r *dns.Msg) (*dns.Msg, error)
+	Address() string
+}
+
+// plainUpstream is a classic dns server on udp, retried over tcp on truncation.
+type plainUpstream struct {
+	addr    string
+	timeout time.Duration
+}
+
+func (u *plainUpstream) Address() string {
+	return u.addr
+}
+
+func (u *plainUpstream) Exchange(r *dns.Msg) (*dns.Msg, error) {
+	// padding only hides the message length on encrypted transports.
+	r = withoutPadding(r)
+	client := &dns.Client{
+		Timeout: u.timeout,
+	}
+	resp, _, err := client.Exchange(r, u.addr)
+	if err == nil && resp.Truncated {
+		// the upstream answer did not fit into udp, fetch the full answer over tcp.
+		client.Net = "tcp"
+		resp, _, err = client.Exchange(r, u.addr)
+	}
+	return resp, err
+}
+
+// newUpstream creates an upstream from a server address like "8.8.8.8" or "[::1]:5353".
+func newUpstream(server string, timeout time.Duration) (Upstream, error) {
+	server = strings.TrimSpace(server)
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(strings.Trim(server, "[]"), "53")
+	}
+	host, _, err := net.SplitHostPort(server)
+	if err != nil {
+		return nil, err
+	}
+	if net.ParseIP(host) == nil {
+		return nil, fmt.Errorf("upstream %s is not an ip address", host)
+	}
+	return &plainUpstream{addr: server, timeout: timeout}, nil
+}
+
+// upstreamHealth tracks failures and latency of one upstream.
+type upstreamHealth struct {
+	Upstream
+
+	mu        sync.Mutex
+	failures  int
+	downUntil time.Time
+	rtt       time.Duration
+}
+
+func (h *upstreamHealth) healthy(now time.Time) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return now.After(h.downUntil)
+}
+
+func (h *upstreamHealth) latency() time.Duration {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.rtt
+}
+
+func (h *upstreamHealth) success(rtt time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.failures = 0
+	h.downUntil = time.Time{}
+	if h.rtt == 0 {
+		h.rtt = rtt
+	} else {
+		// exponentially weighted moving average
+		h.rtt = (h.rtt*7 + rtt) / 8
+	}
+}
+
+func (h *upstreamHealth) failure() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.failures++
+	if h.failures < maxUpstreamFailures {
+		return
+	}
+	backoff := minUpstreamBackoff << (h.failures - maxUpstreamFailures)
+	if backoff > maxUpstreamBackoff || backoff <= 0 {
+		backoff = maxUpstreamBackoff
+	}
+	h.downUntil = time.Now().Add(backoff)
+	log.Warning("upstream dns %s failed %d times, skipped for %s", h.Address(), h.failures, backoff)
+}
+
+func (h *upstreamHealth) exchange(r *dns.Msg) (*dns.Msg, error) {
+	start := time.Now()
+	resp, err := h.Exchange(r)
+	if err == nil && resp.Rcode == dns.RcodeServerFailure {
+		err = fmt.Errorf("upstream returns %s", dns.RcodeToString[resp.Rcode])
+	}
+	if err != nil {
+		h.failure()
+		return resp, err
+	}
+	h.success(time.Since(start))
+	return resp, nil
+}
+
+// UpstreamPool forwards queries to a set of upstreams using a strategy:
+// "failover" tries them in order, "parallel" races all of them and
+// "fastest" tries them by measured latency.
+type UpstreamPool struct {
+	strategy  string
+	upstreams []*upstreamHealth
+}
+
+func NewUpstreamPool(strategy string, upstreams []Upstream) *UpstreamPool {
+	pool := &UpstreamPool{
+		strategy: strings.ToLower(strategy),
+	}
+	switch pool.strategy {
+	case StrategyFailover, StrategyParallel, StrategyFastest:
+	default:
+		if len(pool.strategy) > 0 {
+			log.Warning("unknown upstream strategy %s, using %s", strategy, StrategyFailover)
+		}
+		pool.strategy = StrategyFailover
+	}
+	for _, upstream := range upstreams {
+		pool.upstreams = append(pool.upstreams, &upstreamHealth{Upstream: upstream})
+	}
+	return pool
+}
+
+// candidates returns healthy upstreams first, unhealthy ones are kept as
+// a last resort so a query is never dropped without trying.
+func (pool *UpstreamPool) candidates() []*upstreamHealth {
+	now := time.Now()
+	var healthy, unhealthy []*upstreamHealth
+	for _, upstream := range pool.upstreams {
+		if upstream.healthy(now) {
+			healthy = append(healthy, upstream)
+		} else {
+			unhealthy = append(unhealthy, upstream)
+		}
+	}
+	if pool.strategy == StrategyFastest {
+		// upstreams not measured yet are of unknown latency, they follow the
+		// measured ones in the configured order.
+		sort.SliceStable(healthy, func(i, j int) bool {
+			li, lj := healthy[i].latency(), healthy[j].latency()
+			if li == 0 || lj == 0 {
+				return li != 0 && lj == 0
+			}
+			return li < lj
+		})
+	}
+	return append(healthy, unhealthy...)
+}
+
+// Exchange forwards r and returns the answer along with the address of
+// the upstream that produced it.
+func (pool *UpstreamPool) Exchange(r *dns.Msg) (*dns.Msg, string, error) {
+	candidates := pool.candidates()
+	if len(candidates) == 0 {
+		return nil, "", errNoUpstream
+	}
+	if pool.strategy == StrategyParallel && len(candidates) > 1 {
+		return pool.race(r, candidates)
+	}
+
+	var lastResp *dns.Msg
+	var lastAddr string
+	var lastErr error
+	for _, upstream := range candidates {
+		resp, err := upstream.exchange(r)
+		if err == nil {
+			return resp, upstream.Address(), nil
+		}
+		log.Debug("upstream dns %s fail: %v", upstream.Address(), err)
+		if resp != nil {
+			lastResp, lastAddr = resp, upstream.Address()
+		}
+		lastErr = err
+	}
+	if lastResp != nil {
+		// every upstream failed, pass the last server failure on to the client.
+		return lastResp, lastAddr, nil
+	}
+	return nil, "", lastErr
+}
+
+func (pool *UpstreamPool) race(r *dns.Msg, candidates []*upstreamHealth) (*dns.Msg, string, error) {
+	type result struct {
+		resp *dns.Msg
+		addr string
+		err  error
+	}
+	resultCh := make(chan result, len(candidates))
+	for _, upstream := range candidates {
+		go func(upstream *upstreamHealth, r *dns.Msg) {
+			resp, err := upstream.exchange(r)
+			resultCh <- result{resp: resp, addr: upstream.Address(), err: err}
+		}(upstream, r.Copy())
+	}
+
+	var last result
+	for range candidates {
+		res := <-resultCh
+		if res.err == nil {
+			return res.resp, res.addr, nil
+		}
+		log.Debug("upstream dns %s fail: %v", res.addr, res.err)
+		if res.resp != nil || last.resp == nil {
+			last = res
+		}
+	}
+	if last.resp != nil {
+		return last.resp, last.addr, nil
+	}
+	return nil, "", last.err
+}
+
+// Close releases the connections of the upstreams of the pool.
+func (pool *UpstreamPool) Close() {
+	for _, upstream := range pool.upstreams {
+		if closer, ok := upstream.Upstream.(io.Closer); ok {
+			_ = closer.Close()
+		}
+	}
+}
+
+// Addresses lists the upstreams of the pool.
+func (pool *UpstreamPool) Addresses() []string {
+	addrs := make([]string, 0, len(pool.upstreams))
+	for _, upstream := range pool.upstreams {
+		addrs = append(addrs, upstream.Address())
+	}
+	return addrs
+}
+
+func upstreamTimeout(conf *UpstreamConfig) time.Duration {
+	if conf.Timeout > 0 {
+		return time.Duration(conf.Timeout) * time.Second
+	}
+	return defaultUpstreamTimeout
+}
+
+// newDefaultUpstreamPool builds the pool for queries not matching any forward
+// rule, from the configured servers and, unless disabled, the dns servers
+// detected on the system.
+func (p *ProxyService) newDefaultUpstreamPool(conf *UpstreamConfig) *UpstreamPool {
+	servers := append([]string{}, conf.Servers...)
+	if !conf.IgnoreSystemDNS {
+		servers = append(servers, p.systemDNS...)
+	}
+	if len(servers) == 0 && len(conf.DoH) == 0 && len(conf.DoT) == 0 {
+		servers = append(servers, common.DefaultUpstreamDNS)
+	}
+	return p.newUpstreamPool(defaultUpstreamGroup, conf.Strategy, servers, conf.DoH, conf.DoT, upstreamTimeout(conf))
+}
+
+// newUpstreamPool builds an upstream pool from encrypted and plain servers.
+func (p *ProxyService) newUpstreamPool(name, strategy string, servers []string, dohs []*DoHConfig, dots []*DoTConfig, timeout time.Duration) *UpstreamPool {
+	// encrypted upstreams resolve their host names with the plain servers. Those
+	// of a named group may be internal, they are never resolved by other servers.
+	resolvers := append([]string{}, servers...)
+	if name == defaultUpstreamGroup {
+		resolvers = append(append(resolvers, p.systemDNS...), common.DefaultUpstreamDNS)
+	}
+
+	var upstreams []Upstream
+	for _, doh := range dohs {
+		upstream, err := newDoHUpstream(doh, resolvers, timeout)
+		if err != nil {
+			log.Error("invalid doh upstream %s: %v", doh.Url, err)
+			continue
+		}
+		upstreams = append(upstreams, upstream)
+	}
+	for _, dot := range dots {
+		upstream, err := newDoTUpstream(dot, resolvers, timeout)
+		if err != nil {
+			log.Error("invalid dot upstream %s: %v", dot.Server, err)
+			continue
+		}
+		upstreams = append(upstreams, upstream)
+	}
+
+	seen := make(map[string]bool)
+	for _, server := range servers {
+		upstream, err := newUpstream(server, timeout)
+		if err != nil {
+			log.Error("invalid upstream dns %s: %v", server, err)
+			continue
+		}
+		if seen[upstream.Address()] {
+			continue
+		}
+		seen[upstream.Address()] = true
+		upstreams = append(upstreams, upstream)
+	}
+
+	pool := NewUpstreamPool(strategy, upstreams)
+	log.Info("upstream group %s: dns %v, strategy %s", name, pool.Addresses(), pool.strategy)
+	return pool
+}
@@ -0,0 +1,250 @@
+package dns
+
+import (
+	"errors"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/OpenNHP/StealthDNS/common"
+)
+
+// fakeUpstream answers with rcode after delay, or fails with err.
+type fakeUpstream struct {
+	addr  string
+	delay time.Duration
+	rcode int
+	err   error
+	calls atomic.Int32
+}
+
+func (u *fakeUpstream) Address() string {
+	return u.addr
+}
+
+func (u *fakeUpstream) Exchange(r *dns.Msg) (*dns.Msg, error) {
+	u.calls.Add(1)
+	time.Sleep(u.delay)
+	if u.err != nil {
+		return nil, u.err
+	}
+	m := new(dns.Msg)
+	m.SetRcode(r, u.rcode)
+	return m, nil
+}
+
+func testQuery(name string, qtype uint16) *dns.Msg {
+	r := new(dns.Msg)
+	r.SetQuestion(name, qtype)
+	return r
+}
+
+func TestUpstreamPoolExchange(t *testing.T) {
+	errDown := errors.New("down")
+	tests := []struct {
+		name      string
+		strategy  string
+		upstreams []*fakeUpstream
+		wantAddr  string
+		wantRcode int
+		wantErr   bool
+	}{
+		{
+			name:      "failover to the second",
+			strategy:  StrategyFailover,
+			upstreams: []*fakeUpstream{{addr: "a", err: errDown}, {addr: "b"}},
+			wantAddr:  "b",
+		},
+		{
+			name:      "failover skips servfail",
+			strategy:  StrategyFailover,
+			upstreams: []*fakeUpstream{{addr: "a", rcode: dns.RcodeServerFailure}, {addr: "b"}},
+			wantAddr:  "b",
+		},
+		{
+			name:      "last servfail is passed on",
+			strategy:  StrategyFailover,
+			upstreams: []*fakeUpstream{{addr: "a", rcode: dns.RcodeServerFailure}, {addr: "b", err: errDown}},
+			wantAddr:  "a",
+			wantRcode: dns.RcodeServerFailure,
+		},
+		{
+			name:      "all fail",
+			strategy:  StrategyFailover,
+			upstreams: []*fakeUpstream{{addr: "a", err: errDown}, {addr: "b", err: errDown}},
+			wantErr:   true,
+		},
+		{
+			name:      "nxdomain is an answer",
+			strategy:  StrategyFailover,
+			upstreams: []*fakeUpstream{{addr: "a", rcode: dns.RcodeNameError}, {addr: "b"}},
+			wantAddr:  "a",
+			wantRcode: dns.RcodeNameError,
+		},
+		{
+			name:      "parallel takes the first answer",
+			strategy:  StrategyParallel,
+			upstreams: []*fakeUpstream{{addr: "slow", delay: 200 * time.Millisecond}, {addr: "fast"}},
+			wantAddr:  "fast",
+		},
+		{
+			name:      "parallel skips failures",
+			strategy:  StrategyParallel,
+			upstreams: []*fakeUpstream{{addr: "a", err: errDown}, {addr: "b", delay: 20 * time.Millisecond}},
+			wantAddr:  "b",
+		},
+		{
+			name:     "no upstream",
+			strategy: StrategyFailover,
+			wantErr:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var upstreams []Upstream
+			for _, u := range tt.upstreams {
+				upstreams = append(upstreams, u)
+			}
+			pool := NewUpstreamPool(tt.strategy, upstreams)
+			resp, addr, err := pool.Exchange(testQuery("example.com.", dns.TypeA))
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("Exchange() = %v from %s, want an error", resp, addr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Exchange() error = %v", err)
+			}
+			if addr != tt.wantAddr || resp.Rcode != tt.wantRcode {
+				t.Errorf("Exchange() = %s from %s, want %s from %s", dns.RcodeToString[resp.Rcode], addr, dns.RcodeToString[tt.wantRcode], tt.wantAddr)
+			}
+		})
+	}
+}
+
+func TestUpstreamPoolBackoff(t *testing.T) {
+	down := &fakeUpstream{addr: "down", err: errors.New("down")}
+	up := &fakeUpstream{addr: "up"}
+	pool := NewUpstreamPool(StrategyFailover, []Upstream{down, up})
+
+	for i := 0; i < maxUpstreamFailures; i++ {
+		if _, addr, err := pool.Exchange(testQuery("example.com.", dns.TypeA)); err != nil || addr != "up" {
+			t.Fatalf("Exchange() = %s, %v, want up", addr, err)
+		}
+	}
+	if pool.upstreams[0].healthy(time.Now()) {
+		t.Fatalf("upstream is healthy after %d failures", maxUpstreamFailures)
+	}
+	if !pool.upstreams[0].healthy(time.Now().Add(minUpstreamBackoff + time.Second)) {
+		t.Errorf("upstream is still down after the backoff")
+	}
+
+	// the unhealthy upstream is skipped while another one answers.
+	calls := down.calls.Load()
+	if _, addr, _ := pool.Exchange(testQuery("example.com.", dns.TypeA)); addr != "up" {
+		t.Errorf("Exchange() = %s, want up", addr)
+	}
+	if down.calls.Load() != calls {
+		t.Errorf("unhealthy upstream was queried")
+	}
+
+	// the backoff doubles with each further failure, up to the maximum.
+	h := pool.upstreams[0]
+	for i := 0; i < 10; i++ {
+		h.failure()
+	}
+	h.mu.Lock()
+	backoff := time.Until(h.downUntil)
+	h.mu.Unlock()
+	if backoff > maxUpstreamBackoff || backoff < maxUpstreamBackoff-time.Second {
+		t.Errorf("backoff = %s, want %s", backoff, maxUpstreamBackoff)
+	}
+
+	// a success brings it back.
+	h.success(time.Millisecond)
+	if !h.healthy(time.Now()) {
+		t.Errorf("upstream is down after a success")
+	}
+}
+
+func TestUpstreamPoolFastest(t *testing.T) {
+	upstreams := []Upstream{
+		&fakeUpstream{addr: "unmeasured1"},
+		&fakeUpstream{addr: "slow"},
+		&fakeUpstream{addr: "unmeasured2"},
+		&fakeUpstream{addr: "fast"},
+		&fakeUpstream{addr: "down"},
+	}
+	pool := NewUpstreamPool(StrategyFastest, upstreams)
+	pool.upstreams[1].success(50 * time.Millisecond)
+	pool.upstreams[3].success(5 * time.Millisecond)
+	pool.upstreams[4].success(time.Millisecond)
+	for i := 0; i < maxUpstreamFailures; i++ {
+		pool.upstreams[4].failure()
+	}
+
+	var got []string
+	for _, upstream := range pool.candidates() {
+		got = append(got, upstream.Address())
+	}
+	want := []string{"fast", "slow", "unmeasured1", "unmeasured2", "down"}
+	if len(got) != len(want) {
+		t.Fatalf("candidates() = %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("candidates() = %v, want %v", got, want)
+		}
+	}
+}
+
+func TestNewUpstream(t *testing.T) {
+	tests := []struct {
+		server  string
+		want    string
+		wantErr bool
+	}{
+		{server: "8.8.8.8", want: "8.8.8.8:53"},
+		{server: " 1.1.1.1:5353 ", want: "1.1.1.1:5353"},
+		{server: "::1", want: "[::1]:53"},
+		{server: "[::1]:5353", want: "[::1]:5353"},
+		{server: "dns.example.com", wantErr: true},
+	}
+	for _, tt := range tests {
+		upstream, err := newUpstream(tt.server, time.Second)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("newUpstream(%q) = %s, want an error", tt.server, upstream.Address())
+			}
+			continue
+		}
+		if err != nil || upstream.Address() != tt.want {
+			t.Errorf("newUpstream(%q) = %v, %v, want %s", tt.server, upstream, err, tt.want)
+		}
+	}
+}
+
+func TestUpstreamPoolBootstrap(t *testing.T) {
+	p := &ProxyService{systemDNS: []string{"192.0.2.53"}}
+	dots := []*DoTConfig{{Server: "dns.corp.example:853"}}
+	tests := []struct {
+		group   string
+		servers []string
+		want    []string
+	}{
+		{group: defaultUpstreamGroup, servers: []string{"192.0.2.1"}, want: []string{"192.0.2.1", "192.0.2.53", common.DefaultUpstreamDNS}},
+		{group: "corp", servers: []string{"10.8.0.1"}, want: []string{"10.8.0.1"}},
+		{group: "corp"},
+	}
+	for _, tt := range tests {
+		pool := p.newUpstreamPool(tt.group, "", tt.servers, nil, dots, time.Second)
+		dot := pool.upstreams[0].Upstream.(*dotUpstream)
+		if got := dot.dialer.resolvers; strings.Join(got, " ") != strings.Join(tt.want, " ") {
+			t.Errorf("group %s with servers %v bootstraps with %v, want %v", tt.group, tt.servers, got, tt.want)
+		}
+	}
+}
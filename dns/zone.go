@@ -0,0 +1,123 @@
+package dns
+
+import (
+	"strings"
+
+	"github.com/OpenNHP/opennhp/nhp/log"
+	"github.com/miekg/dns"
+)
+
+// the proxy is the only name server of the nhp zone, it is reached as localhost.
+const (
+	zoneNameServer = "localhost."
+	zoneSerial     = 1
+	zoneApexTTL    = 3600
+)
+
+// nhpSOA is the synthetic SOA record of the nhp zone. Its minimum field is the
+// negative caching time of NXDOMAIN and NODATA answers (RFC 2308).
+func nhpSOA(ttl uint32) *dns.SOA {
+	return syntheticSOA(nhpZone(), ttl)
+}
+
+// negativeSOA is the SOA record of a NXDOMAIN or NODATA answer for name. Names
+// outside of the nhp zone are real domain names of resources, they are their
+// own zone.
+func negativeSOA(name string, ttl uint32) *dns.SOA {
+	if inZone(normalizeName(name), nhpZone()) {
+		return nhpSOA(ttl)
+	}
+	return syntheticSOA(normalizeName(name), ttl)
+}
+
+func syntheticSOA(zone string, ttl uint32) *dns.SOA {
+	return &dns.SOA{
+		Hdr:     dns.RR_Header{Name: zone, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: ttl},
+		Ns:      zoneNameServer,
+		Mbox:    "hostmaster." + zone,
+		Serial:  zoneSerial,
+		Refresh: 3600,
+		Retry:   600,
+		Expire:  86400,
+		Minttl:  ttl,
+	}
+}
+
+// routeNhpZone routes the .nhp zone. Its apex is answered locally, the
+// names below it are protected. The label left of the zone is the resource
+// id, so api.demo.nhp knocks the resource demo.
+func (p *ProxyService) routeNhpZone(name string, qtype uint16) *Route {
+	zone := nhpZone()
+	if name == zone {
+		return &Route{Action: RouteLocal, Handler: dns.HandlerFunc(p.apexAnswer)}
+	}
+	if !inZone(name, zone) {
+		return nil
+	}
+	labels := dns.SplitDomainName(strings.TrimSuffix(name, "."+zone))
+	return &Route{
+		Action:     RouteProtected,
+		ResourceId: labels[len(labels)-1],
+		Subdomain:  strings.Join(labels[:len(labels)-1], "."),
+	}
+}
+
+// apexAnswer answers queries for the apex of the nhp zone with its SOA and
+// NS records.
+func (p *ProxyService) apexAnswer(w dns.ResponseWriter, r *dns.Msg) {
+	question := r.Question[0]
+	zone := nhpZone()
+	soa := nhpSOA(p.failure.Load().ttl)
+	soa.Hdr.Ttl = zoneApexTTL
+	ns := &dns.NS{
+		Hdr: dns.RR_Header{Name: zone, Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: zoneApexTTL},
+		Ns:  zoneNameServer,
+	}
+
+	m := new(dns.Msg)
+	m.SetReply(r)
+	m.Authoritative = true
+	switch question.Qtype {
+	case dns.TypeSOA:
+		m.Answer = append(m.Answer, soa)
+		m.Ns = append(m.Ns, ns)
+	case dns.TypeNS:
+		m.Answer = append(m.Answer, ns)
+	case dns.TypeANY:
+		m.Answer = append(m.Answer, soa, ns)
+	default:
+		m.Ns = append(m.Ns, nhpSOA(p.failure.Load().ttl))
+	}
+	p.writeMsg(w, r, m)
+}
+
+// nxDomain answers a name of the nhp zone that is no resource.
+func (p *ProxyService) nxDomain(w dns.ResponseWriter, r *dns.Msg) {
+	m := new(dns.Msg)
+	m.SetRcode(r, dns.RcodeNameError)
+	m.Authoritative = true
+	m.Ns = append(m.Ns, negativeSOA(r.Question[0].Name, p.failure.Load().ttl))
+	p.writeMsg(w, r, m)
+}
+
+// anyAnswer answers ANY queries of protected names with a synthesized HINFO
+// record (RFC 8482), so they neither knock nor amplify.
+func (p *ProxyService) anyAnswer(w dns.ResponseWriter, r *dns.Msg) {
+	m := new(dns.Msg)
+	m.SetReply(r)
+	m.Authoritative = true
+	m.Answer = append(m.Answer, &dns.HINFO{
+		Hdr: dns.RR_Header{Name: r.Question[0].Name, Rrtype: dns.TypeHINFO, Class: dns.ClassINET, Ttl: zoneApexTTL},
+		Cpu: "RFC8482",
+	})
+	p.writeMsg(w, r, m)
+}
+
+// refuseChaos refuses CHAOS class queries like version.bind, so the proxy
+// neither reveals its version nor forwards them.
+func (p *ProxyService) refuseChaos(w dns.ResponseWriter, r *dns.Msg) {
+	log.Debug("refuse chaos query %s", r.Question[0].Name)
+	m := new(dns.Msg)
+	m.SetRcode(r, dns.RcodeRefused)
+	p.writeMsg(w, r, m)
+}
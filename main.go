@@ -3,16 +3,19 @@ package main
 import (
 	"fmt"
 	"log"
+	"net"
 	"os"
 	"os/signal"
 	"path/filepath"
 	"runtime"
+	"strings"
 	"syscall"
 	"time"
 
 	"github.com/OpenNHP/StealthDNS/cert"
 	"github.com/OpenNHP/StealthDNS/dns"
 	"github.com/OpenNHP/StealthDNS/version"
+	miekg "github.com/miekg/dns"
 	"github.com/urfave/cli/v2"
 )
 
@@ -99,11 +102,105 @@ func main() {
 		},
 	}
 
+	explainPolicyCmd := &cli.Command{
+		Name:    "explain-policy",
+		Aliases: []string{"e"},
+		Usage:   "show which rule of etc/policy.toml matches a query, without answering it.",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:     "name",
+				Aliases:  []string{"n"},
+				Usage:    "query domain name.",
+				Required: true,
+			},
+			&cli.StringFlag{
+				Name:    "type",
+				Aliases: []string{"t"},
+				Usage:   "query type.",
+				Value:   "A",
+			},
+			&cli.StringFlag{
+				Name:    "client",
+				Aliases: []string{"c"},
+				Usage:   "client address of the query.",
+				Value:   "127.0.0.1",
+			},
+			&cli.StringFlag{
+				Name:  "time",
+				Usage: "local time of the query as \"2006-01-02 15:04\"; defaults to now.",
+			},
+		},
+		Action: func(c *cli.Context) error {
+			return explainPolicy(c.String("name"), c.String("type"), c.String("client"), c.String("time"))
+		},
+	}
+
+	cacheCmd := &cli.Command{
+		Name:  "cache",
+		Usage: "inspect and flush the caches of the running local DNS proxy service.",
+		Subcommands: []*cli.Command{
+			{
+				Name:  "stats",
+				Usage: "show the counters of the caches.",
+				Action: func(c *cli.Context) error {
+					return cacheStats()
+				},
+			},
+			{
+				Name:  "list",
+				Usage: "list the cached entries.",
+				Action: func(c *cli.Context) error {
+					return cacheEntries()
+				},
+			},
+			{
+				Name:  "ttl",
+				Usage: "show how long the knock result of a resource stays cached.",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:     "resource",
+						Aliases:  []string{"r"},
+						Usage:    "resource id.",
+						Required: true,
+					},
+				},
+				Action: func(c *cli.Context) error {
+					return cacheResourceTTL(c.String("resource"))
+				},
+			},
+			{
+				Name:  "flush",
+				Usage: "flush the cached answers of a domain name, or all cached entries.",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:    "name",
+						Aliases: []string{"n"},
+						Usage:   "domain name to flush.",
+					},
+					&cli.StringFlag{
+						Name:    "type",
+						Aliases: []string{"t"},
+						Usage:   "query type to flush; flushes all types if empty.",
+					},
+					&cli.BoolFlag{
+						Name:  "all",
+						Usage: "flush all cached entries.",
+					},
+				},
+				Action: func(c *cli.Context) error {
+					return cacheFlush(c.String("name"), c.String("type"), c.Bool("all"))
+				},
+			},
+		},
+	}
+
 	app.Commands = []*cli.Command{
 		runCmd,
 		certInstallCmd,
 		certUninstallCmd,
 		certCreateCmd,
+		explainPolicyCmd,
+		cacheCmd,
 	}
 
 	if err := app.Run(os.Args); err != nil {
@@ -111,6 +208,117 @@ func main() {
 	}
 }
 
+func explainPolicy(name string, qtype string, client string, at string) error {
+	exeFilePath, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	query := &dns.PolicyQuery{Name: name, Time: time.Now()}
+	var found bool
+	if query.Qtype, found = miekg.StringToType[strings.ToUpper(qtype)]; !found {
+		return fmt.Errorf("unknown query type %s", qtype)
+	}
+	if query.Client = net.ParseIP(client); query.Client == nil {
+		return fmt.Errorf("invalid client address %s", client)
+	}
+	if len(at) > 0 {
+		if query.Time, err = time.ParseInLocation("2006-01-02 15:04", at, time.Local); err != nil {
+			return err
+		}
+	}
+
+	explanation, err := dns.ExplainPolicyFile(filepath.Join(filepath.Dir(exeFilePath), "etc", "policy.toml"), query)
+	if err != nil {
+		return err
+	}
+	fmt.Println(explanation)
+	return nil
+}
+
+func newAdminClient() (*dns.AdminClient, error) {
+	exeFilePath, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	return dns.NewAdminClient(filepath.Join(filepath.Dir(exeFilePath), "etc", "config.toml"))
+}
+
+func cacheStats() error {
+	client, err := newAdminClient()
+	if err != nil {
+		return err
+	}
+	stats, err := client.CacheStats()
+	if err != nil {
+		return err
+	}
+	for _, name := range []string{dns.ResourceCacheName, dns.ForwardCacheName} {
+		s := stats[name]
+		fmt.Printf("%s: size %d/%d, hits %d, misses %d, evictions %d, expired %d\n",
+			name, s.Size, s.MaxSize, s.Hits, s.Misses, s.Evictions, s.Expired)
+	}
+	return nil
+}
+
+func cacheEntries() error {
+	client, err := newAdminClient()
+	if err != nil {
+		return err
+	}
+	entries, err := client.CacheEntries()
+	if err != nil {
+		return err
+	}
+	for _, name := range []string{dns.ResourceCacheName, dns.ForwardCacheName} {
+		fmt.Printf("%s:\n", name)
+		for _, entry := range entries[name] {
+			fmt.Printf("  %s\t%s\n", entry.Key, entry.RemainingTTL.Round(time.Second))
+		}
+	}
+	return nil
+}
+
+func cacheResourceTTL(resId string) error {
+	client, err := newAdminClient()
+	if err != nil {
+		return err
+	}
+	ttl, err := client.ResourceTTL(resId)
+	if err != nil {
+		return err
+	}
+	fmt.Println(ttl.Round(time.Second))
+	return nil
+}
+
+func cacheFlush(name string, qtype string, all bool) error {
+	if all == (name != "") {
+		return fmt.Errorf("specify either --name or --all")
+	}
+	client, err := newAdminClient()
+	if err != nil {
+		return err
+	}
+	if all {
+		if err := client.FlushAllCaches(); err != nil {
+			return err
+		}
+		fmt.Println("all cached entries flushed")
+		return nil
+	}
+	if qtype != "" {
+		if _, found := miekg.StringToType[strings.ToUpper(qtype)]; !found {
+			return fmt.Errorf("unknown query type %s", qtype)
+		}
+	}
+	flushed, err := client.FlushCache(name, qtype)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%d cached entries of %s flushed\n", flushed, name)
+	return nil
+}
+
 func runApp() error {
 	log.Println("Stealth DNS starting")
 	if !isAdminPermission() {
@@ -1162,24 +1162,23 @@ func (a *App) SaveClientConfig(config ClientConfig) error {
 		return fmt.Errorf("failed to read config file: %v", err)
 	}
 
-	// If file exists, try to preserve UserData section
-	var userData map[string]interface{}
+	// If file exists, preserve UserData and the StealthDNS sections (Listen, ...)
+	fullConfig := make(map[string]interface{})
 	if len(originalData) > 0 {
-		var fullConfig struct {
-			ClientConfig
-			UserData map[string]interface{} `toml:"UserData"`
-		}
 		toml.Unmarshal(originalData, &fullConfig)
-		userData = fullConfig.UserData
 	}
 
-	// Build complete configuration
-	fullConfig := struct {
-		ClientConfig
-		UserData map[string]interface{} `toml:"UserData,omitempty"`
-	}{
-		ClientConfig: config,
-		UserData:     userData,
+	// Overwrite client fields with the edited values
+	clientData, err := toml.Marshal(config)
+	if err != nil {
+		return fmt.Errorf("failed to serialize config: %v", err)
+	}
+	var clientFields map[string]interface{}
+	if err := toml.Unmarshal(clientData, &clientFields); err != nil {
+		return fmt.Errorf("failed to serialize config: %v", err)
+	}
+	for key, value := range clientFields {
+		fullConfig[key] = value
 	}
 
 	data, err := toml.Marshal(fullConfig)